@@ -0,0 +1,284 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"unicode/utf8"
+)
+
+// idnForm is how internationalized domains are exposed, a-label (punycode)
+// or u-label (Unicode).
+var idnForm *string
+
+func addressInit() {
+	if *idnForm != "a-label" && *idnForm != "u-label" {
+		log.Fatalf("invalid idn form: %s", *idnForm)
+	}
+}
+
+// addressDomain extracts the domain of a MAIL FROM or RCPT TO address in a
+// normalized form, so that a domain is a single label value whether it is
+// written in Unicode or punycode, or with a different case.
+func addressDomain(address string) string {
+	address = strings.TrimSpace(address)
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "<"), ">")
+	// obsolete source routes, <@relay:user@example.org>
+	if strings.HasPrefix(address, "@") {
+		if i := strings.IndexByte(address, ':'); i != -1 {
+			address = address[i+1:]
+		}
+	}
+
+	// the domain follows the last @ outside of a quoted local part
+	at := -1
+	quoted := false
+	for i := 0; i < len(address); i++ {
+		switch address[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case '@':
+			if !quoted {
+				at = i
+			}
+		}
+	}
+	if at == -1 {
+		return ""
+	}
+	return normalizeDomain(address[at+1:])
+}
+
+func normalizeDomain(domain string) string {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		return addressLiteral(domain[1 : len(domain)-1])
+	}
+
+	// ideographic full stops separate labels too
+	domain = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(domain)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if isASCII(domain) && (*idnForm != "u-label" || !strings.Contains(domain, "xn--")) {
+		return domain
+	}
+
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		switch {
+		case !isASCII(label):
+			if !utf8.ValidString(label) {
+				return ""
+			}
+			if *idnForm != "u-label" {
+				labels[i] = "xn--" + punycode(label)
+			}
+		case *idnForm == "u-label" && strings.HasPrefix(label, "xn--"):
+			// invalid punycode is left as is rather than guessed at
+			if decoded, err := unpunycode(label[4:]); err == nil && !isASCII(decoded) {
+				labels[i] = strings.ToLower(decoded)
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// normalizeHostname normalizes host names such as relays, addresses are
+// left as is.
+func normalizeHostname(host string) string {
+	if host == "" || net.ParseIP(host) != nil {
+		return host
+	}
+	return normalizeDomain(host)
+}
+
+// addressLiteral normalizes [192.0.2.1] and [IPv6:2001:db8::1] domains.
+func addressLiteral(literal string) string {
+	if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+		if ip := net.ParseIP(literal[5:]); ip != nil {
+			return "[IPv6:" + ip.String() + "]"
+		}
+	} else if ip := net.ParseIP(literal); ip != nil && ip.To4() != nil {
+		return "[" + ip.String() + "]"
+	}
+	return ""
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycode parameters, RFC 3492 section 5.
+const (
+	base        = 36
+	tmin        = 1
+	tmax        = 26
+	skew        = 38
+	damp        = 700
+	initialBias = 72
+	initialN    = 128
+)
+
+func adapt(delta int, points int, first bool) int {
+	if first {
+		delta /= damp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((base-tmin)*tmax)/2 {
+		delta /= base - tmin
+		k += base
+	}
+	return k + (base-tmin+1)*delta/(delta+skew)
+}
+
+// punycode encodes a label as described in RFC 3492, without the xn--
+// prefix.
+func punycode(label string) string {
+	digit := func(d int) byte {
+		if d < 26 {
+			return byte('a' + d)
+		}
+		return byte('0' + d - 26)
+	}
+
+	runes := []rune(label)
+	out := []byte{}
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := initialN, 0, initialBias
+	for handled < len(runes) {
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tmin {
+					t = tmin
+				} else if t > tmax {
+					t = tmax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			out = append(out, digit(q))
+			bias = adapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+var errPunycode = errors.New("invalid punycode")
+
+// unpunycode decodes a label encoded by punycode.
+func unpunycode(encoded string) (string, error) {
+	output := []rune{}
+	if i := strings.LastIndexByte(encoded, '-'); i != -1 {
+		for _, r := range encoded[:i] {
+			if r >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			output = append(output, r)
+		}
+		encoded = encoded[i+1:]
+	}
+
+	n, bias := initialN, initialBias
+	for i := 0; encoded != ""; {
+		previous, w := i, 1
+		for k := base; ; k += base {
+			if encoded == "" {
+				return "", errPunycode
+			}
+			c := encoded[0]
+			encoded = encoded[1:]
+			var d int
+			switch {
+			case c >= 'a' && c <= 'z':
+				d = int(c - 'a')
+			case c >= 'A' && c <= 'Z':
+				d = int(c - 'A')
+			case c >= '0' && c <= '9':
+				d = int(c-'0') + 26
+			default:
+				return "", errPunycode
+			}
+			i += d * w
+			t := k - bias
+			if t < tmin {
+				t = tmin
+			} else if t > tmax {
+				t = tmax
+			}
+			if d < t {
+				break
+			}
+			w *= base - t
+			if i < 0 || w <= 0 {
+				return "", errPunycode
+			}
+		}
+		bias = adapt(i-previous, len(output)+1, previous == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > utf8.MaxRune {
+			return "", errPunycode
+		}
+		output = append(output[:i], append([]rune{rune(n)}, output[i:]...)...)
+		i++
+	}
+	return string(output), nil
+}
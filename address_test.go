@@ -0,0 +1,93 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+func TestAddressDomain(t *testing.T) {
+	idnForm = new(string)
+	*idnForm = "a-label"
+
+	tests := []struct {
+		address string
+		domain  string
+	}{
+		{"<bob@Example.ORG>", "example.org"},
+		{"bob@example.org.", "example.org"},
+		{"<\"bob@home\"@example.org>", "example.org"},
+		{"<\"bob\\\"@\"@example.org>", "example.org"},
+		{"<@relay.example.net:bob@example.org>", "example.org"},
+		{"<bob@[192.0.2.1]>", "[192.0.2.1]"},
+		{"<bob@[IPv6:2001:DB8::1]>", "[IPv6:2001:db8::1]"},
+		{"<bob@[not an address]>", ""},
+		{"<>", ""},
+		{"<\"bob@example.org\">", ""},
+	}
+	for _, test := range tests {
+		if domain := addressDomain(test.address); domain != test.domain {
+			t.Errorf("addressDomain(%q) = %q, want %q", test.address, domain, test.domain)
+		}
+	}
+}
+
+func TestIDNForm(t *testing.T) {
+	idnForm = new(string)
+
+	tests := []struct {
+		domain string
+		alabel string
+		ulabel string
+	}{
+		{"bücher.example", "xn--bcher-kva.example", "bücher.example"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", "bücher.example"},
+		{"BÜCHER.Example", "xn--bcher-kva.example", "bücher.example"},
+		{"XN--BCHER-KVA.example", "xn--bcher-kva.example", "bücher.example"},
+		{"münchen.de", "xn--mnchen-3ya.de", "münchen.de"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", "例え.テスト"},
+		{"例え。テスト", "xn--r8jz45g.xn--zckzah", "例え.テスト"},
+		{"ñandú.com", "xn--and-6ma2c.com", "ñandú.com"},
+		{"example.org", "example.org", "example.org"},
+		// invalid punycode is left alone
+		{"xn--.example", "xn--.example", "xn--.example"},
+	}
+	for _, test := range tests {
+		*idnForm = "a-label"
+		if domain := normalizeDomain(test.domain); domain != test.alabel {
+			t.Errorf("a-label: normalizeDomain(%q) = %q, want %q", test.domain, domain, test.alabel)
+		}
+		*idnForm = "u-label"
+		if domain := normalizeDomain(test.domain); domain != test.ulabel {
+			t.Errorf("u-label: normalizeDomain(%q) = %q, want %q", test.domain, domain, test.ulabel)
+		}
+	}
+}
+
+func TestPunycodeRoundTrip(t *testing.T) {
+	for _, label := range []string{"bücher", "münchen", "例え", "テスト", "ñandú", "правда", "mañana-123"} {
+		decoded, err := unpunycode(punycode(label))
+		if err != nil || decoded != label {
+			t.Errorf("unpunycode(punycode(%q)) = %q, %v", label, decoded, err)
+		}
+	}
+	for _, encoded := range []string{"bcher-kv!", "bcher-kv", "zzzzzzzzzzzzzzzzzz"} {
+		if _, err := unpunycode(encoded); err == nil {
+			t.Errorf("unpunycode(%q) succeeded", encoded)
+		}
+	}
+}
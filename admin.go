@@ -0,0 +1,189 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var adminTokenFile *string
+var disabledCollectors *string
+
+var adminToken string
+
+// adminLock serializes configuration changes made through the admin API.
+var adminLock sync.Mutex
+
+// thresholds that can be adjusted at runtime, they all point to flags.
+var thresholds = map[string]*int{}
+
+// thresholdMinimums are the smallest values thresholds accept, whether
+// set by flag or at runtime.
+var thresholdMinimums = map[string]int{
+	"label_max_length":       1,
+	"max_series":             0,
+	"top_peers":              0,
+	"offender_auth_failures": 1,
+	"hops_warning":           0,
+}
+
+func checkThreshold(name string, value int) error {
+	if value < thresholdMinimums[name] {
+		return fmt.Errorf("invalid value for %s: %d", name, value)
+	}
+	return nil
+}
+
+// thresholdsInit registers the thresholds and checks the values given by
+// flag, before anything depends on them.
+func thresholdsInit() {
+	thresholds["label_max_length"] = labelMaxLength
+	thresholds["max_series"] = maxSeries
+	thresholds["top_peers"] = topPeers
+	thresholds["offender_auth_failures"] = offenderAuthFailures
+	thresholds["hops_warning"] = hopsWarning
+
+	for name, value := range thresholds {
+		if err := checkThreshold(name, *value); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+type adminConfig struct {
+	Collectors map[string]bool `json:"collectors"`
+	Thresholds map[string]int  `json:"thresholds"`
+}
+
+func adminInit() {
+	if *disabledCollectors != "" {
+		for _, name := range strings.Split(*disabledCollectors, ",") {
+			c := getCollector(name)
+			if c == nil {
+				log.Fatalf("unknown collector: %s", name)
+			}
+			c.disabled = true
+		}
+	}
+
+	if *adminTokenFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*adminTokenFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	adminToken = strings.TrimSpace(string(data))
+	if adminToken == "" {
+		log.Fatalf("empty admin token in %s", *adminTokenFile)
+	}
+}
+
+func adminAuthorized(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+func currentConfig() adminConfig {
+	config := adminConfig{
+		Collectors: make(map[string]bool),
+		Thresholds: make(map[string]int),
+	}
+	for _, c := range collectors {
+		config.Collectors[c.name] = !c.disabled
+	}
+	for name, value := range thresholds {
+		config.Thresholds[name] = *value
+	}
+	return config
+}
+
+// checkConfig validates a configuration change before any lock is taken,
+// the collectors and thresholds it names are fixed at startup.
+func checkConfig(config adminConfig) error {
+	for name := range config.Collectors {
+		if getCollector(name) == nil {
+			return fmt.Errorf("unknown collector: %s", name)
+		}
+	}
+	for name, value := range config.Thresholds {
+		if _, ok := thresholds[name]; !ok {
+			return fmt.Errorf("unknown threshold: %s", name)
+		}
+		if err := checkThreshold(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyConfig(config adminConfig) {
+	for name, enabled := range config.Collectors {
+		getCollector(name).disabled = !enabled
+	}
+	for name, value := range config.Thresholds {
+		*thresholds[name] = value
+	}
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// the body is read before locking, a client trickling it must not
+	// stall event processing
+	config := adminConfig{}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// partial updates, omitted collectors and thresholds are left as is
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkConfig(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminLock.Lock()
+	metricsLock.Lock()
+	applyConfig(config)
+	current := currentConfig()
+	metricsLock.Unlock()
+	adminLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(current)
+}
@@ -0,0 +1,71 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+// anomalies are transitions smtpd should never report, they are counted
+// and compensated for rather than skewing the gauges.
+var anomalyKinds = []string{
+	"duplicate_connect",
+	"unknown_session",
+	"duplicate_begin",
+	"commit_without_begin",
+	"rollback_without_begin",
+	"reset_without_begin",
+}
+
+// active gauges that are decremented, and may have to be clamped.
+var clampedGauges = []string{
+	"smtpd_sessions_active",
+	"smtpd_sessions_inet4_active",
+	"smtpd_sessions_inet6_active",
+	"smtpd_sessions_unix_active",
+	"smtpd_sessions_auth_active",
+	"smtpd_sessions_tls_active",
+	"smtpd_tx_active",
+}
+
+func anomaly(m *metrics, kind string) {
+	m.anomalies[kind]++
+}
+
+// decrement lowers an active gauge, clamping it at zero: events lost
+// across a restart would otherwise make it wrap around.
+func (m *metrics) decrement(gauge *uint64, name string) {
+	if *gauge == 0 {
+		m.clamps[name]++
+		return
+	}
+	*gauge--
+}
+
+func anomaliesCollector(e *exposition) {
+	e.header("smtpd_protocol_anomalies_total", "The number of impossible session transitions reported.", "counter", e.sets, "kind")
+	for _, m := range e.sets {
+		for _, kind := range anomalyKinds {
+			e.sample("smtpd_protocol_anomalies_total", m.labels()+","+label("kind", kind), float64(m.anomalies[kind]))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_gauge_clamps_total", "The number of times an active gauge was kept from going negative.", "counter", e.sets, "gauge")
+	for _, m := range e.sets {
+		for _, gauge := range clampedGauges {
+			e.sample("smtpd_gauge_clamps_total", m.labels()+","+label("gauge", gauge), float64(m.clamps[gauge]))
+		}
+	}
+	e.end()
+}
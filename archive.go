@@ -0,0 +1,41 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+var archivePath *string
+var archiveRetention *time.Duration
+
+func archiveInit() {
+	if *archivePath == "" {
+		return
+	}
+	write, err := openArchive(*archivePath, *archiveRetention)
+	if err != nil {
+		log.Fatal(err)
+	}
+	addSink("sqlite", []string{"transaction"}, func(r interface{}) error {
+		if r, ok := r.(*txRecord); ok {
+			return write(r)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,86 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const archiveSchema = `
+CREATE TABLE IF NOT EXISTS transactions (
+	session           TEXT NOT NULL,
+	msgid             TEXT NOT NULL,
+	direction         TEXT NOT NULL,
+	result            TEXT NOT NULL,
+	began_at          INTEGER NOT NULL,
+	ended_at          INTEGER NOT NULL,
+	size              INTEGER NOT NULL,
+	sender_domain     TEXT NOT NULL,
+	recipients        INTEGER NOT NULL,
+	recipient_domains TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transactions_ended_at ON transactions (ended_at);
+`
+
+func init() {
+	registerFeature("sqlite")
+}
+
+// openArchive opens the SQLite archive, records older than retention are
+// pruned hourly.
+func openArchive(path string, retention time.Duration) (func(*txRecord) error, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// a single writer, SQLite doesn't do concurrent writes anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(archiveSchema); err != nil {
+		return nil, err
+	}
+
+	insert, err := db.Prepare(`INSERT INTO transactions
+		(session, msgid, direction, result, began_at, ended_at, size, sender_domain, recipients, recipient_domains)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	if retention > 0 {
+		go func() {
+			for ; ; time.Sleep(time.Hour) {
+				_, err := db.Exec("DELETE FROM transactions WHERE ended_at < ?", time.Now().Add(-retention).Unix())
+				if err != nil {
+					log.Printf("archive pruning: %v", err)
+				}
+			}
+		}()
+	}
+
+	return func(r *txRecord) error {
+		_, err := insert.Exec(r.Session, r.Message, r.Direction, r.Result,
+			r.BeganAt.Unix(), r.EndedAt.Unix(), r.Size, r.Sender, r.Recipients, recordDomains(r))
+		return err
+	}, nil
+}
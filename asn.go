@@ -0,0 +1,200 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var asnDatabase *string
+var maxASNs *int
+var topASN *int
+
+// asnLookup returns the autonomous system of an address, 0 if the
+// database doesn't know it.
+var asnLookup func(net.IP) (uint, string, error)
+
+// asnStats are the sessions seen from an autonomous system and how many
+// of them were refused something.
+type asnStats struct {
+	organization string
+	sessions     uint64
+	rejected     uint64
+}
+
+// asnTable counts smtp-in sessions per autonomous system, systems seen
+// once the table is full are only accounted in other. Systems in the top
+// are exposed with their counts since they entered it, the counts before
+// staying in other so that it never goes down. Protected by metricsLock,
+// exposed also by exposedLock as concurrent scrapes update it.
+type asnTable struct {
+	systems     map[uint]*asnStats
+	overflow    asnStats
+	exposedLock sync.Mutex
+	exposed     map[uint]asnStats
+}
+
+func newASNTable() *asnTable {
+	return &asnTable{systems: make(map[uint]*asnStats), exposed: make(map[uint]asnStats)}
+}
+
+func (t *asnTable) account(number uint, organization string, rejected bool) {
+	stats, ok := t.systems[number]
+	if !ok {
+		if len(t.systems) >= *maxASNs {
+			stats = &t.overflow
+		} else {
+			stats = &asnStats{organization: organization}
+			t.systems[number] = stats
+		}
+	}
+	stats.sessions++
+	if rejected {
+		stats.rejected++
+	}
+}
+
+type asnCount struct {
+	asn   string
+	stats asnStats
+}
+
+// top returns the n autonomous systems with the most sessions, followed
+// by the others summed up. A system entering the top starts from zero and
+// one leaving it has its counts since go back to other, both counters
+// only ever go up.
+func (t *asnTable) top(n int) []asnCount {
+	t.exposedLock.Lock()
+	defer t.exposedLock.Unlock()
+
+	numbers := make([]uint, 0, len(t.systems))
+	for number := range t.systems {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool {
+		a, b := t.systems[numbers[i]], t.systems[numbers[j]]
+		if a.sessions != b.sessions {
+			return a.sessions > b.sessions
+		}
+		return numbers[i] < numbers[j]
+	})
+	if len(numbers) > n {
+		numbers = numbers[:n]
+	}
+
+	top := make(map[uint]bool)
+	for _, number := range numbers {
+		top[number] = true
+		if _, ok := t.exposed[number]; !ok {
+			t.exposed[number] = *t.systems[number]
+		}
+	}
+	for number := range t.exposed {
+		if !top[number] {
+			delete(t.exposed, number)
+		}
+	}
+
+	systems := make([]asnCount, 0, len(numbers)+1)
+	for _, number := range numbers {
+		asn := "unknown"
+		if number != 0 {
+			asn = "AS" + strconv.FormatUint(uint64(number), 10)
+		}
+		stats, base := *t.systems[number], t.exposed[number]
+		stats.sessions -= base.sessions
+		stats.rejected -= base.rejected
+		systems = append(systems, asnCount{asn, stats})
+	}
+
+	other := asnCount{"other", t.overflow}
+	for number, stats := range t.systems {
+		if base, ok := t.exposed[number]; ok {
+			stats = &base
+		}
+		other.stats.sessions += stats.sessions
+		other.stats.rejected += stats.rejected
+	}
+	return append(systems, other)
+}
+
+// accountASN is called when smtp-in sessions end, addresses the database
+// doesn't know, such as private ones, are accounted as unknown.
+func accountASN(m *metrics, s *session) {
+	if asnLookup == nil || s.subsystem != "smtp-in" || s.peer == "" {
+		return
+	}
+	ip := net.ParseIP(s.peer)
+	if ip == nil {
+		return
+	}
+	number, organization, err := asnLookup(ip)
+	if err != nil {
+		return
+	}
+	m.asns.account(number, organization, s.refused || s.rejected != "")
+}
+
+func asnInit() {
+	if *asnDatabase == "" {
+		return
+	}
+	lookup, err := openASNDatabase(*asnDatabase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	asnLookup = lookup
+	for _, m := range metricSets {
+		if m.direction == "smtp-in" {
+			m.asns = newASNTable()
+		}
+	}
+}
+
+func asnCollector(e *exposition) {
+	if asnLookup == nil {
+		return
+	}
+	tops := make(map[*metrics][]asnCount)
+	for _, m := range e.inbound() {
+		tops[m] = m.asns.top(*topASN)
+	}
+	labels := func(m *metrics, system asnCount) string {
+		organization, _ := sanitizeLabel(system.stats.organization)
+		return m.labels() + "," + label("asn", system.asn) + "," + label("org", organization)
+	}
+
+	e.header("smtpd_sessions_by_asn_total", "The number of smtp-in sessions of the top autonomous systems.", "counter", e.inbound(), "asn", "org")
+	for _, m := range e.inbound() {
+		for _, system := range tops[m] {
+			e.sample("smtpd_sessions_by_asn_total", labels(m, system), float64(system.stats.sessions))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_sessions_by_asn_rejected_total", "The number of smtp-in sessions of the top autonomous systems that were refused something.", "counter", e.inbound(), "asn", "org")
+	for _, m := range e.inbound() {
+		for _, system := range tops[m] {
+			e.sample("smtpd_sessions_by_asn_rejected_total", labels(m, system), float64(system.stats.rejected))
+		}
+	}
+	e.end()
+}
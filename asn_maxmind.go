@@ -0,0 +1,50 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+//go:build maxmind
+// +build maxmind
+
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func init() {
+	registerFeature("maxmind")
+}
+
+// openASNDatabase opens a GeoLite2-ASN database, it is memory-mapped so
+// nothing is read from disk past startup.
+func openASNDatabase(path string) (func(net.IP) (uint, string, error), error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ip net.IP) (uint, string, error) {
+		var record struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := db.Lookup(ip, &record); err != nil {
+			return 0, "", err
+		}
+		return record.Number, record.Organization, nil
+	}, nil
+}
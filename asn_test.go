@@ -0,0 +1,53 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestASNTableMonotonic(t *testing.T) {
+	max := 8
+	maxASNs = &max
+	table := newASNTable()
+	random := rand.New(rand.NewSource(1))
+
+	previous := make(map[string]asnStats)
+	for scrape := 0; scrape < 1000; scrape++ {
+		for i := 0; i < 20; i++ {
+			// shifting popularity moves systems in and out of the top
+			number := uint(random.Intn(12) + scrape/100)
+			table.account(number, "", random.Intn(3) == 0)
+		}
+
+		total := uint64(0)
+		current := make(map[string]asnStats)
+		for _, system := range table.top(3) {
+			current[system.asn] = system.stats
+			total += system.stats.sessions
+			if before, ok := previous[system.asn]; ok &&
+				(system.stats.sessions < before.sessions || system.stats.rejected < before.rejected) {
+				t.Fatalf("scrape %d: %s went down from %+v to %+v", scrape, system.asn, before, system.stats)
+			}
+		}
+		if total != uint64(20*(scrape+1)) {
+			t.Fatalf("scrape %d: %d sessions exposed out of %d", scrape, total, 20*(scrape+1))
+		}
+		previous = current
+	}
+}
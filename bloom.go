@@ -0,0 +1,91 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"hash/fnv"
+)
+
+const bloomHashes = 7
+
+// bloom remembers recently seen values in bounded memory: values are
+// inserted in the current generation which replaces the previous one
+// once it holds capacity values, so a value is remembered for at least
+// capacity insertions. About 10 bits per value keep false positives ~1%.
+type bloom struct {
+	capacity int
+	inserted int
+	current  []uint64
+	previous []uint64
+}
+
+func newBloom(capacity int) *bloom {
+	words := (capacity*10 + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloom{
+		capacity: capacity,
+		current:  make([]uint64, words),
+		previous: make([]uint64, words),
+	}
+}
+
+func (b *bloom) positions(value string) [bloomHashes]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	sum := h.Sum64()
+
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	bits := uint64(len(b.current) * 64)
+
+	var positions [bloomHashes]uint64
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % bits
+	}
+	return positions
+}
+
+func bloomTest(bits []uint64, positions [bloomHashes]uint64) bool {
+	for _, p := range positions {
+		if bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// seen reports whether value was recently seen and remembers it.
+func (b *bloom) seen(value string) bool {
+	positions := b.positions(value)
+	if bloomTest(b.current, positions) || bloomTest(b.previous, positions) {
+		return true
+	}
+
+	if b.inserted >= b.capacity {
+		b.previous, b.current = b.current, b.previous
+		for i := range b.current {
+			b.current[i] = 0
+		}
+		b.inserted = 0
+	}
+	for _, p := range positions {
+		b.current[p/64] |= 1 << (p % 64)
+	}
+	b.inserted++
+	return false
+}
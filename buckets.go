@@ -0,0 +1,140 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var bucketMaps = namedValues{}
+
+// bucketMapNames are the label values collectors can map to buckets, each
+// map is configured with -bucket-map name=path.
+var bucketMapNames = []string{"domains", "relays", "helo"}
+
+// bucketRule maps the values it matches to a bucket, the first matching
+// rule of a map wins.
+type bucketRule struct {
+	bucket  string
+	kind    string
+	value   string
+	pattern *regexp.Regexp
+	network *net.IPNet
+}
+
+var bucketRules = make(map[string][]bucketRule)
+
+func parseBucketRule(bucket string, kind string, value string) (bucketRule, error) {
+	rule := bucketRule{bucket: bucket, kind: kind, value: strings.ToLower(value)}
+	var err error
+	switch kind {
+	case "exact", "prefix", "suffix":
+	case "regex":
+		rule.pattern, err = regexp.Compile(value)
+	case "cidr":
+		if !strings.Contains(value, "/") {
+			if strings.Contains(value, ":") {
+				value += "/128"
+			} else {
+				value += "/32"
+			}
+		}
+		_, rule.network, err = net.ParseCIDR(value)
+	default:
+		err = fmt.Errorf("unknown match kind: %s", kind)
+	}
+	return rule, err
+}
+
+func loadBucketMap(path string) ([]bucketRule, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	rules := []bucketRule{}
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		// patterns may contain #, only whole lines are comments
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(strings.Join(strings.Fields(line), " "), " ", 3)
+		if len(fields) != 3 {
+			log.Fatalf("%s:%d: expected a bucket, a match kind and a value", path, lineno)
+		}
+		rule, err := parseBucketRule(fields[0], fields[1], fields[2])
+		if err != nil {
+			log.Fatalf("%s:%d: %v", path, lineno, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func (rule *bucketRule) match(value string) bool {
+	switch rule.kind {
+	case "exact":
+		return strings.ToLower(value) == rule.value
+	case "prefix":
+		return strings.HasPrefix(strings.ToLower(value), rule.value)
+	case "suffix":
+		return strings.HasSuffix(strings.ToLower(value), rule.value)
+	case "regex":
+		return rule.pattern.MatchString(value)
+	case "cidr":
+		ip := net.ParseIP(strings.Trim(value, "[]"))
+		return ip != nil && rule.network.Contains(ip)
+	}
+	return false
+}
+
+// bucketOf returns the bucket of a value in the named map, values that no
+// rule matches keep their own label value.
+func bucketOf(name string, value string) (string, bool) {
+	for _, rule := range bucketRules[name] {
+		if rule.match(value) {
+			return rule.bucket, true
+		}
+	}
+	return "", false
+}
+
+func bucketsInit() {
+	for name, path := range bucketMaps {
+		known := false
+		for _, bucketMap := range bucketMapNames {
+			known = known || name == bucketMap
+		}
+		if !known {
+			log.Fatalf("unknown bucket map: %s", name)
+		}
+		rules, err := loadBucketMap(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bucketRules[name] = rules
+	}
+}
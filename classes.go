@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var classesFile *string
+
+// classRule classifies the MAIL FROM and RCPT TO addresses it matches, the
+// first matching rule of an address wins.
+type classRule struct {
+	class   string
+	pattern *regexp.Regexp
+}
+
+var classRules []classRule
+
+// classNames are the configured classes, in order of appearance.
+var classNames []string
+
+func loadClasses(path string) ([]classRule, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	rules := []classRule{}
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		// patterns may contain #, only whole lines are comments
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i == -1 {
+			log.Fatalf("%s:%d: expected a class and a pattern", path, lineno)
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(line[i:]))
+		if err != nil {
+			log.Fatalf("%s:%d: %v", path, lineno, err)
+		}
+		rules = append(rules, classRule{line[:i], pattern})
+	}
+	return rules, scanner.Err()
+}
+
+// classifyAddress records the class of an address for the transaction.
+func classifyAddress(s *session, address string) {
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "<"), ">")
+	for _, rule := range classRules {
+		if rule.pattern.MatchString(address) {
+			if s.classes == nil {
+				s.classes = make(map[string]bool)
+			}
+			s.classes[rule.class] = true
+			return
+		}
+	}
+}
+
+// accountClasses is called on commit, a message is accounted once per
+// class however many of its addresses match.
+func accountClasses(m *metrics, s *session) {
+	for class := range s.classes {
+		m.addressClasses[class]++
+	}
+}
+
+func classesInit() {
+	if *classesFile == "" {
+		return
+	}
+	rules, err := loadClasses(*classesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	classRules = rules
+
+	known := make(map[string]bool)
+	for _, rule := range rules {
+		if !known[rule.class] {
+			known[rule.class] = true
+			classNames = append(classNames, rule.class)
+		}
+	}
+	for _, m := range metricSets {
+		m.addressClasses = newBuckets(classNames)
+	}
+}
+
+func classesCollector(e *exposition) {
+	if len(classRules) == 0 {
+		return
+	}
+	e.header("smtpd_messages_by_class_total", "The number of committed messages per sender or recipient class.", "counter", e.sets, "class")
+	for _, m := range e.sets {
+		for _, class := range classNames {
+			e.sample("smtpd_messages_by_class_total", m.labels()+","+label("class", class), float64(m.addressClasses[class]))
+		}
+	}
+	e.end()
+}
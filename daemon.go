@@ -0,0 +1,236 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var daemonSocket *string
+var forwardSocket *string
+
+// daemonListen binds the Unix socket shims forward events to.
+func daemonListen(path string) net.Listener {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return listener
+}
+
+// daemonServe runs the filter as a long-lived daemon, events are forwarded
+// over a Unix socket by a shim run by smtpd so that counters survive smtpd
+// restarts. Several smtpd instances, told apart by -instance, may share it.
+func daemonServe(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go daemonConn(conn)
+	}
+}
+
+// daemonConn processes the events forwarded by a shim, the sessions of
+// its instance are forgotten when smtpd restarts, when the shim goes away
+// or when its heartbeats stop.
+func daemonConn(conn net.Conn) {
+	defer conn.Close()
+
+	inst := &instance{name: "unknown", sessions: make(map[string]bool), lastSeen: time.Now()}
+	reason := "disconnect"
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(*heartbeatTimeout))
+		if !scanner.Scan() {
+			if err, ok := scanner.Err().(net.Error); ok && err.Timeout() {
+				reason = "expired"
+			}
+			break
+		}
+		line := scanner.Text()
+		inst.seen(time.Now())
+		eventSeen()
+
+		switch {
+		case line == "heartbeat":
+			continue
+		case strings.HasPrefix(line, "instance|"):
+			inst.register(strings.TrimPrefix(line, "instance|"))
+			continue
+		case line == "config|ready":
+			inst.forget("reconnect")
+			continue
+		case strings.HasPrefix(line, "config|"):
+			continue
+		}
+
+		atoms, err := handleLine(line, false)
+		if err != nil {
+			invalidEvent(err)
+			continue
+		}
+		inst.track(atoms)
+	}
+
+	inst.forget(reason)
+	inst.unregister()
+}
+
+// forwarder is the shim side, it answers smtpd itself and forwards the
+// lines to the daemon, dropping them while the daemon is unreachable or
+// too slow for the buffer in between.
+type forwarder struct {
+	path string
+
+	// the lock orders lines against the buffer being closed at exit
+	sync.RWMutex
+	lines  chan string
+	closed bool
+	done   chan struct{}
+
+	conn    net.Conn
+	w       *bufio.Writer
+	retryAt time.Time
+}
+
+func newForwarder(path string, size int) *forwarder {
+	f := &forwarder{path: path, lines: make(chan string, size), done: make(chan struct{})}
+	go f.run()
+	return f
+}
+
+// forward never blocks, smtpd must not wait on the daemon.
+func (f *forwarder) forward(line string) {
+	f.RLock()
+	defer f.RUnlock()
+
+	if f.closed {
+		return
+	}
+	select {
+	case f.lines <- line:
+	default:
+	}
+}
+
+// close flushes the lines still buffered.
+func (f *forwarder) close() {
+	f.Lock()
+	f.closed = true
+	close(f.lines)
+	f.Unlock()
+
+	<-f.done
+}
+
+func (f *forwarder) run() {
+	defer close(f.done)
+	for line := range f.lines {
+		f.write(line)
+		// flushed once the buffer is empty, or lines would wait
+		if len(f.lines) == 0 && f.conn != nil {
+			f.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if err := f.w.Flush(); err != nil {
+				f.fail(err)
+			}
+		}
+	}
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func (f *forwarder) write(line string) {
+	if f.conn == nil {
+		if time.Now().Before(f.retryAt) {
+			return
+		}
+		conn, err := net.DialTimeout("unix", f.path, time.Second)
+		if err != nil {
+			f.fail(err)
+			return
+		}
+		f.conn = conn
+		f.w = bufio.NewWriter(conn)
+		f.w.WriteString("instance|" + *instanceName + "\n")
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	f.w.WriteString(line)
+	if err := f.w.WriteByte('\n'); err != nil {
+		f.fail(err)
+	}
+}
+
+// fail drops the connection, lines are dropped until the next attempt.
+func (f *forwarder) fail(err error) {
+	log.Printf("forward: %v", err)
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+	f.retryAt = time.Now().Add(5 * time.Second)
+}
+
+func forward(path string) {
+	shimSocket = path
+	harden()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	skipConfig(scanner)
+	filterInit()
+
+	// lines wait for the daemon in a buffer as large as its queue
+	if *queueSize < 1 {
+		log.Fatalf("invalid queue size: %d", *queueSize)
+	}
+	f := newForwarder(path, *queueSize)
+	go func() {
+		for range time.Tick(*heartbeatInterval) {
+			f.forward("heartbeat")
+		}
+	}()
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "config|") {
+			if configLine(line) {
+				filterInit()
+			}
+		} else if strings.HasPrefix(line, "filter|") {
+			atoms := splitEvent(line)
+			if len(atoms) < 8 {
+				log.Fatalf("missing atoms: %s", line)
+			}
+			filterDataLine(atoms)
+		}
+		f.forward(line)
+	}
+	f.close()
+	os.Exit(0)
+}
@@ -0,0 +1,418 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dane *bool
+var daneInterval *time.Duration
+var daneMaxHosts *int
+
+// tlsaRecord is a DANE TLSA record (RFC 6698).
+type tlsaRecord struct {
+	usage    uint8
+	selector uint8
+	matching uint8
+	data     []byte
+}
+
+// destinations checked for DANE, keyed by host:port, with their state
+// after the last check: "tlsa", "insecure" when the records weren't
+// validated with DNSSEC, "no_tlsa" or "error". Their MX hosts are looked
+// up from the recipient domains of smtp-out transactions.
+var daneHosts = struct {
+	sync.Mutex
+	state       map[string]string
+	mismatches  map[string]bool
+	unreachable map[string]bool
+	domains     map[string]bool
+	checks      uint64
+}{
+	state:       make(map[string]string),
+	mismatches:  make(map[string]bool),
+	unreachable: make(map[string]bool),
+	domains:     make(map[string]bool),
+}
+
+// daneDomain registers the recipient domain of an smtp-out transaction,
+// smtpd doesn't report the name of the MX host it connects to.
+func daneDomain(domain string) {
+	if !*dane || strings.HasPrefix(domain, "[") {
+		return
+	}
+	// looked up in their ASCII form whatever -idn-form
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			labels[i] = "xn--" + punycode(label)
+		}
+	}
+	domain = strings.Join(labels, ".")
+
+	daneHosts.Lock()
+	defer daneHosts.Unlock()
+	if len(daneHosts.domains) < *daneMaxHosts {
+		daneHosts.domains[domain] = true
+	}
+}
+
+// daneSeen registers an outbound destination for the next checks.
+func daneSeen(host string, port string) {
+	if !*dane || host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	address := net.JoinHostPort(strings.TrimSuffix(host, "."), port)
+
+	daneHosts.Lock()
+	defer daneHosts.Unlock()
+	if _, ok := daneHosts.state[address]; ok || len(daneHosts.state) >= *daneMaxHosts {
+		return
+	}
+	daneHosts.state[address] = ""
+}
+
+func nameserver() string {
+	fp, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer fp.Close()
+		scanner := bufio.NewScanner(fp)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func encodeName(buf *bytes.Buffer, name string) error {
+	for _, part := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(part) == 0 || len(part) > 63 {
+			return errors.New("invalid name")
+		}
+		buf.WriteByte(byte(len(part)))
+		buf.WriteString(part)
+	}
+	buf.WriteByte(0)
+	return nil
+}
+
+// skipName skips a possibly compressed name in a DNS message.
+func skipName(msg []byte, offset int) (int, error) {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			return offset + 2, nil
+		case length&0xc0 != 0:
+			return 0, errors.New("invalid label")
+		}
+		offset += length + 1
+	}
+	return 0, errors.New("truncated message")
+}
+
+const typeTLSA = 52
+
+// lookupTLSA queries the system's first nameserver for TLSA records, the
+// stdlib resolver doesn't know about them. DNSSEC validation is left to
+// the nameserver, which must be a trusted validating resolver: records
+// are only authenticated when it sets the AD flag in its answer.
+func lookupTLSA(name string, timeout time.Duration) ([]tlsaRecord, bool, error) {
+	id := uint16(rand.Intn(65536))
+	query := &bytes.Buffer{}
+	// recursion desired, and the AD flag asks for the validation result
+	binary.Write(query, binary.BigEndian, []uint16{id, 0x0120, 1, 0, 0, 0})
+	if err := encodeName(query, name); err != nil {
+		return nil, false, err
+	}
+	binary.Write(query, binary.BigEndian, []uint16{typeTLSA, 1})
+
+	msg, err := dnsExchange("udp", query.Bytes(), timeout)
+	if err == nil && len(msg) > 2 && msg[2]&0x02 != 0 {
+		// truncated, retried over TCP
+		msg, err = dnsExchange("tcp", query.Bytes(), timeout)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return parseTLSA(msg, id)
+}
+
+// parseTLSA returns the TLSA records of an answer and whether the
+// nameserver authenticated them, a missing name has none.
+func parseTLSA(msg []byte, id uint16) ([]tlsaRecord, bool, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, false, errors.New("invalid answer")
+	}
+	authenticated := msg[3]&0x20 != 0
+	if rcode := msg[3] & 0x0f; rcode == 3 {
+		return nil, authenticated, nil
+	} else if rcode != 0 {
+		return nil, false, errors.New("server failure")
+	}
+
+	var err error
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	offset := 12
+	for i := 0; i < questions; i++ {
+		if offset, err = skipName(msg, offset); err != nil {
+			return nil, false, err
+		}
+		offset += 4
+	}
+
+	records := []tlsaRecord{}
+	for i := 0; i < answers; i++ {
+		if offset, err = skipName(msg, offset); err != nil {
+			return nil, false, err
+		}
+		if offset+10 > len(msg) {
+			return nil, false, errors.New("truncated message")
+		}
+		kind := binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, false, errors.New("truncated message")
+		}
+		if kind == typeTLSA && length > 3 {
+			rdata := msg[offset : offset+length]
+			records = append(records, tlsaRecord{rdata[0], rdata[1], rdata[2], rdata[3:]})
+		}
+		offset += length
+	}
+	return records, authenticated, nil
+}
+
+func dnsExchange(network string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, nameserver(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// DNS over TCP prefixes messages with their length
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r tlsaRecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.matching {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, r.data)
+}
+
+// daneMatch tells whether the chain presented by a server matches one of
+// its TLSA records, end-entity usages only match the leaf certificate.
+func daneMatch(records []tlsaRecord, chain []*x509.Certificate) bool {
+	for _, r := range records {
+		for i, cert := range chain {
+			if (r.usage == 1 || r.usage == 3) && i != 0 {
+				break
+			}
+			if r.matches(cert) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// daneCheck compares the certificate of a destination to its TLSA
+// records, a destination that can't be connected to or fails STARTTLS is
+// unreachable rather than mismatching, one not offering STARTTLS is.
+func daneCheck(address string) {
+	host, port, _ := net.SplitHostPort(address)
+	records, authenticated, err := lookupTLSA("_"+port+"._tcp."+host, *dnsTimeout)
+
+	state, mismatch, unreachable := "no_tlsa", false, false
+	switch {
+	case err != nil:
+		state = "error"
+	case len(records) == 0:
+	case !authenticated:
+		state = "insecure"
+	default:
+		state = "tlsa"
+		client, tlsState, err := dialSMTP(address, *dnsTimeout)
+		if err != nil {
+			unreachable = true
+			break
+		}
+		client.Close()
+		mismatch = tlsState == nil || !daneMatch(records, tlsState.PeerCertificates)
+	}
+
+	daneHosts.Lock()
+	defer daneHosts.Unlock()
+	daneHosts.state[address] = state
+	daneHosts.mismatches[address] = mismatch
+	daneHosts.unreachable[address] = unreachable
+	daneHosts.checks++
+}
+
+// mxHosts adds the MX hosts of the -dns-domain destinations and of the
+// recipient domains of smtp-out transactions.
+func mxHosts() {
+	daneHosts.Lock()
+	domains := append([]string{}, dnsDomains...)
+	for domain := range daneHosts.domains {
+		domains = append(domains, domain)
+	}
+	daneHosts.Unlock()
+
+	for _, domain := range domains {
+		ctx, cancel := context.WithTimeout(context.Background(), *dnsTimeout)
+		mxs, err := net.DefaultResolver.LookupMX(ctx, domain)
+		cancel()
+		if err != nil {
+			continue
+		}
+		for _, mx := range mxs {
+			daneSeen(mx.Host, "25")
+		}
+	}
+}
+
+func daneInit() {
+	if !*dane {
+		return
+	}
+	go func() {
+		for {
+			mxHosts()
+
+			daneHosts.Lock()
+			addresses := make([]string, 0, len(daneHosts.state))
+			for address := range daneHosts.state {
+				addresses = append(addresses, address)
+			}
+			daneHosts.Unlock()
+
+			for _, address := range addresses {
+				daneCheck(address)
+			}
+			time.Sleep(*daneInterval)
+		}
+	}()
+}
+
+func daneCollector(e *exposition) {
+	if !*dane {
+		return
+	}
+
+	daneHosts.Lock()
+	defer daneHosts.Unlock()
+
+	states := map[string]uint64{"tlsa": 0, "insecure": 0, "no_tlsa": 0, "error": 0}
+	mismatches, unreachable := uint64(0), uint64(0)
+	for address, state := range daneHosts.state {
+		if state != "" {
+			states[state]++
+		}
+		if daneHosts.mismatches[address] {
+			mismatches++
+		}
+		if daneHosts.unreachable[address] {
+			unreachable++
+		}
+	}
+
+	e.header("smtpd_dane_destinations", "The number of outbound destinations per TLSA lookup result.", "gauge", nil, "state")
+	for _, state := range []string{"tlsa", "insecure", "no_tlsa", "error"} {
+		e.sample("smtpd_dane_destinations", label("state", state), float64(states[state]))
+	}
+	e.end()
+
+	e.header("smtpd_dane_mismatches", "The number of destinations publishing TLSA records not matching their certificate.", "gauge", nil)
+	e.sample("smtpd_dane_mismatches", "", float64(mismatches))
+	e.end()
+
+	e.header("smtpd_dane_unreachable", "The number of destinations publishing TLSA records that couldn't be connected to or failed STARTTLS.", "gauge", nil)
+	e.sample("smtpd_dane_unreachable", "", float64(unreachable))
+	e.end()
+
+	e.header("smtpd_dane_checks_total", "The number of DANE checks performed.", "counter", nil)
+	e.sample("smtpd_dane_checks_total", "", float64(daneHosts.checks))
+	e.end()
+}
@@ -0,0 +1,110 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// tlsaAnswer builds an answer to a TLSA query for _25._tcp.mx.example.org.
+func tlsaAnswer(id uint16, flags uint16, records ...[]byte) []byte {
+	msg := &bytes.Buffer{}
+	binary.Write(msg, binary.BigEndian, []uint16{id, flags, 1, uint16(len(records)), 0, 0})
+	encodeName(msg, "_25._tcp.mx.example.org")
+	binary.Write(msg, binary.BigEndian, []uint16{typeTLSA, 1})
+	for _, record := range records {
+		msg.Write(record)
+	}
+	return msg.Bytes()
+}
+
+// tlsaAnswerRecord builds a record whose owner name points to the question.
+func tlsaAnswerRecord(kind uint16, rdata []byte) []byte {
+	record := &bytes.Buffer{}
+	binary.Write(record, binary.BigEndian, []uint16{0xc00c, kind, 1, 0, 300, uint16(len(rdata))})
+	record.Write(rdata)
+	return record.Bytes()
+}
+
+func TestParseTLSA(t *testing.T) {
+	digest := sha256.Sum256([]byte("key"))
+	tlsa := tlsaAnswerRecord(typeTLSA, append([]byte{3, 1, 1}, digest[:]...))
+	cname := &bytes.Buffer{}
+	encodeName(cname, "mx.example.net")
+	alias := tlsaAnswerRecord(5, cname.Bytes())
+
+	// an owner name spelled out rather than compressed
+	owner := &bytes.Buffer{}
+	encodeName(owner, "_25._tcp.mx.example.org")
+	spelled := append(owner.Bytes(), tlsa[2:]...)
+
+	tests := []struct {
+		name          string
+		msg           []byte
+		records       int
+		authenticated bool
+		fails         bool
+	}{
+		{"authenticated", tlsaAnswer(1, 0x81a0, alias, tlsa), 1, true, false},
+		{"unauthenticated", tlsaAnswer(1, 0x8180, tlsa), 1, false, false},
+		{"spelled out owner", tlsaAnswer(1, 0x81a0, spelled), 1, true, false},
+		{"no records", tlsaAnswer(1, 0x81a0), 0, true, false},
+		{"nxdomain", tlsaAnswer(1, 0x81a3), 0, true, false},
+		{"servfail", tlsaAnswer(1, 0x8182), 0, false, true},
+		{"other id", tlsaAnswer(2, 0x81a0, tlsa), 0, false, true},
+		{"query", tlsaAnswer(1, 0x0120, tlsa), 0, false, true},
+		{"short header", tlsaAnswer(1, 0x81a0, tlsa)[:8], 0, false, true},
+		{"truncated rdata", tlsaAnswer(1, 0x81a0, tlsa)[:60], 0, false, true},
+		{"truncated record", tlsaAnswer(1, 0x81a0, tlsa[:6]), 0, false, true},
+		{"reserved label", tlsaAnswer(1, 0x81a0, append([]byte{0x40}, tlsa[1:]...)), 0, false, true},
+	}
+	for _, test := range tests {
+		records, authenticated, err := parseTLSA(test.msg, 1)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if test.fails {
+			continue
+		}
+		if len(records) != test.records || authenticated != test.authenticated {
+			t.Errorf("%s: got %d records, authenticated %v", test.name, len(records), authenticated)
+		}
+		if len(records) == 1 && !reflect.DeepEqual(records[0], tlsaRecord{3, 1, 1, digest[:]}) {
+			t.Errorf("%s: got %+v", test.name, records[0])
+		}
+	}
+}
+
+func TestEncodeName(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := encodeName(buf, "_25._tcp.mx.example.org."); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\x03_25\x04_tcp\x02mx\x07example\x03org\x00"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+	for _, name := range []string{"mx..example.org", "", string(make([]byte, 64)) + ".org"} {
+		if err := encodeName(&bytes.Buffer{}, name); err == nil {
+			t.Errorf("%q: no error", name)
+		}
+	}
+}
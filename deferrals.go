@@ -0,0 +1,130 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var deferralPatterns *string
+
+// deferralRule files a remote response matching its pattern under a
+// category, the first matching rule wins.
+type deferralRule struct {
+	category string
+	pattern  *regexp.Regexp
+}
+
+// deferralRules recognize the usual wording of remote servers, rules from
+// -deferral-patterns are tried first so they can override these.
+var deferralRules = []deferralRule{
+	{"greylisted", regexp.MustCompile(`(?i)gr[ae]y-?list|postgrey|\b4\.7\.1 .*try again later`)},
+	{"mailbox_full", regexp.MustCompile(`(?i)\b[45]\.2\.2\b|mailbox (is )?full|over ?quota|quota exceeded|insufficient (system )?storage`)},
+	{"reputation", regexp.MustCompile(`(?i)reputation|block ?list|black ?list|spamhaus|spamcop|barracuda|\bdnsbl\b|\brbl\b|listed (at|on|in)|unsolicited|\bspam\b`)},
+	{"rate_limited", regexp.MustCompile(`(?i)\b4\.7\.28\b|rate ?limit|throttl|too many (connections|messages|recipients)|slow down|exceeded .*(rate|limit)`)},
+}
+
+// outbound transactions that failed per category of the remote response,
+// none when the remote server gave no error, protected by metricsLock.
+var deferralCategories = []string{}
+var outboundDeferrals = make(map[string]uint64)
+
+func loadDeferralPatterns(path string) ([]deferralRule, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	rules := []deferralRule{}
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		// patterns may contain #, only whole lines are comments
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(strings.Join(strings.Fields(line), " "), " ", 2)
+		if len(fields) != 2 {
+			log.Fatalf("%s:%d: expected a category and a pattern", path, lineno)
+		}
+		pattern, err := regexp.Compile("(?i)" + fields[1])
+		if err != nil {
+			log.Fatalf("%s:%d: %v", path, lineno, err)
+		}
+		rules = append(rules, deferralRule{category: fields[0], pattern: pattern})
+	}
+	return rules, scanner.Err()
+}
+
+func deferralsInit() {
+	if *deferralPatterns != "" {
+		rules, err := loadDeferralPatterns(*deferralPatterns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		deferralRules = append(rules, deferralRules...)
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range deferralRules {
+		if !seen[rule.category] {
+			seen[rule.category] = true
+			deferralCategories = append(deferralCategories, rule.category)
+		}
+	}
+	for _, category := range []string{"other", "none"} {
+		if !seen[category] {
+			deferralCategories = append(deferralCategories, category)
+		}
+	}
+	outboundDeferrals = newBuckets(deferralCategories)
+}
+
+func deferralCategory(response string) string {
+	if response == "" {
+		return "none"
+	}
+	for _, rule := range deferralRules {
+		if rule.pattern.MatchString(response) {
+			return rule.category
+		}
+	}
+	return "other"
+}
+
+// remoteError keeps the last error of a remote server, the final line of
+// a multi-line response being the one smtpd acts upon.
+func remoteError(s *session, response string) {
+	if s.subsystem != "smtp-out" || len(response) < 4 || response[3] != ' ' {
+		return
+	}
+	if response[0] == '4' || response[0] == '5' {
+		s.remoteError = response
+	}
+}
+
+// accountDeferral files a failed outbound transaction, or a session that
+// failed before one could start, under the category of the last error.
+func accountDeferral(s *session) {
+	outboundDeferrals[deferralCategory(s.remoteError)]++
+	s.remoteError = ""
+}
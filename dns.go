@@ -0,0 +1,118 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dnsDomains = stringValues{}
+var dnsInterval *time.Duration
+var dnsTimeout *time.Duration
+
+var dnsTypes = []string{"mx", "a"}
+
+type dnsStats struct {
+	duration *histogram
+	failures uint64
+}
+
+var dnsHealth = struct {
+	sync.Mutex
+	stats map[string]map[string]*dnsStats
+}{stats: make(map[string]map[string]*dnsStats)}
+
+func dnsRecord(domain string, kind string, start time.Time, err error) {
+	dnsHealth.Lock()
+	defer dnsHealth.Unlock()
+
+	stats := dnsHealth.stats[domain][kind]
+	stats.duration.observe(time.Since(start).Seconds())
+	if err != nil {
+		stats.failures++
+	}
+}
+
+// resolveDestination resolves a destination the way smtp-out would: MX
+// records first, then the addresses of the preferred MX or of the domain
+// itself when it has no MX.
+func resolveDestination(domain string) {
+	ctx, cancel := context.WithTimeout(context.Background(), *dnsTimeout)
+	defer cancel()
+
+	start := time.Now()
+	mxs, err := net.DefaultResolver.LookupMX(ctx, domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		err = nil
+	}
+	dnsRecord(domain, "mx", start, err)
+
+	host := domain
+	if len(mxs) != 0 {
+		host = strings.TrimSuffix(mxs[0].Host, ".")
+	}
+
+	start = time.Now()
+	_, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	dnsRecord(domain, "a", start, err)
+}
+
+func dnsInit() {
+	if len(dnsDomains) == 0 {
+		return
+	}
+	for _, domain := range dnsDomains {
+		dnsHealth.stats[domain] = make(map[string]*dnsStats)
+		for _, kind := range dnsTypes {
+			dnsHealth.stats[domain][kind] = &dnsStats{duration: newHistogram(latencyBuckets...)}
+		}
+	}
+
+	go func() {
+		for {
+			for _, domain := range dnsDomains {
+				resolveDestination(domain)
+			}
+			time.Sleep(*dnsInterval)
+		}
+	}()
+}
+
+func dnsCollector(e *exposition) {
+	dnsHealth.Lock()
+	defer dnsHealth.Unlock()
+
+	e.header("smtpd_dns_resolution_duration_seconds", "The time it took to resolve destination domains.", "histogram", nil, "domain", "type")
+	for _, domain := range dnsDomains {
+		for _, kind := range dnsTypes {
+			e.histogram("smtpd_dns_resolution_duration_seconds", label("domain", domain)+","+label("type", kind), dnsHealth.stats[domain][kind].duration)
+		}
+	}
+	e.end()
+
+	e.header("smtpd_dns_resolution_failures_total", "The number of failed resolutions of destination domains.", "counter", nil, "domain", "type")
+	for _, domain := range dnsDomains {
+		for _, kind := range dnsTypes {
+			e.sample("smtpd_dns_resolution_failures_total", label("domain", domain)+","+label("type", kind), float64(dnsHealth.stats[domain][kind].failures))
+		}
+	}
+	e.end()
+}
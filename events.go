@@ -0,0 +1,181 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// eventLayout is how the parameters of an event are laid out on the wire
+// from a protocol version on.
+type eventLayout struct {
+	since  string
+	fields []string
+
+	// field absorbing the extra parameters of a value containing |, -1
+	// if none, and number of trailing fields smtpd may leave out
+	variadic int
+	optional int
+
+	// position of each wire field in the schema fields
+	order []int
+}
+
+// eventSchema describes the parameters of an event: handlers are given
+// the schema fields in order, whatever the protocol version.
+type eventSchema struct {
+	fields  []string
+	layouts []eventLayout
+}
+
+// layoutSince is a shorthand for layouts in the order of the schema fields.
+func layoutSince(since string, fields []string, variadic int, optional int) []eventLayout {
+	return []eventLayout{{since: since, fields: fields, variadic: variadic, optional: optional}}
+}
+
+// eventSchemas are the report events handled by the filter, adding an
+// event or a protocol version changing a layout is a change to this table.
+var eventSchemas = map[string]*eventSchema{
+	"link-connect":    {fields: []string{"rdns", "fcrdns", "src", "dest"}},
+	"link-disconnect": {fields: []string{}},
+	"link-greeting":   {fields: []string{"hostname"}},
+	"link-identify":   {fields: []string{"method", "identity"}},
+	"link-tls":        {fields: []string{"tls-string"}},
+	"link-auth":       {fields: []string{"username", "result"}, layouts: layoutSince("0.5", []string{"username", "result"}, 0, 0)},
+	"link-reset":      {fields: []string{}},
+	"tx-reset":        {fields: []string{"message-id"}},
+	"tx-begin":        {fields: []string{"message-id"}},
+	"tx-mail":         {fields: []string{"message-id", "result", "address"}, layouts: layoutSince("0.5", []string{"message-id", "result", "address"}, 2, 0)},
+	"tx-rcpt":         {fields: []string{"message-id", "result", "address"}, layouts: layoutSince("0.5", []string{"message-id", "result", "address"}, 2, 0)},
+	"tx-envelope":     {fields: []string{"message-id", "envelope-id"}},
+	"tx-data":         {fields: []string{"message-id", "result"}},
+	"tx-commit":       {fields: []string{"message-id", "message-size"}, layouts: layoutSince("0.5", []string{"message-id", "message-size"}, -1, 1)},
+	"tx-rollback":     {fields: []string{"message-id"}, layouts: layoutSince("0.5", []string{"message-id"}, -1, 1)},
+	"protocol-client": {fields: []string{"command"}, layouts: layoutSince("0.5", []string{"command"}, 0, 0)},
+	"protocol-server": {fields: []string{"response"}, layouts: layoutSince("0.5", []string{"response"}, 0, 0)},
+	"timeout":         {fields: []string{}},
+	"filter-response": {fields: []string{"phase", "response", "param"}, layouts: layoutSince("0.5", []string{"phase", "response", "param"}, 2, 1)},
+}
+
+func init() {
+	for name, schema := range eventSchemas {
+		schema.compile(name)
+	}
+}
+
+// compile resolves the wire fields of the layouts, events without one are
+// laid out as their schema fields since the first protocol version.
+func (schema *eventSchema) compile(name string) {
+	if schema.layouts == nil {
+		schema.layouts = layoutSince("0.1", schema.fields, -1, 0)
+	}
+	for i := range schema.layouts {
+		l := &schema.layouts[i]
+		l.order = make([]int, len(l.fields))
+		for j, field := range l.fields {
+			l.order[j] = -1
+			for k, wanted := range schema.fields {
+				if field == wanted {
+					l.order[j] = k
+				}
+			}
+			if l.order[j] == -1 {
+				panic(fmt.Sprintf("%s: unknown field %s in layout %s", name, field, l.since))
+			}
+		}
+		if i > 0 && !versionLess(schema.layouts[i-1].since, l.since) {
+			panic(fmt.Sprintf("%s: layouts out of order", name))
+		}
+	}
+}
+
+// versionLess compares protocol versions component by component.
+func versionLess(a string, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// layout returns the layout of a protocol version, versions older than
+// the first layout are assumed to use it.
+func (schema *eventSchema) layout(version string) *eventLayout {
+	l := &schema.layouts[0]
+	for i := range schema.layouts[1:] {
+		if versionLess(version, schema.layouts[i+1].since) {
+			break
+		}
+		l = &schema.layouts[i+1]
+	}
+	return l
+}
+
+// normalize checks the parameters of an event against the layout of its
+// protocol version and returns them in the order of the schema fields,
+// left out fields being empty.
+func (schema *eventSchema) normalize(version string, params []string) ([]string, error) {
+	l := schema.layout(version)
+	n := len(l.fields)
+	if l.variadic >= 0 && len(params) > n {
+		extra := len(params) - n
+		joined := append([]string{}, params[:l.variadic]...)
+		joined = append(joined, strings.Join(params[l.variadic:l.variadic+extra+1], "|"))
+		params = append(joined, params[l.variadic+extra+1:]...)
+	}
+	if len(params) > n || len(params) < n-l.optional {
+		return nil, fmt.Errorf("expected %d parameters, got %d", n, len(params))
+	}
+
+	inOrder := len(params) == n && len(l.fields) == len(schema.fields)
+	for i, k := range l.order {
+		inOrder = inOrder && i == k
+	}
+	if inOrder {
+		return params, nil
+	}
+	normalized := make([]string, len(schema.fields))
+	for i, value := range params {
+		normalized[l.order[i]] = value
+	}
+	return normalized, nil
+}
+
+// eventParams returns the parameters of a report event as its handler
+// expects them, events without a schema are passed as is.
+func eventParams(atoms []string) ([]string, error) {
+	schema, ok := eventSchemas[atoms[4]]
+	if !ok {
+		return atoms[6:], nil
+	}
+	params, err := schema.normalize(atoms[1], atoms[6:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", atoms[4], err)
+	}
+	return params, nil
+}
@@ -0,0 +1,129 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventSchemas(t *testing.T) {
+	for event := range reporters {
+		if _, ok := eventSchemas[event]; !ok {
+			t.Errorf("%s: no schema", event)
+		}
+	}
+}
+
+func TestEventParams(t *testing.T) {
+	tests := []struct {
+		line   string
+		params []string
+		fails  bool
+	}{
+		{"report|0.5|0|smtp-in|link-connect|1|mail.example.org|pass|192.0.2.1:33080|192.0.2.2:25",
+			[]string{"mail.example.org", "pass", "192.0.2.1:33080", "192.0.2.2:25"}, false},
+		{"report|0.5|0|smtp-in|link-connect|1|mail.example.org|pass|192.0.2.1:33080", nil, true},
+		{"report|0.5|0|smtp-in|link-disconnect|1", []string{}, false},
+		{"report|0.5|0|smtp-in|link-disconnect|1|extra", nil, true},
+		{"report|0.5|0|smtp-in|link-reset|1", []string{}, false},
+		{"report|0.5|0|smtp-in|link-auth|1|bob|smith|fail", []string{"bob|smith", "fail"}, false},
+		{"report|0.5|0|smtp-in|link-auth|1|bob", nil, true},
+		{"report|0.5|0|smtp-in|tx-mail|1|1ef1c203|ok|<\"a|b\"@example.org>",
+			[]string{"1ef1c203", "ok", "<\"a|b\"@example.org>"}, false},
+		{"report|0.5|0|smtp-in|tx-commit|1|1ef1c203|4242", []string{"1ef1c203", "4242"}, false},
+		{"report|0.5|0|smtp-in|tx-commit|1|1ef1c203", []string{"1ef1c203", ""}, false},
+		{"report|0.5|0|smtp-in|tx-commit|1", nil, true},
+		{"report|0.5|0|smtp-in|tx-rollback|1", []string{""}, false},
+		{"report|0.5|0|smtp-in|protocol-client|1|AUTH PLAIN a|b", []string{"AUTH PLAIN a|b"}, false},
+		{"report|0.5|0|smtp-in|protocol-server|1|", []string{""}, false},
+		{"report|0.5|0|smtp-in|filter-response|1|connect|reject|550 go away",
+			[]string{"connect", "reject", "550 go away"}, false},
+		{"report|0.5|0|smtp-in|filter-response|1|connect|proceed", []string{"connect", "proceed", ""}, false},
+		{"report|0.5|0|smtp-in|filter-response|1|connect", nil, true},
+		// unknown events are passed as is
+		{"report|0.5|0|smtp-in|link-unknown|1|a|b", []string{"a", "b"}, false},
+	}
+	for _, test := range tests {
+		params, err := eventParams(splitEvent(test.line))
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error %v", test.line, err)
+			continue
+		}
+		if !test.fails && !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%s: got %q, want %q", test.line, params, test.params)
+		}
+	}
+}
+
+func TestEventLayouts(t *testing.T) {
+	// a protocol version moving a field and adding an optional one
+	schema := &eventSchema{
+		fields: []string{"message-id", "result", "address", "extra"},
+		layouts: []eventLayout{
+			{since: "0.5", fields: []string{"message-id", "result", "address"}, variadic: 2},
+			{since: "0.7", fields: []string{"message-id", "address", "result", "extra"}, variadic: 1, optional: 1},
+		},
+	}
+	schema.compile("test")
+
+	tests := []struct {
+		version string
+		params  []string
+		want    []string
+	}{
+		{"0.1", []string{"id", "ok", "a|b"}, []string{"id", "ok", "a|b", ""}},
+		{"0.5", []string{"id", "ok", "a", "b"}, []string{"id", "ok", "a|b", ""}},
+		{"0.6", []string{"id", "ok", "a"}, []string{"id", "ok", "a", ""}},
+		{"0.7", []string{"id", "a", "b", "ok", "x"}, []string{"id", "ok", "a|b", "x"}},
+		{"0.7", []string{"id", "a", "ok"}, []string{"id", "ok", "a", ""}},
+		{"0.10", []string{"id", "a", "ok", "x"}, []string{"id", "ok", "a", "x"}},
+	}
+	for _, test := range tests {
+		params, err := schema.normalize(test.version, test.params)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.version, test.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(params, test.want) {
+			t.Errorf("%s %q: got %q, want %q", test.version, test.params, params, test.want)
+		}
+	}
+
+	if _, err := schema.normalize("0.7", []string{"id"}); err == nil {
+		t.Errorf("0.7: missing fields accepted")
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"0.5", "0.6", true},
+		{"0.6", "0.5", false},
+		{"0.5", "0.5", false},
+		{"0.9", "0.10", true},
+		{"0.5", "0.5.1", true},
+		{"1", "0.9", false},
+	}
+	for _, test := range tests {
+		if less := versionLess(test.a, test.b); less != test.less {
+			t.Errorf("versionLess(%q, %q) = %v, want %v", test.a, test.b, less, test.less)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var exporterRetry *time.Duration
+var exporterFallback *bool
+var exporterFile *string
+var httpRate *float64
+var httpBurst *int
+var httpConcurrency *int
+var httpTimeout *time.Duration
+var accessLog *bool
+
+const httpMaxClients = 10000
+
+// exporterState is how the exporter address was bound, the filter keeps
+// processing events meanwhile so that smtpd's filter chain never breaks.
+var exporterState = struct {
+	sync.Mutex
+	address  string
+	retries  uint64
+	fallback bool
+}{}
+
+// exporterDeferred is true when binding a taken exporter address may be
+// retried or fall back to an ephemeral port rather than be fatal.
+func exporterDeferred() bool {
+	return *exporterRetry > 0 || *exporterFallback
+}
+
+func exporterFallen() bool {
+	exporterState.Lock()
+	defer exporterState.Unlock()
+	return exporterState.fallback
+}
+
+// exporterBind retries binding the exporter address with backoff for
+// -exporter-retry, then falls back to an ephemeral port on the same host.
+func exporterBind() net.Listener {
+	deadline := time.Now().Add(*exporterRetry)
+	delay := time.Second
+	for time.Now().Before(deadline) {
+		time.Sleep(delay)
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+
+		exporterState.Lock()
+		exporterState.retries++
+		exporterState.Unlock()
+
+		listener, err := net.Listen("tcp", *exporter)
+		if err == nil {
+			return listener
+		}
+		log.Printf("exporter: %v", err)
+	}
+
+	if !*exporterFallback {
+		log.Printf("exporter: giving up on %s, metrics won't be exposed", *exporter)
+		return nil
+	}
+	host, _, err := net.SplitHostPort(*exporter)
+	if err != nil {
+		log.Printf("exporter: %v", err)
+		return nil
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		log.Printf("exporter: %v, metrics won't be exposed", err)
+		return nil
+	}
+	log.Printf("exporter: %s is taken, listening on %s instead", *exporter, listener.Addr())
+
+	exporterState.Lock()
+	exporterState.fallback = true
+	exporterState.Unlock()
+	return listener
+}
+
+// exporterAnnounce writes the address the exporter listens on, along with
+// the pid of the filter, for service discovery to find a fallback port.
+func exporterAnnounce(address string) error {
+	exporterState.Lock()
+	exporterState.address = address
+	fallback := exporterState.fallback
+	exporterState.Unlock()
+
+	if *exporterFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(struct {
+		PID      int    `json:"pid"`
+		Address  string `json:"address"`
+		Fallback bool   `json:"fallback"`
+	}{os.Getpid(), address, fallback})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(*exporterFile), ".filter-prometheus")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), *exporterFile)
+}
+
+// httpClient is the token bucket of a client address.
+type httpClient struct {
+	tokens float64
+	seen   time.Time
+}
+
+// httpLimits protects event processing from misconfigured scrapers, every
+// scrape holding the metrics lock for a while.
+var httpLimits = struct {
+	sync.Mutex
+	clients map[string]*httpClient
+	active  chan struct{}
+	limited map[string]uint64
+}{
+	clients: make(map[string]*httpClient),
+	limited: map[string]uint64{"rate": 0, "concurrency": 0},
+}
+
+func httpAllow(address string, now time.Time) bool {
+	httpLimits.Lock()
+	defer httpLimits.Unlock()
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	c, ok := httpLimits.clients[host]
+	if !ok {
+		if len(httpLimits.clients) >= httpMaxClients {
+			// clients with a full bucket are as good as new
+			for key, client := range httpLimits.clients {
+				if now.Sub(client.seen).Seconds()**httpRate >= float64(*httpBurst) {
+					delete(httpLimits.clients, key)
+				}
+			}
+		}
+		c = &httpClient{tokens: float64(*httpBurst), seen: now}
+		if len(httpLimits.clients) < httpMaxClients {
+			httpLimits.clients[host] = c
+		}
+	}
+
+	c.tokens += now.Sub(c.seen).Seconds() * *httpRate
+	if c.tokens > float64(*httpBurst) {
+		c.tokens = float64(*httpBurst)
+	}
+	c.seen = now
+	if c.tokens < 1 {
+		httpLimits.limited["rate"]++
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+func httpLimit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *httpRate > 0 && !httpAllow(r.RemoteAddr, time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if httpLimits.active != nil {
+			select {
+			case httpLimits.active <- struct{}{}:
+				defer func() { <-httpLimits.active }()
+			default:
+				httpLimits.Lock()
+				httpLimits.limited["concurrency"]++
+				httpLimits.Unlock()
+				http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// httpRequests counts the requests served per status code.
+var httpRequests = struct {
+	sync.Mutex
+	codes map[int]uint64
+}{codes: map[int]uint64{http.StatusOK: 0}}
+
+// httpRecorder captures the status code and size of a response.
+type httpRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (r *httpRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *httpRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func httpLog(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &httpRecorder{ResponseWriter: w, code: http.StatusOK}
+		handler.ServeHTTP(rec, r)
+
+		httpRequests.Lock()
+		httpRequests.codes[rec.code]++
+		httpRequests.Unlock()
+
+		if *accessLog {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			log.Print("http ", logfmt(
+				"client", host,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"code", strconv.Itoa(rec.code),
+				"bytes", strconv.Itoa(rec.bytes),
+				"duration", strconv.FormatFloat(time.Since(start).Seconds(), 'f', 6, 64),
+				"agent", r.UserAgent()))
+		}
+	})
+}
+
+func httpInit() {
+	if *httpRate < 0 || *httpRate > 0 && *httpBurst < 1 {
+		log.Fatalf("invalid HTTP rate: %g requests per second, burst of %d", *httpRate, *httpBurst)
+	}
+	if *httpConcurrency > 0 {
+		httpLimits.active = make(chan struct{}, *httpConcurrency)
+	}
+}
+
+func exporterServe(listener net.Listener) {
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/metrics/smtp-in", directionHandler("smtp-in"))
+	http.HandleFunc("/metrics/smtp-out", directionHandler("smtp-out"))
+	http.HandleFunc("/api/v1/offenders", offendersHandler)
+	http.HandleFunc("/api/v1/config", configHandler)
+	http.HandleFunc("/schema", schemaHandler)
+
+	if listener == nil {
+		if listener = exporterBind(); listener == nil {
+			return
+		}
+	}
+	if err := exporterAnnounce(listener.Addr().String()); err != nil {
+		log.Printf("exporter: %v", err)
+	}
+	if *handoffFile != "" && !exporterFallen() {
+		handoffLoad()
+		handoffListen(listener)
+	}
+
+	server := &http.Server{
+		Handler:           httpLog(httpLimit(http.DefaultServeMux)),
+		ReadHeaderTimeout: *httpTimeout,
+		ReadTimeout:       *httpTimeout,
+		WriteTimeout:      *httpTimeout,
+		MaxHeaderBytes:    16 << 10,
+	}
+	log.Fatal(server.Serve(listener))
+}
+
+func exporterCollector(e *exposition) {
+	exporterState.Lock()
+	defer exporterState.Unlock()
+
+	e.header("smtpd_exporter_bind_retries_total", "The number of times binding the exporter address was retried.", "counter", nil)
+	e.sample("smtpd_exporter_bind_retries_total", "", float64(exporterState.retries))
+	e.end()
+
+	fallback := 0.0
+	if exporterState.fallback {
+		fallback = 1
+	}
+	httpLimits.Lock()
+	e.header("smtpd_exporter_requests_limited_total", "The number of HTTP requests refused per limit.", "counter", nil, "limit")
+	for _, reason := range []string{"rate", "concurrency"} {
+		e.sample("smtpd_exporter_requests_limited_total", label("limit", reason), float64(httpLimits.limited[reason]))
+	}
+	e.end()
+	httpLimits.Unlock()
+
+	httpRequests.Lock()
+	codes := []int{}
+	for code := range httpRequests.codes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	e.header("smtpd_exporter_http_requests_total", "The number of HTTP requests served per status code.", "counter", nil, "code")
+	for _, code := range codes {
+		e.sample("smtpd_exporter_http_requests_total", label("code", strconv.Itoa(code)), float64(httpRequests.codes[code]))
+	}
+	e.end()
+	httpRequests.Unlock()
+
+	e.header("smtpd_exporter_fallback", "Whether the exporter listens on an ephemeral port because its address was taken.", "gauge", nil, "address")
+	e.sample("smtpd_exporter_fallback", label("address", exporterState.address), fallback)
+	e.end()
+}
@@ -0,0 +1,52 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// features compiled in through build tags, they register themselves from
+// their init functions.
+var features = make(map[string]bool)
+
+func registerFeature(name string) {
+	features[name] = true
+}
+
+// registerCollector adds a collector after the built-in ones, for features
+// that are only compiled in with a build tag.
+func registerCollector(name string, collect func(*exposition)) {
+	if getCollector(name) != nil {
+		log.Fatalf("duplicate collector: %s", name)
+	}
+	collectors = append(collectors, &collector{name: name, collect: collect})
+}
+
+func buildInfoCollector(e *exposition) {
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e.header("smtpd_filter_build_info", "The optional features the filter was built with.", "gauge", nil, "features")
+	e.sample("smtpd_filter_build_info", label("features", strings.Join(names, ",")), 1)
+	e.end()
+}
@@ -18,21 +18,81 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"log"
+	"net"
 	"net/http"
 )
 
 var exporter *string
+var rawAddressFamily *bool
 var registerSMTPIn bool = false
 var registerSMTPOut bool = false
 
 type session struct {
-	id string
+	id          string
+	subsystem   string
+	role        string
+	peer        string
+	peerTracked bool
+	proxied     bool
+	greeted     bool
+	rejected    string
+
+	// what preceded link-disconnect
+	quit     bool
+	timedOut bool
+
+	// STARTTLS accepted, or waiting for the server response
+	starttls bool
+
+	// smtp-in HELO/EHLO name, and whether a command was refused since
+	helo    string
+	refused bool
+
+	// smtp-in reputation tier of the peer, with -reputation
+	reputation string
+
+	// smtp-out only
+	relay       string
+	failed      bool
+	envelopes   []string
+	remoteError string
+
+	// timestamp of the event being processed
+	timestamp time.Time
+
+	connectedAt  time.Time
+	greetedAt    time.Time
+	identifiedAt time.Time
+	mailAt       time.Time
+	dataAt       time.Time
+	txEndAt      time.Time
+
+	command   string
+	commandAt time.Time
+
+	msg *message
+
+	// size of the message of the transaction, in passthrough mode
+	msgBytes uint64
+
+	txBeganAt   time.Time
+	mailDomain  string
+	rcptDomains map[string]uint64
+	classes     map[string]bool
+	selftest    string
 
 	inet4 bool
 	inet6 bool
@@ -40,11 +100,21 @@ type session struct {
 
 	auth bool
 	tls  bool
+	tx   bool
 }
 
-var sessions = make(map[string]*session)
+var sessions = newSessionStore(16)
+
+// metricsLock is held for writing while an event updates the metrics and
+// for reading while a scrape renders them, so that related counters (say,
+// commits and active transactions) are always observed consistently.
+var metricsLock sync.RWMutex
 
 type metrics struct {
+	direction string
+	role      string
+	labelSet  string
+
 	sessionsActive uint64
 	sessionsTotal  uint64
 
@@ -59,30 +129,165 @@ type metrics struct {
 	sessionsTLSActive uint64
 	sessionsTLSTotal  uint64
 
+	tlsHandshakeFailures uint64
+
 	sessionsAuthActive   uint64
 	sessionsAuthTotal    uint64
 	sessionsAuthFailures uint64
 
+	authAttempts window
+	authFailures window
+
+	peers *peerTable
+	helos *heloTable
+
+	sessionsPrivilegedPort uint64
+	sessionsProxyPort      map[string]uint64
+	sessionsProxied        uint64
+	sessionsSeeded         uint64
+
 	txActive        uint64
 	txCommitTotal   uint64
 	txRollbackTotal uint64
 	txTotal         uint64
+	txNullSender    uint64
+
+	// committed transactions per day of week and hour, in local time
+	txCommitHourOfWeek [7][24]uint64
+
+	lastCommit struct {
+		labels    string
+		timestamp time.Time
+	}
+	lastAuthAt time.Time
+
+	phases      map[string]map[string]*histogram
+	filterDelay map[string]map[string]*histogram
+
+	phaseQuantiles       map[string]*quantileWindow
+	filterDelayQuantiles *quantileWindow
+
+	messageClass       map[string]uint64
+	messageAttachments uint64
+	messageExecutables map[string]uint64
+	messageParts       *histogram
+	messageHeaderBytes *histogram
+	messageBodyBytes   *histogram
+
+	messageHops         *histogram
+	messageHopsExceeded uint64
+	messageDuplicateID  uint64
+	messageFormat       map[string]uint64
+	messageContentType  map[string]uint64
+	messageCharset      map[string]uint64
+
+	// spam scores per sender tenant, with -spam-score-headers
+	spamScores map[string]*histogram
+
+	// time from DATA being accepted to the first data line
+	dataFirstLine *histogram
+
+	// bytes per second from DATA to the final dot
+	dataThroughput *histogram
+	dataTrickling  uint64
+
+	// data received for transactions rolled back
+	wastedBytes uint64
+
+	anomalies map[string]uint64
+	clamps    map[string]uint64
+
+	limitHits map[string]uint64
+
+	// responses per class.subject.detail enhanced status code
+	responsesEnhanced map[string]uint64
+
+	connectionsRejected map[string]uint64
+	disconnects         map[string]uint64
+
+	domainUsage usageTable
+	tenantUsage usageTable
+
+	addressClasses map[string]uint64
+
+	// smtp-in sessions and commits per reputation tier, with -reputation
+	reputationSessions map[string]uint64
+	reputationCommits  map[string]uint64
+
+	// smtp-in sessions per autonomous system, with -asn-database
+	asns *asnTable
 }
 
-var smtpIn = metrics{}
-var smtpOut = metrics{}
+var smtpIn = newMetrics("smtp-in")
+var smtpOut = newMetrics("smtp-out")
 
 var reporters = map[string]func(*session, string, []string){
 	"link-connect":    linkConnect,
 	"link-disconnect": linkDisconnect,
+	"link-greeting":   linkGreeting,
+	"link-identify":   linkIdentify,
 	"link-tls":        linkTLS,
 	"link-auth":       linkAuth,
+	"link-reset":      linkReset,
 	"tx-reset":        txReset,
 	"tx-begin":        txBegin,
 	"tx-mail":         txMail,
 	"tx-rcpt":         txRcpt,
+	"tx-envelope":     txEnvelope,
+	"tx-data":         txData,
 	"tx-commit":       txCommit,
 	"tx-rollback":     txRollback,
+	"protocol-client": protocolClient,
+	"protocol-server": protocolServer,
+	"timeout":         linkTimeout,
+	"filter-response": filterResponse,
+}
+
+// newBuckets returns counters for the given values, so that they are
+// exposed at zero before being first seen.
+func newBuckets(buckets []string) map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, bucket := range buckets {
+		counts[bucket] = 0
+	}
+	return counts
+}
+
+func newMetrics(direction string) metrics {
+	return metrics{
+		direction: direction,
+		labelSet:  label("direction", direction),
+		anomalies: newBuckets(anomalyKinds),
+		clamps:    newBuckets(clampedGauges),
+		limitHits: newLimits(),
+
+		connectionsRejected: newBuckets(rejectionReasons),
+		disconnects:         newBuckets(disconnectReasons),
+		responsesEnhanced:   make(map[string]uint64),
+		domainUsage:         make(usageTable),
+		tenantUsage:         make(usageTable),
+		authAttempts:        newWindow(5 * time.Minute),
+		authFailures:        newWindow(5 * time.Minute),
+		peers:               newPeerTable(),
+		helos:               newHeloTable(),
+		phases:              newPhaseHistograms(),
+		filterDelay:         newCommandHistograms(),
+
+		phaseQuantiles:       newQuantileWindows(phases),
+		filterDelayQuantiles: &quantileWindow{},
+		messageClass:         newBuckets(messageClasses),
+
+		messageExecutables: newBuckets(executableExtensions),
+		messageFormat:      newBuckets(formatAnomalies),
+		messageContentType: newBuckets(contentTypes),
+		messageCharset:     newBuckets(charsets),
+		messageParts:       newHistogram(1, 2, 3, 5, 10, 20, 50),
+		messageHeaderBytes: newHistogram(256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536),
+		messageBodyBytes:   newHistogram(1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216, 67108864),
+		messageHops:        newHistogram(1, 2, 3, 5, 10, 20, 30, 50, 100),
+		dataFirstLine:      newHistogram(latencyBuckets...),
+		dataThroughput:     newHistogram(10, 100, 1000, 10000, 100000, 1000000, 10000000, 100000000),
+	}
 }
 
 func getMetrics(subsystem string) *metrics {
@@ -95,138 +300,441 @@ func getMetrics(subsystem string) *metrics {
 	return &metrics{}
 }
 
+func (m *metrics) labels() string {
+	return m.labelSet
+}
+
+// labelNames are the names of the labels of the metric set.
+func (m *metrics) labelNames() []string {
+	if m.role != "" {
+		return []string{"direction", "session_role"}
+	}
+	return []string{"direction"}
+}
+
+// addressFamily classifies a link-connect address, IPv4-mapped addresses
+// (::ffff:a.b.c.d) seen on dual-stack listeners count as inet4 unless the
+// raw classification was requested.
+func addressFamily(address string) string {
+	if strings.HasPrefix(address, "unix:") {
+		return "unix"
+	}
+	if !strings.HasPrefix(address, "[") {
+		return "inet4"
+	}
+	if !*rawAddressFamily {
+		if host, ok := peerAddress(address); ok && net.ParseIP(host).To4() != nil {
+			return "inet4"
+		}
+	}
+	return "inet6"
+}
+
+// peerAddress extracts the IP address from a link-connect address,
+// normalizing IPv4-mapped addresses the same way addressFamily does.
+func peerAddress(address string) (string, bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil && !*rawAddressFamily {
+		return ip.To4().String(), true
+	}
+	return host, true
+}
+
 func linkConnect(s *session, subsystem string, params []string) {
-	if len(params) != 4 {
-		log.Fatal("invalid input, shouldn't happen")
+	if subsystem == "smtp-in" {
+		s.role = listenerRole(params[3])
 	}
-	m := getMetrics(subsystem)
+	m := s.metrics()
 
 	m.sessionsActive++
 	m.sessionsTotal++
 
-	src := params[2]
-	if !strings.HasPrefix(src, "unix:") {
-		if src[0] == '[' {
-			m.sessionsInet6Active++
-			m.sessionsInet6Total++
-			s.inet6 = true
-		} else {
-			m.sessionsInet4Active++
-			m.sessionsInet4Total++
-			s.inet4 = true
-		}
-	} else {
+	s.connectedAt = s.timestamp
+
+	switch addressFamily(params[2]) {
+	case "inet6":
+		m.sessionsInet6Active++
+		m.sessionsInet6Total++
+		s.inet6 = true
+	case "inet4":
+		m.sessionsInet4Active++
+		m.sessionsInet4Total++
+		s.inet4 = true
+	default:
 		m.sessionsUnixActive++
 		m.sessionsUnixTotal++
 		s.unix = true
 	}
+
+	// the peer is the client for smtp-in and the remote server for smtp-out
+	peer := params[2]
+	if subsystem == "smtp-out" {
+		peer = params[3]
+	}
+	host, ok := peerAddress(peer)
+	if ok && subsystem == "smtp-in" && isProxy(host) {
+		// the reported address is the proxy's, not the client's
+		m.sessionsProxied++
+		s.proxied = true
+	}
+	if ok && !s.unix && !s.proxied {
+		s.peer = host
+		s.peerTracked = m.peers.connect(host)
+	}
+
+	if subsystem == "smtp-in" && !s.unix && !s.proxied {
+		sourcePort(m, params[2])
+	}
+	if subsystem == "smtp-in" && m.reputationSessions != nil {
+		s.reputation = reputationTier(s.peer)
+		m.reputationSessions[s.reputation]++
+	}
+	historyIP(s, func(c *historyCounts) { c.Connections++ })
+
+	if subsystem == "smtp-out" {
+		s.relay = normalizeHostname(params[0])
+		if s.relay == "" || s.relay == "<unknown>" {
+			s.relay = s.peer
+		}
+	}
 }
 
 func linkDisconnect(s *session, subsystem string, params []string) {
-	if len(params) != 0 {
-		log.Fatal("invalid input, shouldn't happen")
+	m := s.metrics()
+	if subsystem == "smtp-out" && !s.greeted {
+		outboundConnectFailure(s)
+	}
+	if subsystem == "smtp-out" && s.greeted && !s.tls {
+		outboundTLSVerify["none"]++
 	}
-	m := getMetrics(subsystem)
+	if subsystem == "smtp-out" && s.remoteError != "" {
+		accountDeferral(s)
+	}
+	tlsHandshakeFailure(m, s)
+	accountRejection(m, s)
+	accountHelo(m, s)
+	accountASN(m, s)
+	releaseSession(s, m)
+}
+
+// releaseSession forgets a session and its contribution to active gauges.
+func releaseSession(s *session, m *metrics) {
 	if s.inet4 {
-		m.sessionsInet4Active--
+		m.decrement(&m.sessionsInet4Active, "smtpd_sessions_inet4_active")
 	} else if s.inet6 {
-		m.sessionsInet6Active--
+		m.decrement(&m.sessionsInet6Active, "smtpd_sessions_inet6_active")
 	} else if s.unix {
-		m.sessionsUnixActive--
+		m.decrement(&m.sessionsUnixActive, "smtpd_sessions_unix_active")
 	}
 
 	if s.auth {
-		m.sessionsAuthActive--
+		m.decrement(&m.sessionsAuthActive, "smtpd_sessions_auth_active")
 	}
 
 	if s.tls {
-		m.sessionsTLSActive--
+		m.decrement(&m.sessionsTLSActive, "smtpd_sessions_tls_active")
+	}
+
+	if s.peerTracked {
+		m.peers.disconnect(s.peer)
+	}
+
+	if s.tx {
+		m.decrement(&m.txActive, "smtpd_tx_active")
 	}
 
-	m.sessionsActive--
+	m.decrement(&m.sessionsActive, "smtpd_sessions_active")
 
-	delete(sessions, s.id)
+	sessions.delete(s.id)
 }
 
-func linkTLS(s *session, subsystem string, params []string) {
-	if len(params) != 1 {
-		log.Fatal("invalid input, shouldn't happen")
+func linkGreeting(s *session, subsystem string, params []string) {
+	s.greeted = true
+	s.greetedAt = s.timestamp
+	observePhase(s.metrics(), s, "banner", s.connectedAt, s.timestamp)
+}
+
+func linkIdentify(s *session, subsystem string, params []string) {
+	s.identifiedAt = s.timestamp
+	s.helo = params[1]
+	observePhase(s.metrics(), s, "helo", s.greetedAt, s.timestamp)
+}
+
+func linkTimeout(s *session, subsystem string, params []string) {
+	s.metrics().limitHits["timeout"]++
+	s.timedOut = true
+
+	if subsystem == "smtp-out" && !s.greeted {
+		outboundConnectFailure(s)
 	}
-	m := getMetrics(subsystem)
+}
+
+func linkTLS(s *session, subsystem string, params []string) {
+	m := s.metrics()
 	m.sessionsTLSActive++
 	m.sessionsTLSTotal++
 	s.tls = true
+
+	if subsystem == "smtp-out" {
+		outboundTLSVerify[tlsVerifyResult(params[0])]++
+	} else if name, ok := tlsServerName(params[0]); ok && len(tlsHostnames) != 0 {
+		tlsSNI[name]++
+	}
+
+	if version := tlsVersion(params[0]); legacyTLS[version] {
+		security(s.timestamp, "tls_downgrade", map[string]string{
+			"direction": subsystem,
+			"ip":        s.peer,
+			"version":   version,
+		})
+	}
 }
 
 func linkAuth(s *session, subsystem string, params []string) {
-	if len(params) != 2 {
-		log.Fatal("invalid input, shouldn't happen")
-	}
-	m := getMetrics(subsystem)
+	m := s.metrics()
 
+	now := time.Now()
+	m.authAttempts.add(now, 1)
 	if params[1] != "pass" {
+		m.authFailures.add(now, 1)
 		m.sessionsAuthFailures++
+		fields := map[string]string{
+			"direction": subsystem,
+			"ip":        s.peer,
+			"user":      params[0],
+		}
+		if s.role != "" {
+			fields["role"] = s.role
+		}
+		security(s.timestamp, "auth_failure", fields)
+		if subsystem == "smtp-in" && s.peer != "" {
+			offenderAuthFailure(s.peer)
+		}
+		historyIP(s, func(c *historyCounts) { c.AuthFailures++ })
 		return
 	}
+	historyIP(s, func(c *historyCounts) { c.AuthSuccesses++ })
 	m.sessionsAuthActive++
 	m.sessionsAuthTotal++
+	m.lastAuthAt = s.timestamp
 	s.auth = true
 }
 
+// linkReset is reported when smtpd resets the session state, any
+// transaction still open is over.
+func linkReset(s *session, subsystem string, params []string) {
+	if !s.tx {
+		return
+	}
+	m := s.metrics()
+	m.decrement(&m.txActive, "smtpd_tx_active")
+	s.tx = false
+	s.txEndAt = s.timestamp
+}
+
 func txReset(s *session, subsystem string, params []string) {
-	if len(params) != 1 {
-		log.Fatal("invalid input, shouldn't happen")
+	m := s.metrics()
+	if !s.tx {
+		anomaly(m, "reset_without_begin")
+		return
 	}
-	m := getMetrics(subsystem)
-	m.txActive--
+	m.decrement(&m.txActive, "smtpd_tx_active")
+	s.tx = false
+	s.txEndAt = s.timestamp
 }
 
 func txBegin(s *session, subsystem string, params []string) {
-	if len(params) != 1 {
-		log.Fatal("invalid input, shouldn't happen")
+	m := s.metrics()
+	if s.tx {
+		// the previous transaction was never reset
+		anomaly(m, "duplicate_begin")
+		m.decrement(&m.txActive, "smtpd_tx_active")
 	}
-	m := getMetrics(subsystem)
+	s.tx = true
+	s.txBeganAt = s.timestamp
 	m.txActive++
 	m.txTotal++
+	s.envelopes = nil
+	s.msg = nil
+	s.msgBytes = 0
+	s.mailDomain = ""
+	s.rcptDomains = nil
+	s.classes = nil
+	s.selftest = ""
 }
 
 func txMail(s *session, subsystem string, params []string) {
-	if len(params) < 3 {
-		log.Fatal("invalid input, shouldn't happen")
-	}
-	//m := getMetrics(subsystem)
+	m := s.metrics()
 	status := params[1]
 
 	if status != "ok" {
+		s.refused = true
 		return
 	}
+
+	// DSNs and bounces are sent with an empty reverse-path
+	if address := params[2]; address == "" || address == "<>" {
+		m.txNullSender++
+	}
+	s.mailDomain = addressDomain(params[2])
+	s.selftest = selftestToken(params[2])
+	classifyAddress(s, params[2])
+
+	start := s.identifiedAt
+	if s.txEndAt.After(start) {
+		start = s.txEndAt
+	}
+	s.mailAt = s.timestamp
+	observePhase(m, s, "mail", start, s.timestamp)
 }
 
 func txRcpt(s *session, subsystem string, params []string) {
-	if len(params) < 3 {
-		log.Fatal("invalid input, shouldn't happen")
-	}
-	//m := getMetrics(subsystem)
 	status := params[1]
 
 	if status != "ok" {
+		s.refused = true
 		return
 	}
+
+	if domain := addressDomain(params[2]); domain != "" {
+		if s.rcptDomains == nil {
+			s.rcptDomains = make(map[string]uint64)
+		}
+		s.rcptDomains[domain]++
+		if subsystem == "smtp-out" {
+			daneDomain(domain)
+		}
+	}
+	classifyAddress(s, params[2])
+}
+
+func txEnvelope(s *session, subsystem string, params []string) {
+	if subsystem == "smtp-out" {
+		s.envelopes = append(s.envelopes, params[1])
+	}
+}
+
+func txData(s *session, subsystem string, params []string) {
+	m := s.metrics()
+
+	if params[1] != "ok" {
+		return
+	}
+	s.dataAt = s.timestamp
+	observePhase(m, s, "data", s.mailAt, s.timestamp)
 }
 
 func txCommit(s *session, subsystem string, params []string) {
-	m := getMetrics(subsystem)
+	m := s.metrics()
+	if !s.tx {
+		anomaly(m, "commit_without_begin")
+	}
 	m.txCommitTotal++
+	local := s.timestamp.Local()
+	m.txCommitHourOfWeek[local.Weekday()][local.Hour()]++
+	m.lastCommit.labels = label("msgid", params[0])
+	m.lastCommit.timestamp = s.timestamp
+	observePhase(m, s, "commit", s.dataAt, s.timestamp)
+	s.txEndAt = s.timestamp
+
+	// left out by smtpd versions not reporting it
+	size, _ := strconv.ParseUint(params[1], 10, 64)
+	accountTransaction(m, s, size)
+	historyTransaction(s, func(c *historyCounts) {
+		c.Commits++
+		for _, count := range s.rcptDomains {
+			c.Recipients += count
+		}
+	})
+	accountClasses(m, s)
+	if s.reputation != "" {
+		m.reputationCommits[s.reputation]++
+	}
+	selftestCommitted(s.selftest)
+	emitRecord(s, subsystem, "commit", params[0], size)
+
+	if subsystem == "smtp-out" {
+		deliveryDone(s.envelopes, s.timestamp)
+		s.envelopes = nil
+		s.remoteError = ""
+	}
 }
 
 func txRollback(s *session, subsystem string, params []string) {
-	m := getMetrics(subsystem)
+	m := s.metrics()
+	if !s.tx {
+		anomaly(m, "rollback_without_begin")
+	}
 	m.txRollbackTotal++
+	s.txEndAt = s.timestamp
+
+	emitRecord(s, subsystem, "rollback", params[0], 0)
+	wastedBytes(s)
+	historyTransaction(s, func(c *historyCounts) { c.Rollbacks++ })
+
+	if subsystem == "smtp-out" {
+		deliveryFailure(s.timestamp)
+		deliveryDeferred(s.envelopes, s.timestamp, strings.HasPrefix(s.remoteError, "5"))
+		accountDeferral(s)
+		s.envelopes = nil
+	}
+}
+
+func protocolClient(s *session, subsystem string, params []string) {
+	// a client talking before the banner is an early talker
+	if subsystem == "smtp-in" && !s.greeted && s.peer != "" {
+		offenderEarlyTalker(s.peer)
+	}
+
+	line := params[0]
+	starttlsCommand(s, line)
+	if strings.EqualFold(strings.TrimSpace(line), "QUIT") {
+		s.quit = true
+	}
+	if subsystem == "smtp-in" {
+		s.command = commandVerb(line)
+		s.commandAt = s.timestamp
+	}
+}
+
+func protocolServer(s *session, subsystem string, params []string) {
+	m := s.metrics()
+	response := params[0]
+	if limit := classifyLimit(response); limit != "" {
+		m.limitHits[limit]++
+	}
+	accountEnhancedStatus(m, response)
+	if response != "" {
+		serverRejection(s, response)
+	}
+	starttlsResponse(s, response)
+	remoteError(s, response)
+
+	// multi-line responses are only accounted for once
+	if s.command != "" {
+		if !s.timestamp.Before(s.commandAt) {
+			m.filterDelay[s.family()][s.command].observe(s.timestamp.Sub(s.commandAt).Seconds())
+			m.filterDelayQuantiles.observe(time.Now(), s.timestamp.Sub(s.commandAt).Seconds())
+		}
+		s.command = ""
+	}
 }
 
 func filterInit() {
+	metricsLock.Lock()
+	registered["smtp-in"] = registerSMTPIn
+	registered["smtp-out"] = registerSMTPOut
+	handshakeInfo.smtpdVersion = smtpdVersion
+	metricsLock.Unlock()
+
 	if registerSMTPIn {
 		fmt.Printf("register|report|smtp-in|*\n")
+		if *passthrough {
+			fmt.Printf("register|filter|smtp-in|data-line\n")
+		}
 	}
 	if registerSMTPOut {
 		fmt.Printf("register|report|smtp-out|*\n")
@@ -234,167 +742,802 @@ func filterInit() {
 	fmt.Println("register|ready")
 }
 
+// splitEvent splits a line into its fields, data lines are split up to
+// their content which is kept as is.
+func splitEvent(line string) []string {
+	if strings.HasPrefix(line, "filter|") {
+		return strings.SplitN(line, "|", 8)
+	}
+	return strings.Split(line, "|")
+}
+
+// parseTimestamp parses smtpd's seconds.fraction timestamps without going
+// through a float, which is both slower and lossy.
+func parseTimestamp(value string) (time.Time, error) {
+	sec, frac := value, ""
+	if i := strings.IndexByte(value, '.'); i != -1 {
+		sec, frac = value[:i], value[i+1:]
+	}
+	seconds, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// windows and histograms work on nanoseconds since the epoch
+	if seconds < 0 || seconds >= math.MaxInt64/int64(time.Second) {
+		return time.Time{}, strconv.ErrRange
+	}
+	nanoseconds := int64(0)
+	for i := 0; i < 9; i++ {
+		nanoseconds *= 10
+		if i < len(frac) {
+			if frac[i] < '0' || frac[i] > '9' {
+				return time.Time{}, strconv.ErrSyntax
+			}
+			nanoseconds += int64(frac[i] - '0')
+		}
+	}
+	return time.Unix(seconds, nanoseconds), nil
+}
+
 func trigger(actions map[string]func(*session, string, []string), atoms []string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	timestamp, err := parseTimestamp(atoms[2])
+	if err != nil {
+		invalidEvent(fmt.Errorf("invalid timestamp: %s", atoms[2]))
+		return
+	}
+	params, err := eventParams(atoms)
+	if err != nil {
+		invalidEvent(err)
+		return
+	}
+	protocolSeen(atoms[1])
+
 	if atoms[4] == "link-connect" {
 		// special case to simplify subsequent code
+		if previous, ok := sessions.get(atoms[5]); ok {
+			anomaly(previous.metrics(), "duplicate_connect")
+			linkDisconnect(previous, atoms[3], nil)
+		}
 		s := session{}
-		s.id = atoms[5]
-		sessions[s.id] = &s
+		// copied so the session doesn't pin the whole line in memory
+		s.id = string([]byte(atoms[5]))
+		s.subsystem = atoms[3]
+		sessions.set(&s)
 	}
 
-	s, ok := sessions[atoms[5]]
+	s, ok := sessions.get(atoms[5])
 	if !ok {
+		if atoms[4] == "link-disconnect" && seededDisconnect(getMetrics(atoms[3])) {
+			return
+		}
+		anomaly(getMetrics(atoms[3]), "unknown_session")
 		return
 	}
 
+	s.timestamp = timestamp
+
+	emitEvent(s, atoms, params)
+
 	if v, ok := actions[atoms[4]]; ok {
-		v(s, atoms[3], atoms[6:])
+		v(s, atoms[3], params)
 	}
+	dispatchEvent(s, atoms, params)
 }
 
-func skipConfig(scanner *bufio.Scanner) {
-	for {
-		if !scanner.Scan() {
-			os.Exit(0)
+type exposition struct {
+	w           io.Writer
+	sets        []*metrics
+	openMetrics bool
+	scratch     []byte
+
+	// type of the family being exposed
+	kind string
+
+	// direction the exposition is restricted to, if any, the header of a
+	// family is pending until one of its samples is kept
+	direction string
+	pending   []byte
+
+	// declare is told about every family exposed, see schema
+	declare func(name string, help string, kind string, sets []*metrics, labels []string)
+}
+
+// inbound returns the metric sets for which passthrough metrics make sense,
+// data lines are only ever seen on smtp-in.
+func (e *exposition) inbound() []*metrics {
+	sets := []*metrics{}
+	for _, m := range e.sets {
+		if m.direction == "smtp-in" {
+			sets = append(sets, m)
 		}
-		line := scanner.Text()
-		if line == "config|subsystem|smtp-in" {
-			registerSMTPIn = true
+	}
+	return sets
+}
+
+// header starts a family, sets are the metric sets whose labels its
+// samples carry, nil if none, and labels the names of their other labels.
+func (e *exposition) header(name string, help string, kind string, sets []*metrics, labels ...string) {
+	if e.declare != nil {
+		e.declare(name, help, kind, sets, labels)
+	}
+	e.kind = kind
+	if e.openMetrics && kind == "counter" {
+		// OpenMetrics counter families are named without their _total
+		// suffix, counters not following the convention are left untyped.
+		if strings.HasSuffix(name, "_total") {
+			name = strings.TrimSuffix(name, "_total")
+		} else {
+			kind = "unknown"
 		}
-		if line == "config|subsystem|smtp-out" {
-			registerSMTPOut = true
+	}
+	b := append(e.scratch[:0], "# HELP "...)
+	b = append(append(append(b, name...), ' '), help...)
+	b = append(b, "\n# TYPE "...)
+	b = append(append(append(b, name...), ' '), kind...)
+	b = append(b, '\n')
+	if e.direction != "" {
+		e.pending = append(e.pending[:0], b...)
+		return
+	}
+	e.w.Write(b)
+	e.scratch = b
+}
+
+// keep restricts the exposition to the series of its direction, series
+// without a direction only belong to the combined exposition.
+func (e *exposition) keep(labels string) bool {
+	if e.direction == "" {
+		return true
+	}
+	if !strings.Contains(labels, label("direction", e.direction)) {
+		return false
+	}
+	if e.pending != nil {
+		e.w.Write(e.pending)
+		e.pending = nil
+	}
+	return true
+}
+
+func (e *exposition) sample(name string, labels string, value float64) {
+	if !e.keep(labels) {
+		return
+	}
+	// samples are the bulk of a scrape, they are assembled in a reused
+	// buffer rather than through fmt
+	b := append(e.scratch[:0], name...)
+	if labels != "" {
+		b = append(b, '{')
+		b = append(b, labels...)
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, e.offset(name, labels, value), 'f', -1, 64)
+	b = append(b, '\n')
+	e.w.Write(b)
+	e.scratch = b
+}
+
+// exemplar is only exposed in the OpenMetrics format, it must follow the
+// sample it belongs to.
+func (e *exposition) exemplar(labels string, value float64, timestamp time.Time) {
+	if !e.openMetrics || labels == "" {
+		return
+	}
+	fmt.Fprintf(e.w, " # {%s} %s %.3f", labels, strconv.FormatFloat(value, 'f', -1, 64), float64(timestamp.UnixNano())/1e9)
+}
+
+func (e *exposition) sampleWithExemplar(name string, labels string, value float64, exemplarLabels string, exemplarValue float64, timestamp time.Time) {
+	if !e.openMetrics || exemplarLabels == "" {
+		e.sample(name, labels, value)
+		return
+	}
+	if !e.keep(labels) {
+		return
+	}
+	fmt.Fprintf(e.w, "%s{%s} %s", name, labels, strconv.FormatFloat(e.offset(name, labels, value), 'f', -1, 64))
+	e.exemplar(exemplarLabels, exemplarValue, timestamp)
+	fmt.Fprintf(e.w, "\n")
+}
+
+// created follows a counter sample in the OpenMetrics format with the time
+// its series appeared, so that the first increment isn't lost to rate().
+func (e *exposition) created(name string, labels string, t time.Time) {
+	if !e.openMetrics || !strings.HasSuffix(name, "_total") {
+		return
+	}
+	// series carried over from the previous process are older
+	if handoffOffsets != nil && handoffStart.Before(t) {
+		t = handoffStart
+	}
+	e.sample(strings.TrimSuffix(name, "_total")+"_created", labels, float64(t.UnixNano())/1e9)
+}
+
+func (e *exposition) end() {
+	if e.pending != nil {
+		// no sample of the family was kept
+		e.pending = nil
+		return
+	}
+	// OpenMetrics doesn't allow empty lines
+	if !e.openMetrics {
+		io.WriteString(e.w, "\n")
+	}
+}
+
+func (e *exposition) family(name string, help string, kind string, value func(*metrics) uint64) {
+	e.header(name, help, kind, e.sets)
+	for _, m := range e.sets {
+		e.sample(name, m.labels(), float64(value(m)))
+		if kind == "counter" {
+			e.created(name, m.labels(), startTime)
 		}
-		if line == "config|ready" {
-			return
+	}
+	e.end()
+}
+
+func (e *exposition) counter(name string, help string, value func(*metrics) uint64) {
+	e.family(name, help, "counter", value)
+}
+
+func (e *exposition) gauge(name string, help string, value func(*metrics) uint64) {
+	e.family(name, help, "gauge", value)
+}
+
+// timestamps exposes when something last happened, metric sets for which
+// it never did are left out rather than reported at the epoch.
+func (e *exposition) timestamps(name string, help string, value func(*metrics) time.Time) {
+	e.header(name, help, "gauge", e.sets)
+	for _, m := range e.sets {
+		if t := value(m); !t.IsZero() {
+			e.sample(name, m.labels(), float64(t.UnixNano())/1e9)
 		}
 	}
+	e.end()
 }
 
-func smtpMetricsHandlers(direction string, w http.ResponseWriter, r *http.Request) {
-	m := getMetrics(direction)
+type collector struct {
+	name     string
+	disabled bool
+	collect  func(*exposition)
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_active The number of active smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_active counter\n")
-	fmt.Fprintf(w, "smtpd_sessions_active{direction=\"%s\"} %d\n", direction, m.sessionsActive)
-	fmt.Fprintf(w, "\n")
+var collectors = []*collector{
+	{name: "filter", collect: filterCollector},
+	{name: "queue", collect: queueCollector},
+	{name: "sessions", collect: sessionsCollector},
+	{name: "tx", collect: txCollector},
+	{name: "anomalies", collect: anomaliesCollector},
+	{name: "domains", collect: domainsCollector},
+	{name: "classes", collect: classesCollector},
+	{name: "reputation", collect: reputationCollector},
+	{name: "asn", collect: asnCollector},
+	{name: "latency", collect: latencyCollector},
+	{name: "peers", collect: peersCollector},
+	{name: "outbound", collect: outboundCollector},
+	{name: "messages", collect: messagesCollector},
+	{name: "spam", collect: spamCollector},
+	{name: "tls", collect: tlsCollector},
+	{name: "probe", collect: probeCollector},
+	{name: "dns", collect: dnsCollector},
+	{name: "dane", collect: daneCollector},
+	{name: "spool", collect: spoolCollector},
+	{name: "process", collect: processCollector},
+	{name: "offenders", collect: offendersCollector},
+	{name: "history", collect: historyCollector},
+	{name: "selftest", collect: selftestCollector},
+	{name: "firewall", collect: firewallCollector},
+	{name: "limits", collect: limitsCollector},
+	{name: "responses", collect: responsesCollector},
+	{name: "rejections", collect: rejectionsCollector},
+	{name: "helo", collect: heloCollector},
+	{name: "instances", collect: instancesCollector},
+	{name: "sinks", collect: sinksCollector},
+	{name: "series", collect: seriesCollector},
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_total The number of active smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_total gauge\n")
-	fmt.Fprintf(w, "smtpd_sessions_total{direction=\"%s\"} %d\n", direction, m.sessionsTotal)
-	fmt.Fprintf(w, "\n")
+func getCollector(name string) *collector {
+	for _, c := range collectors {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func sessionsCollector(e *exposition) {
+	e.gauge("smtpd_sessions_active", "The number of active sessions.",
+		func(m *metrics) uint64 { return m.sessionsActive })
+	e.counter("smtpd_sessions_total", "The number of sessions.",
+		func(m *metrics) uint64 { return m.sessionsTotal })
+
+	e.gauge("smtpd_sessions_inet4_active", "The number of active inet4 sessions.",
+		func(m *metrics) uint64 { return m.sessionsInet4Active })
+	e.counter("smtpd_sessions_inet4_total", "The number of inet4 sessions.",
+		func(m *metrics) uint64 { return m.sessionsInet4Total })
+
+	e.gauge("smtpd_sessions_inet6_active", "The number of active inet6 sessions.",
+		func(m *metrics) uint64 { return m.sessionsInet6Active })
+	e.counter("smtpd_sessions_inet6_total", "The number of inet6 sessions.",
+		func(m *metrics) uint64 { return m.sessionsInet6Total })
+
+	e.gauge("smtpd_sessions_unix_active", "The number of active unix sessions.",
+		func(m *metrics) uint64 { return m.sessionsUnixActive })
+	e.counter("smtpd_sessions_unix_total", "The number of unix sessions.",
+		func(m *metrics) uint64 { return m.sessionsUnixTotal })
+
+	e.gauge("smtpd_sessions_tls_active", "The number of active TLS sessions.",
+		func(m *metrics) uint64 { return m.sessionsTLSActive })
+	e.counter("smtpd_sessions_tls_total", "The number of TLS sessions.",
+		func(m *metrics) uint64 { return m.sessionsTLSTotal })
+	e.counter("smtpd_tls_handshake_failures_total", "The number of sessions that ended after STARTTLS without completing the TLS handshake.",
+		func(m *metrics) uint64 { return m.tlsHandshakeFailures })
+
+	e.gauge("smtpd_sessions_auth_active", "The number of active authenticated sessions.",
+		func(m *metrics) uint64 { return m.sessionsAuthActive })
+	e.counter("smtpd_sessions_auth_total", "The number of authenticated sessions.",
+		func(m *metrics) uint64 { return m.sessionsAuthTotal })
+	e.counter("smtpd_sessions_auth_failures", "The number of failed authentications.",
+		func(m *metrics) uint64 { return m.sessionsAuthFailures })
+
+	now := time.Now()
+	e.header("smtpd_auth_failure_ratio_5m", "The ratio of failed authentications over the last 5 minutes.", "gauge", e.sets)
+	for _, m := range e.sets {
+		ratio := float64(0)
+		if attempts := m.authAttempts.sum(now); attempts != 0 {
+			ratio = float64(m.authFailures.sum(now)) / float64(attempts)
+		}
+		e.sample("smtpd_auth_failure_ratio_5m", m.labels(), ratio)
+	}
+	e.end()
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_inet4_active The number of active inet4 smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_inet4_active counter\n")
-	fmt.Fprintf(w, "smtpd_sessions_inet4_active{direction=\"%s\"} %d\n", direction, m.sessionsInet4Active)
-	fmt.Fprintf(w, "\n")
+	e.timestamps("smtpd_last_auth_success_timestamp_seconds", "The time of the last successful authentication.",
+		func(m *metrics) time.Time { return m.lastAuthAt })
+}
+
+func txCollector(e *exposition) {
+	e.gauge("smtpd_tx_active", "The number of active transactions.",
+		func(m *metrics) uint64 { return m.txActive })
+	e.counter("smtpd_tx_total", "The number of transactions.",
+		func(m *metrics) uint64 { return m.txTotal })
+
+	// the last committed message ID is attached as an exemplar
+	e.header("smtpd_tx_commit_total", "The number of committed transactions.", "counter", e.sets)
+	for _, m := range e.sets {
+		e.sampleWithExemplar("smtpd_tx_commit_total", m.labels(), float64(m.txCommitTotal),
+			m.lastCommit.labels, 1, m.lastCommit.timestamp)
+		e.created("smtpd_tx_commit_total", m.labels(), startTime)
+	}
+	e.end()
+
+	e.header("smtpd_tx_commit_hourofweek_total", "The number of committed transactions per day of week (0 being Sunday) and hour, in local time.", "counter", e.sets, "dow", "hour")
+	for _, m := range e.sets {
+		for dow := range m.txCommitHourOfWeek {
+			for hour, count := range m.txCommitHourOfWeek[dow] {
+				labels := m.labels() + "," + label("dow", strconv.Itoa(dow)) + "," + label("hour", strconv.Itoa(hour))
+				e.sample("smtpd_tx_commit_hourofweek_total", labels, float64(count))
+				e.created("smtpd_tx_commit_hourofweek_total", labels, startTime)
+			}
+		}
+	}
+	e.end()
+
+	e.counter("smtpd_tx_rollback_total", "The number of rollbacked transactions.",
+		func(m *metrics) uint64 { return m.txRollbackTotal })
+	e.counter("smtpd_null_sender_total", "The number of transactions with a null sender.",
+		func(m *metrics) uint64 { return m.txNullSender })
+
+	e.timestamps("smtpd_last_message_received_timestamp_seconds", "The time of the last committed transaction.",
+		func(m *metrics) time.Time { return m.lastCommit.timestamp })
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_inet4_total The number of active inet4 smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_inet4_total gauge\n")
-	fmt.Fprintf(w, "smtpd_sessions_inet4_total{direction=\"%s\"} %d\n", direction, m.sessionsInet4Total)
-	fmt.Fprintf(w, "\n")
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	serveMetrics(w, r, "")
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_inet6_active The number of active inet6 smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_inet6_active counter\n")
-	fmt.Fprintf(w, "smtpd_sessions_inet6_active{direction=\"%s\"} %d\n", direction, m.sessionsInet6Active)
-	fmt.Fprintf(w, "\n")
+// directionHandler serves the series of a single direction, so that
+// directions can be scraped as separate targets at different intervals.
+func directionHandler(direction string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, r, direction)
+	}
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_inet6_total The number of active inet6 smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_inet6_total gauge\n")
-	fmt.Fprintf(w, "smtpd_sessions_inet6_total{direction=\"%s\"} %d\n", direction, m.sessionsInet6Total)
-	fmt.Fprintf(w, "\n")
+func serveMetrics(w http.ResponseWriter, r *http.Request, direction string) {
+	// node_exporter style filtering, ?collect[]=sessions&collect[]=tx
+	filters := r.URL.Query()["collect[]"]
+	enabled := make(map[string]bool)
+	for _, name := range filters {
+		if getCollector(name) == nil {
+			http.Error(w, fmt.Sprintf("unknown collector: %s", name), http.StatusBadRequest)
+			return
+		}
+		enabled[name] = true
+	}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_unix_active The number of active unix smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_unix_active counter\n")
-	fmt.Fprintf(w, "smtpd_sessions_unix_active{direction=\"%s\"} %d\n", direction, m.sessionsUnixActive)
-	fmt.Fprintf(w, "\n")
+	// rendered to a buffer so a slow client doesn't hold the lock
+	buf := &bytes.Buffer{}
+	e := &exposition{w: buf, sets: metricSets, direction: direction}
+	if direction != "" {
+		e.sets = []*metrics{}
+		for _, m := range metricSets {
+			if m.direction == direction {
+				e.sets = append(e.sets, m)
+			}
+		}
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		e.openMetrics = true
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_unix_total The number of active unix smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_unix_total gauge\n")
-	fmt.Fprintf(w, "smtpd_sessions_unix_total{direction=\"%s\"} %d\n", direction, m.sessionsUnixTotal)
-	fmt.Fprintf(w, "\n")
+	render(e, enabled)
+	if e.openMetrics {
+		fmt.Fprintf(buf, "# EOF\n")
+	}
+	if *metricStyle == "prefix" {
+		buf = prefixStyle(buf, e.openMetrics)
+	}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_tls_active The number of active TLS smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_tls_active counter\n")
-	fmt.Fprintf(w, "smtpd_sessions_tls_active{direction=\"%s\"} %d\n", direction, m.sessionsTLSActive)
-	fmt.Fprintf(w, "\n")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		buf.WriteTo(gz)
+		gz.Close()
+		return
+	}
+	buf.WriteTo(w)
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_tls_total The number of active unix smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_tls_total gauge\n")
-	fmt.Fprintf(w, "smtpd_sessions_tls_total{direction=\"%s\"} %d\n", direction, m.sessionsTLSTotal)
-	fmt.Fprintf(w, "\n")
+// acceptsGzip tells whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		if name := strings.TrimSpace(params[0]); name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if value, err := strconv.ParseFloat(q[2:], 64); err == nil && value == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_auth_active The number of active unix smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_auth_active counter\n")
-	fmt.Fprintf(w, "smtpd_sessions_auth_active{direction=\"%s\"} %d\n", direction, m.sessionsAuthActive)
-	fmt.Fprintf(w, "\n")
+// render runs the collectors that aren't disabled, restricted to those in
+// enabled unless it is empty.
+func render(e *exposition, enabled map[string]bool) {
+	adminLock.Lock()
+	selected := []*collector{}
+	for _, c := range collectors {
+		if c.disabled || len(enabled) != 0 && !enabled[c.name] {
+			continue
+		}
+		selected = append(selected, c)
+	}
+	adminLock.Unlock()
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_auth_total The number of active unix smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_auth_total gauge\n")
-	fmt.Fprintf(w, "smtpd_sessions_auth_total{direction=\"%s\"} %d\n", direction, m.sessionsAuthTotal)
-	fmt.Fprintf(w, "\n")
+	metricsLock.RLock()
+	for _, c := range selected {
+		c.collect(e)
+	}
+	metricsLock.RUnlock()
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_sessions_auth_failures The number of active unix smtp-in sessions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_sessions_auth_failures gauge\n")
-	fmt.Fprintf(w, "smtpd_sessions_auth_failures{direction=\"%s\"} %d\n", direction, m.sessionsAuthFailures)
-	fmt.Fprintf(w, "\n")
+// namedValues is a repeatable name=value flag.
+type namedValues map[string]string
 
-	fmt.Fprintf(w, "# HELP smtpd_tx_active The number of active smtp-in transactions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_tx_active counter\n")
-	fmt.Fprintf(w, "smtpd_tx_active{direction=\"%s\"} %d\n", direction, m.txActive)
-	fmt.Fprintf(w, "\n")
+func (n namedValues) String() string {
+	return ""
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_tx_total The number of total smtp-in transactions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_tx_total gauge\n")
-	fmt.Fprintf(w, "smtpd_tx_total{direction=\"%s\"} %d\n", direction, m.txTotal)
-	fmt.Fprintf(w, "\n")
+func (n namedValues) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i <= 0 {
+		return fmt.Errorf("expected name=value: %s", value)
+	}
+	n[value[:i]] = value[i+1:]
+	return nil
+}
 
-	fmt.Fprintf(w, "# HELP smtpd_tx_commit_total The number of total committed smtp-in transactions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_tx_commit_total gauge\n")
-	fmt.Fprintf(w, "smtpd_tx_commit_total{direction=\"%s\"} %d\n", direction, m.txCommitTotal)
-	fmt.Fprintf(w, "\n")
+// stringValues is a repeatable flag.
+type stringValues []string
 
-	fmt.Fprintf(w, "# HELP smtpd_tx_rollback_total The number of total rollbacked smtp-in transactions.\n")
-	fmt.Fprintf(w, "# TYPE smtpd_tx_tollback_total gauge\n")
-	fmt.Fprintf(w, "smtpd_tx_rollback_total{direction=\"%s\"} %d\n", direction, m.txRollbackTotal)
-	fmt.Fprintf(w, "\n")
+func (s *stringValues) String() string {
+	return strings.Join(*s, ",")
 }
 
-func metricsHandler(w http.ResponseWriter, r *http.Request) {
-	smtpMetricsHandlers("smtp-in", w, r)
-	smtpMetricsHandlers("smtp-out", w, r)
+func (s *stringValues) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 func main() {
 	exporter = flag.String("exporter", "localhost:13742", "exporter host and port")
+	rawAddressFamily = flag.Bool("raw-address-family", false, "count IPv4-mapped IPv6 addresses as inet6")
+	labelPolicy = flag.String("label-policy", "truncate", "policy for unsafe or oversized label values: drop, hash or truncate")
+	labelMaxLength = flag.Int("label-max-length", 128, "maximum length of label values")
+	maxSeries = flag.Int("max-series", 10000, "maximum number of dynamic label combinations")
+	maxPeers = flag.Int("max-peers", 10000, "maximum number of peer addresses tracked for concurrency")
+	topPeers = flag.Int("top-peers", 10, "number of peer addresses exposed in the top concurrency gauges")
+	maxHeloNames = flag.Int("max-helo-names", 1000, "maximum number of HELO/EHLO names tracked, 0 to disable")
+	topHelo = flag.Int("top-helo", 10, "number of HELO/EHLO names exposed")
+	domainMetrics = flag.Bool("domain-metrics", false, "expose usage per sender and recipient domain")
+	siemTarget = flag.String("siem", "", "target to send security events to, udp://host[:port] or tcp://host[:port]")
+	siemFormat = flag.String("siem-format", "cef", "format of security events, cef or leef")
+	runUser = flag.String("user", "", "user to run as once the exporter and the daemon socket are bound")
+	runGroup = flag.String("group", "", "group to run as, the primary group of -user by default")
+	chrootDir = flag.String("chroot", "", "directory to chroot to once initialized")
+	daemonSocket = flag.String("daemon", "", "run as a daemon receiving events from shims on this Unix socket")
+	accessLog = flag.Bool("access-log", false, "log HTTP requests with their client, status code, size and duration")
+	httpRate = flag.Float64("http-rate", 0, "requests per second allowed per client address, unlimited if 0")
+	httpBurst = flag.Int("http-burst", 10, "requests a client address may send in a burst when rate-limited")
+	httpConcurrency = flag.Int("http-concurrency", 4, "maximum number of concurrent HTTP requests, unlimited if 0")
+	httpTimeout = flag.Duration("http-timeout", 30*time.Second, "timeout of reading an HTTP request and writing its response")
+	exporterRetry = flag.Duration("exporter-retry", 0, "time during which binding a taken exporter address is retried with backoff instead of failing")
+	exporterFallback = flag.Bool("exporter-fallback", false, "listen on an ephemeral port when the exporter address is taken")
+	metricStyle = flag.String("metric-style", "label", "how directions are told apart: label (direction label) or prefix (smtpd_in_ and smtpd_out_ metric names)")
+	handoffFile = flag.String("handoff-file", "", "file where counters are handed over to the next process on exit, to upgrade without resetting them")
+	exporterFile = flag.String("exporter-file", "", "file to which the pid and the address the exporter listens on are written")
+	shareSocket = flag.String("share", "", "Unix socket on which the filter owning the exporter address receives the events of other instances of the filter, which forward them instead of failing to listen")
+	forwardSocket = flag.String("forward", "", "run as a shim forwarding events to the daemon listening on this Unix socket")
+	instanceName = flag.String("instance", hostname(), "name of the smtpd instance a shim forwards events for")
+	heartbeatInterval = flag.Duration("heartbeat", 10*time.Second, "interval at which a shim sends heartbeats to the daemon")
+	heartbeatTimeout = flag.Duration("heartbeat-timeout", 30*time.Second, "time after which the daemon expires the sessions of a silent shim")
+	syslogTarget = flag.String("syslog", "", "syslog target to send notable events to, udp://host[:port], tcp://host[:port] or unix:///dev/log")
+	syslogFacility = flag.String("syslog-facility", "mail", "syslog facility of notable events")
+	deliveryFailureSpike = flag.Int("delivery-failure-spike", 50, "number of delivery failures in 5 minutes raising a notable event, 0 to disable")
+	publishNATS = flag.String("publish-nats", "", "NATS server URL to publish transaction records to, nats://[user:password@]host[:port]")
+	publishKafka = flag.String("publish-kafka", "", "comma-separated Kafka brokers to publish transaction records to, requires building with -tags kafka")
+	publishTopic = flag.String("publish-topic", "smtpd", "NATS subject or Kafka topic records are published to")
+	publishEvents = flag.Bool("publish-events", false, "also publish every report event")
+	archivePath = flag.String("archive", "", "SQLite database to archive transaction records to, requires building with -tags sqlite")
+	archiveRetention = flag.Duration("archive-retention", 90*24*time.Hour, "how long archived transaction records are kept, 0 to keep them forever")
+	reportDir = flag.String("report-dir", "", "directory to write daily usage reports per tenant to")
+	reportS3 = flag.String("report-s3", "", "S3-compatible URL of the bucket, and optional prefix, to upload daily usage reports per tenant to")
+	reportS3Region = flag.String("report-s3-region", "us-east-1", "region used to sign S3 uploads")
+	reportFormat = flag.String("report-format", "csv", "usage reports format, csv or json")
+	reportInterval = flag.Duration("report-interval", time.Hour, "interval at which usage reports are written")
+	tenantsFile = flag.String("tenants", "", "file mapping domains to tenants, one \"domain tenant\" pair per line")
+	warmStart = flag.Duration("warm-start", 5*time.Minute, "how long after startup active gauges are flagged as unreliable")
+	warmStartStats = flag.Bool("warm-start-stats", false, "seed active sessions from smtpctl show stats on startup")
+	sessionShards = flag.Int("session-shards", 16, "number of shards the session store is split into")
+	subsystemsList = flag.String("subsystems", "", "comma-separated subsystems to register for regardless of the handshake: smtp-in, smtp-out or both, as advertised by smtpd if empty")
+	queueSize = flag.Int("queue-size", 4096, "maximum number of events waiting to be processed before dropping")
+	pipeTimeout = flag.Duration("pipe-timeout", 10*time.Minute, "time without any event after which the smtpd pipe is reported unhealthy, never if 0")
+	proxiesList = flag.String("proxies", "", "comma-separated addresses or networks of proxies smtpd runs behind")
+	proxyPortsList = flag.String("proxy-ports", "1080,3128,8080,8118,9050", "comma-separated source ports of known proxies")
+	maxOffenders = flag.Int("max-offenders", 10000, "maximum number of offender addresses tracked")
+	offenderAuthFailures = flag.Int("offender-auth-failures", 10, "number of auth failures to list an address as offender")
+	offenderTTL = flag.Duration("offender-ttl", 24*time.Hour, "time after which an inactive offender is forgotten")
+	offendersFile = flag.String("offenders-file", "", "file to append offenders to in fail2ban-friendly format")
+	firewall = flag.String("firewall", "", "firewall to feed offenders to: pf or nft")
+	firewallTable = flag.String("firewall-table", "", "pf table name or nft \"family table set\" to feed offenders to")
+	firewallAnchor = flag.String("firewall-anchor", "", "pf anchor containing the table")
+	firewallReasons = flag.String("firewall-reasons", "auth-failures,early-talker", "comma-separated offender reasons fed to the firewall")
+	firewallTTL = flag.Duration("firewall-ttl", time.Hour, "time an offender stays in the firewall")
+	maxDeferred = flag.Int("max-deferred", 100000, "maximum number of deferred envelopes tracked")
+	smtpctl = flag.String("smtpctl", "/usr/sbin/smtpctl", "path to smtpctl")
+	queuePoll = flag.Duration("queue-poll", 0, "interval at which the queue is polled with smtpctl, 0 to disable")
+	deferredExpiry = flag.Duration("deferred-expiry", 4*24*time.Hour, "time after which a deferred envelope is forgotten, smtpd's queue expiry, 0 to disable")
+	deferralPatterns = flag.String("deferral-patterns", "", "file of category and pattern lines classifying remote errors, tried before the built-in ones")
+	passthrough = flag.Bool("passthrough", false, "register for smtp-in data lines to expose message metrics")
+	hopsWarning = flag.Int("hops-warning", 30, "number of Received headers above which a message is counted as a potential loop")
+	spamScoreHeaders = flag.String("spam-score-headers", "", "comma-separated headers in which a scanner earlier in the filter chain reports spam scores, e.g. X-Spam-Status")
+	trickleRate = flag.Int("trickle-rate", 100, "bytes per second under which a message taking over 10s is counted as trickling, 0 to disable")
+	flag.Var(tlsCerts, "tls-cert", "listener=path of a certificate to watch for expiry, can be repeated")
+	flag.Var(tlsProbes, "tls-probe", "listener=host:port of a listener to probe for certificate expiry, can be repeated")
+	historyRetention = flag.Duration("history-retention", 0, "retention of the per-IP and per-domain statistics served at /api/v1/ips/ and /api/v1/export, disabled if 0")
+	historyBucket = flag.Duration("history-bucket", 5*time.Minute, "duration of the time buckets of per-IP and per-domain statistics")
+	historyMaxKeys = flag.Int("history-max-keys", 100000, "maximum number of addresses and domains kept per time bucket")
+	selftestInterval = flag.Duration("selftest-interval", 0, "interval at which a self-test message is sent through smtpd, disabled if 0")
+	selftestDeadline = flag.Duration("selftest-deadline", time.Minute, "time within which a self-test message must go through the filter")
+	selftestSendmail = flag.String("selftest-sendmail", "/usr/sbin/sendmail", "path to the sendmail command used to send self-test messages")
+	selftestRcpt = flag.String("selftest-rcpt", "", "recipient of self-test messages")
+	quantileWindowWidth = flag.Duration("quantile-window", 5*time.Minute, "sliding window over which latency quantile gauges are computed, disabled if 0")
+	privacy = flag.String("privacy", "off", "how IP addresses and local parts are exposed: off, truncate or hash")
+	privacyKeyFile = flag.String("privacy-key-file", "", "file containing the key of hashed pseudonyms, random on every start if empty")
+	idnForm = flag.String("idn-form", "a-label", "form of internationalized domains in labels: a-label (punycode) or u-label (Unicode)")
+	flag.Var(bucketMaps, "bucket-map", "name=path of a file of rules mapping label values to buckets, for domains or relays, can be repeated")
+	flag.Var(&reputationFiles, "reputation", "file of network and score lines rating smtp-in peers, can be repeated")
+	reputationThresholds = flag.String("reputation-thresholds", "30,70", "reputation scores under which peers are in the low and medium tiers")
+	reputationReload = flag.Duration("reputation-reload", time.Minute, "interval at which reputation files are reloaded when modified, 0 to disable")
+	asnDatabase = flag.String("asn-database", "", "path of a GeoLite2-ASN database labelling smtp-in sessions by autonomous system")
+	maxASNs = flag.Int("max-asns", 10000, "maximum number of autonomous systems tracked")
+	topASN = flag.Int("top-asn", 20, "number of autonomous systems exposed, the others being summed up as other")
+	classesFile = flag.String("classes", "", "file of class and address pattern rules for smtpd_messages_by_class_total")
+	flag.Var(roles, "role", "role=listener[,listener...] classifying smtp-in sessions by local address, e.g. submission=:587,:465, can be repeated")
+	flag.Var(&tlsHostnames, "tls-hostname", "local hostname accounted in the SNI metrics, can be repeated")
+	tlsCertInterval = flag.Duration("tls-cert-interval", time.Hour, "interval at which certificates are checked")
+	flag.Var(probes, "probe", "listener=host:port of a listener to probe periodically, can be repeated")
+	probeInterval = flag.Duration("probe-interval", time.Minute, "interval at which listeners are probed")
+	probeTimeout = flag.Duration("probe-timeout", 10*time.Second, "timeout of a listener probe")
+	flag.Var(&dnsDomains, "dns-domain", "destination domain to resolve periodically, can be repeated")
+	dnsInterval = flag.Duration("dns-interval", time.Minute, "interval at which destination domains are resolved")
+	dnsTimeout = flag.Duration("dns-timeout", 10*time.Second, "timeout of a destination domain resolution")
+	dane = flag.Bool("dane", false, "look up TLSA records of outbound destinations and compare them to their certificates")
+	daneInterval = flag.Duration("dane-interval", time.Hour, "interval at which outbound destinations are checked for DANE")
+	daneMaxHosts = flag.Int("dane-max-hosts", 1000, "maximum number of outbound destinations checked for DANE")
+	spoolPath = flag.String("spool", "", "path of the smtpd spool to watch, e.g. /var/spool/smtpd")
+	spoolInterval = flag.Duration("spool-interval", time.Minute, "interval at which the spool is scanned")
+	processMetrics = flag.Bool("process-metrics", false, "expose resource usage of the smtpd processes")
+	stateFile = flag.String("state-file", "", "file where state surviving restarts is persisted")
+	adminTokenFile = flag.String("admin-token-file", "", "file containing the bearer token for the admin API, disabled if empty")
+	disabledCollectors = flag.String("disable-collectors", "", "comma-separated collectors disabled at startup")
+	lokiURL = flag.String("loki", "", "URL of a Loki server to which transactions and security events are pushed, disabled if empty")
+	flag.Var(lokiLabels, "loki-label", "name=value of a static label added to Loki streams, can be repeated")
+	otlpURL = flag.String("otlp", "", "URL of an OTLP/HTTP collector to which transactions are exported as spans, disabled if empty")
+	otlpSampleRatio = flag.Float64("otlp-sample-ratio", 1, "ratio of transactions exported as spans")
+	otlpSampleFailed = flag.Bool("otlp-sample-failed", true, "always export rolled back transactions, regardless of the ratio")
+	flag.Var(plugins, "plugin", "name=command of a metrics plugin fed events as JSON lines, can be repeated")
+	scriptFile = flag.String("script", "", "Starlark script deriving metrics from events, disabled if empty")
+	pushURL = flag.String("push-url", "", "URL to which metric deltas are pushed as JSON, disabled if empty")
+	pushInterval = flag.Duration("push-interval", time.Minute, "interval at which metric deltas are pushed")
+	pushCollectors = flag.String("push-collectors", "", "comma-separated collectors pushed, all enabled ones if empty")
+	messageIDWindow = flag.Int("message-id-window", 100000, "minimum number of recent Message-IDs remembered for duplicate detection")
 	flag.Parse()
 
+	// the shim registers for the subsystems itself
+	subsystemsInit()
+	if *forwardSocket != "" {
+		forward(*forwardSocket)
+	}
+	listener, shareListener := exporterListen()
+
+	checkLabelPolicy()
+	thresholdsInit()
+	privacyInit()
+	rolesInit()
+	peersInit()
+	stateInit()
+	sessionsInit()
+	warmStartInit()
+	addressInit()
+	bucketsInit()
+	tenantsInit()
+	classesInit()
+	reputationInit()
+	asnInit()
+	spamScoresInit()
+	reportInit()
+	archiveInit()
+	publishInit()
+	syslogInit()
+	siemInit()
+	lokiInit()
+	otlpInit()
+	if *messageIDWindow < 1 {
+		log.Fatalf("invalid message-id window: %d", *messageIDWindow)
+	}
+	messageIDs = newBloom(*messageIDWindow)
+	offendersInit()
+	historyInit()
+	quantileWindowInit()
+	selftestInit()
+	firewallInit()
+	outboundInit()
+	deferralsInit()
+	pluginsInit()
+	scriptInit()
+	adminInit()
+	httpInit()
+	metricStyleInit()
+	handoffInit()
+	tlsInit()
+	probeInit()
+	dnsInit()
+	daneInit()
+	spoolInit()
+	pushInit()
+	queueInit()
+
+	// the exporter and the daemon only serve once the filter is hardened
+	var daemonListener net.Listener
+	if *daemonSocket != "" {
+		daemonListener = daemonListen(*daemonSocket)
+	}
+	dropPrivileges()
+	harden()
+
+	go exporterServe(listener)
+
+	if shareListener != nil {
+		go daemonServe(shareListener)
+	}
+	if daemonListener != nil {
+		daemonServe(daemonListener)
+	}
+
 	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 
 	skipConfig(scanner)
 
 	filterInit()
 
-	go func() {
-		http.HandleFunc("/metrics", metricsHandler)
-		log.Fatal(http.ListenAndServe(*exporter, nil))
-	}()
-
 	for {
 		if !scanner.Scan() {
-			os.Exit(0)
+			shutdown()
 		}
+		if _, err := handleLine(scanner.Text(), true); err != nil {
+			invalidEvent(err)
+		}
+	}
+}
 
-		line := scanner.Text()
-		atoms := strings.Split(line, "|")
-		if len(atoms) < 6 {
-			log.Fatalf("missing atoms: %s", line)
+var shutdownOnce sync.Once
+
+// shutdown processes whatever is pending before exiting. It is called on
+// EOF and on SIGTERM alike, a second caller waits for the first to exit.
+func shutdown() {
+	shutdownOnce.Do(func() {
+		queueDrain()
+		sinksDrain()
+		pushFlush()
+		if reportEnabled() {
+			writeReports()
+		}
+		if *handoffFile != "" {
+			if err := handoffSave(); err != nil {
+				log.Printf("handoff: %v", err)
+			}
+			handoffRelease()
 		}
+		os.Exit(0)
+	})
+}
 
-		switch atoms[0] {
-		case "report":
-			trigger(reporters, atoms)
-		default:
-			log.Fatalf("invalid stream: %s", atoms[0])
+// handleLine dispatches a line received from smtpd, local is false when
+// it was forwarded by a shim which already answered smtpd.
+func handleLine(line string, local bool) ([]string, error) {
+	eventSeen()
+	if strings.HasPrefix(line, "config|") {
+		// smtpd restarted, the handshake is processed in order with
+		// the events of the previous instance and never dropped
+		if configLine(line) {
+			enqueueWait([]string{"config", "ready"})
+			if local {
+				filterInit()
+			}
+		}
+		return nil, nil
+	}
+
+	atoms := splitEvent(line)
+	if len(atoms) < 6 {
+		return nil, fmt.Errorf("missing atoms: %s", line)
+	}
+	if atoms[3] != "smtp-in" && atoms[3] != "smtp-out" {
+		return nil, fmt.Errorf("invalid subsystem: %s", atoms[3])
+	}
+
+	switch atoms[0] {
+	case "report":
+		if lifecycleEvent(atoms) {
+			enqueueWait(atoms)
+		} else {
+			enqueue(atoms)
+		}
+	case "filter":
+		if len(atoms) < 8 {
+			return nil, fmt.Errorf("missing atoms: %s", line)
+		}
+		if local {
+			filterDataLine(atoms)
 		}
+		enqueue(atoms)
+	default:
+		return nil, fmt.Errorf("invalid stream: %s", atoms[0])
 	}
+	return atoms, nil
 }
@@ -0,0 +1,185 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+var benchmarkSession = []string{
+	"report|0.5|1576146008.006099|smtp-in|link-connect|7641df9771b4ed00|mail.example.org|pass|192.0.2.1:33080|192.0.2.2:25",
+	"report|0.5|1576146008.006200|smtp-in|link-greeting|7641df9771b4ed00|mx.example.com",
+	"report|0.5|1576146008.006300|smtp-in|protocol-client|7641df9771b4ed00|EHLO mail.example.org",
+	"report|0.5|1576146008.006400|smtp-in|link-identify|7641df9771b4ed00|EHLO|mail.example.org",
+	"report|0.5|1576146008.006500|smtp-in|protocol-server|7641df9771b4ed00|250 ok",
+	"report|0.5|1576146008.006600|smtp-in|tx-begin|7641df9771b4ed00|1ef1c203",
+	"report|0.5|1576146008.006700|smtp-in|tx-mail|7641df9771b4ed00|1ef1c203|ok|alice@example.org",
+	"report|0.5|1576146008.006800|smtp-in|tx-rcpt|7641df9771b4ed00|1ef1c203|ok|bob@example.com",
+	"report|0.5|1576146008.006900|smtp-in|tx-envelope|7641df9771b4ed00|1ef1c203|1ef1c203bd8a61ce",
+	"report|0.5|1576146008.007000|smtp-in|tx-data|7641df9771b4ed00|1ef1c203|ok",
+	"report|0.5|1576146008.007100|smtp-in|tx-commit|7641df9771b4ed00|1ef1c203|4242",
+	"report|0.5|1576146008.007200|smtp-in|tx-reset|7641df9771b4ed00|1ef1c203",
+	"report|0.5|1576146008.007300|smtp-in|link-disconnect|7641df9771b4ed00",
+}
+
+func BenchmarkSplitEvent(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		splitEvent(benchmarkSession[0])
+	}
+}
+
+func BenchmarkParseTimestamp(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseTimestamp("1576146008.006099")
+	}
+}
+
+// testInit sets the flags the event handlers depend on, main normally
+// defines them.
+func testInit() {
+	rawAddressFamily = new(bool)
+	domainMetrics = new(bool)
+	idnForm = new(string)
+	*idnForm = "a-label"
+	maxPeers = new(int)
+	*maxPeers = 10000
+	maxSeries = new(int)
+	*maxSeries = 10000
+	privacy = new(string)
+	*privacy = "off"
+	historyRetention = new(time.Duration)
+	quantileWindowWidth = new(time.Duration)
+	*quantileWindowWidth = 5 * time.Minute
+	maxHeloNames = new(int)
+	*maxHeloNames = 1000
+	labelMaxLength = new(int)
+	*labelMaxLength = 128
+	pipeTimeout = new(time.Duration)
+	*pipeTimeout = 10 * time.Minute
+	dane = new(bool)
+	deliveryFailureSpike = new(int)
+	*deliveryFailureSpike = 50
+	maxDeferred = new(int)
+	*maxDeferred = 100000
+	hopsWarning = new(int)
+	*hopsWarning = 30
+	maxOffenders = new(int)
+	*maxOffenders = 10000
+	offenderAuthFailures = new(int)
+	*offenderAuthFailures = 10
+	firewall = new(string)
+	labelPolicy = new(string)
+	*labelPolicy = "truncate"
+}
+
+// BenchmarkSession measures the processing of a complete session, each
+// iteration accounting for as many events as benchmarkSession holds.
+func BenchmarkSession(b *testing.B) {
+	testInit()
+	events := [][]string{}
+	for _, line := range benchmarkSession {
+		events = append(events, splitEvent(line))
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, atoms := range events {
+			trigger(reporters, atoms)
+		}
+	}
+}
+
+// BenchmarkExposition measures a scrape of the collectors fed by events,
+// the others depend on external state.
+func BenchmarkExposition(b *testing.B) {
+	testInit()
+	selected := []*collector{}
+	for _, name := range []string{"queue", "sessions", "tx", "latency", "peers", "messages", "series"} {
+		selected = append(selected, getCollector(name))
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e := &exposition{w: ioutil.Discard, sets: metricSets}
+		for _, c := range selected {
+			c.collect(e)
+		}
+	}
+}
+
+// fuzzSeeds are sessions as reported by the protocol versions smtpd
+// shipped, each seed being a sequence of lines.
+func fuzzSeeds() []string {
+	outbound := []string{
+		"report|0.5|1576146008.006099|smtp-out|link-connect|7641df9771b4ed01|mx.example.com|pass|192.0.2.2:41000|198.51.100.1:25",
+		"report|0.5|1576146008.006200|smtp-out|link-greeting|7641df9771b4ed01|mx.example.com",
+		"report|0.5|1576146008.006300|smtp-out|link-tls|7641df9771b4ed01|version=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256, verified=yes",
+		"report|0.5|1576146008.006400|smtp-out|tx-begin|7641df9771b4ed01|1ef1c204",
+		"report|0.5|1576146008.006500|smtp-out|tx-envelope|7641df9771b4ed01|1ef1c204|1ef1c204bd8a61ce",
+		"report|0.5|1576146008.006600|smtp-out|protocol-server|7641df9771b4ed01|451 4.7.1 try again later",
+		"report|0.5|1576146008.006700|smtp-out|tx-rollback|7641df9771b4ed01|1ef1c204",
+		"report|0.5|1576146008.006800|smtp-out|timeout|7641df9771b4ed01",
+		"report|0.5|1576146008.006900|smtp-out|link-disconnect|7641df9771b4ed01",
+	}
+	data := []string{
+		"report|0.5|1576146009.000000|smtp-in|link-connect|7641df9771b4ed02|localhost|pass|[::1]:33080|[::1]:25",
+		"report|0.5|1576146009.000100|smtp-in|link-auth|7641df9771b4ed02|bob|pass",
+		"report|0.5|1576146009.000200|smtp-in|tx-begin|7641df9771b4ed02|1ef1c205",
+		"report|0.5|1576146009.000300|smtp-in|tx-mail|7641df9771b4ed02|1ef1c205|ok|<\"a|b\"@example.org>",
+		"filter|0.5|1576146009.000400|smtp-in|data-line|7641df9771b4ed02|c0ffee|Content-Type: text/plain; charset=utf-8",
+		"filter|0.5|1576146009.000500|smtp-in|data-line|7641df9771b4ed02|c0ffee|",
+		"filter|0.5|1576146009.000600|smtp-in|data-line|7641df9771b4ed02|c0ffee|hello",
+		"filter|0.5|1576146009.000700|smtp-in|data-line|7641df9771b4ed02|c0ffee|.",
+		"report|0.5|1576146009.000800|smtp-in|filter-response|7641df9771b4ed02|commit|proceed",
+		"report|0.5|1576146009.000900|smtp-in|tx-commit|7641df9771b4ed02|1ef1c205",
+		"report|0.5|1576146009.001000|smtp-in|link-reset|7641df9771b4ed02",
+		"report|0.5|1576146009.001100|smtp-in|link-disconnect|7641df9771b4ed02",
+	}
+	handshake := "config|smtpd-version|6.8.0p2\nconfig|protocol|0.7\nconfig|subsystem|smtp-in\nconfig|ready"
+
+	seeds := []string{handshake}
+	for _, version := range []string{"0.1", "0.4", "0.5", "0.6", "0.7"} {
+		for _, session := range [][]string{benchmarkSession, outbound, data} {
+			seeds = append(seeds, strings.Replace(strings.Join(session, "\n"), "|0.5|", "|"+version+"|", -1))
+		}
+	}
+	return seeds
+}
+
+// FuzzHandleLine feeds lines to the parser and event handlers, whatever
+// smtpd sends must never crash the filter.
+func FuzzHandleLine(f *testing.F) {
+	testInit()
+	queue = make(chan []string, 64)
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, lines string) {
+		for _, line := range strings.Split(lines, "\n") {
+			handleLine(line, false)
+			for len(queue) > 0 {
+				process(<-queue)
+			}
+		}
+	})
+}
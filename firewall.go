@@ -0,0 +1,175 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var firewall *string
+var firewallTable *string
+var firewallAnchor *string
+var firewallReasons *string
+var firewallTTL *time.Duration
+
+// the firewall is fed from a single goroutine so that a slow pfctl or nft
+// invocation never blocks event processing.
+var firewallQueue = make(chan string, 1024)
+
+var firewallState = struct {
+	sync.Mutex
+	expiry  map[string]time.Time
+	added   uint64
+	removed uint64
+	errors  uint64
+}{expiry: make(map[string]time.Time)}
+
+func firewallInit() {
+	switch *firewall {
+	case "":
+		return
+	case "pf", "nft":
+	default:
+		log.Fatalf("invalid firewall: %s", *firewall)
+	}
+	if *firewallTable == "" {
+		log.Fatal("-firewall requires -firewall-table")
+	}
+
+	go firewallWorker()
+}
+
+func firewallWants(reason string) bool {
+	if *firewall == "" {
+		return false
+	}
+	for _, r := range strings.Split(*firewallReasons, ",") {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func firewallAdd(ip string, reason string) {
+	if !firewallWants(reason) {
+		return
+	}
+	select {
+	case firewallQueue <- ip:
+	default:
+		log.Printf("firewall queue full, dropping %s", ip)
+	}
+}
+
+func firewallCommand(action string, ip string) *exec.Cmd {
+	if *firewall == "nft" {
+		// -firewall-table is "family table set", e.g. "inet filter smtpd"
+		element := fmt.Sprintf("{ %s }", ip)
+		if action == "add" {
+			element = fmt.Sprintf("{ %s timeout %ds }", ip, int64(firewallTTL.Seconds()))
+		}
+		args := append([]string{action, "element"}, strings.Fields(*firewallTable)...)
+		return exec.Command("nft", append(args, element)...)
+	}
+
+	args := []string{}
+	if *firewallAnchor != "" {
+		args = append(args, "-a", *firewallAnchor)
+	}
+	args = append(args, "-t", *firewallTable, "-T", action, ip)
+	return exec.Command("pfctl", args...)
+}
+
+func firewallRun(action string, ip string) {
+	out, err := firewallCommand(action, ip).CombinedOutput()
+
+	firewallState.Lock()
+	defer firewallState.Unlock()
+	if err != nil {
+		firewallState.errors++
+		log.Printf("firewall: %s %s: %v: %s", action, ip, err, strings.TrimSpace(string(out)))
+		return
+	}
+	if action == "add" {
+		firewallState.added++
+	} else {
+		firewallState.removed++
+	}
+}
+
+func firewallWorker() {
+	ticker := time.NewTicker(time.Minute)
+	for {
+		select {
+		case ip := <-firewallQueue:
+			firewallState.Lock()
+			_, exists := firewallState.expiry[ip]
+			firewallState.expiry[ip] = time.Now().Add(*firewallTTL)
+			firewallState.Unlock()
+			if !exists {
+				firewallRun("add", ip)
+			}
+
+		case now := <-ticker.C:
+			expired := []string{}
+			firewallState.Lock()
+			for ip, deadline := range firewallState.expiry {
+				if now.After(deadline) {
+					expired = append(expired, ip)
+					delete(firewallState.expiry, ip)
+				}
+			}
+			firewallState.Unlock()
+
+			// nft expires elements on its own
+			if *firewall == "pf" {
+				for _, ip := range expired {
+					firewallRun("delete", ip)
+				}
+			}
+		}
+	}
+}
+
+func firewallCollector(e *exposition) {
+	firewallState.Lock()
+	entries := len(firewallState.expiry)
+	added, removed, errors := firewallState.added, firewallState.removed, firewallState.errors
+	firewallState.Unlock()
+
+	e.header("smtpd_firewall_entries", "The number of addresses currently fed to the firewall.", "gauge", nil)
+	e.sample("smtpd_firewall_entries", "", float64(entries))
+	e.end()
+
+	e.header("smtpd_firewall_added_total", "The number of addresses added to the firewall.", "counter", nil)
+	e.sample("smtpd_firewall_added_total", "", float64(added))
+	e.end()
+
+	e.header("smtpd_firewall_removed_total", "The number of addresses removed from the firewall.", "counter", nil)
+	e.sample("smtpd_firewall_removed_total", "", float64(removed))
+	e.end()
+
+	e.header("smtpd_firewall_errors_total", "The number of failed firewall commands.", "counter", nil)
+	e.sample("smtpd_firewall_errors_total", "", float64(errors))
+	e.end()
+}
@@ -0,0 +1,298 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var handoffFile *string
+
+// handoffOffsets are the counter and histogram series of the previous
+// process, added to the ones of this process so that upgrading the binary
+// doesn't reset them. Protected by metricsLock.
+var handoffOffsets map[string]float64
+var handoffStart time.Time
+
+// counters kept across restarts by other means.
+var handoffExcluded = map[string]bool{
+	"smtpd_filter_restarts_total": true,
+}
+
+// offset adds the value of a counter or histogram sample carried over
+// from the previous process.
+func (e *exposition) offset(name string, labels string, value float64) float64 {
+	if handoffOffsets == nil || e.kind != "counter" && e.kind != "histogram" {
+		return value
+	}
+	if strings.HasSuffix(name, "_created") {
+		return value
+	}
+	key := name
+	if labels != "" {
+		key += "{" + labels + "}"
+	}
+	return value + handoffOffsets[key]
+}
+
+// handoffSave writes the counter and histogram series as the process
+// exits, it goes through the exposition like pushes do. A process that
+// never bound the exporter address didn't load the file of the previous
+// one and leaves it alone.
+func handoffSave() error {
+	exporterState.Lock()
+	bound := exporterState.address != "" && !exporterState.fallback
+	exporterState.Unlock()
+	if !bound {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	render(&exposition{w: buf, sets: metricSets}, nil)
+
+	out := &bytes.Buffer{}
+	started := startTime
+	if !handoffStart.IsZero() {
+		started = handoffStart
+	}
+	fmt.Fprintf(out, "# started %d\n", started.Unix())
+
+	kind := ""
+	scanner := bufio.NewScanner(buf)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			if fields := strings.Fields(line); len(fields) == 4 {
+				kind = fields[3]
+			}
+			continue
+		}
+		if line == "" || line[0] == '#' || kind != "counter" && kind != "histogram" {
+			continue
+		}
+		name, _, value, err := parseSample(line)
+		if err != nil || value == 0 || handoffExcluded[name] || strings.HasSuffix(name, "_created") {
+			continue
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	// write and rename so the next process never loads a truncated file
+	tmp, err := ioutil.TempFile(filepath.Dir(*handoffFile), ".filter-prometheus")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), *handoffFile)
+}
+
+// handoffLoad is called once the exporter address is bound, which the
+// previous process only releases after writing the handoff file. The file
+// is removed so that it is never applied twice.
+func handoffLoad() {
+	data, err := ioutil.ReadFile(*handoffFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("handoff: %v", err)
+		return
+	}
+	if err := os.Remove(*handoffFile); err != nil {
+		log.Printf("handoff: %v", err)
+		return
+	}
+
+	offsets := make(map[string]float64)
+	var started time.Time
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# started ") {
+			if unix, err := strconv.ParseInt(strings.TrimPrefix(line, "# started "), 10, 64); err == nil {
+				started = time.Unix(unix, 0)
+			}
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i == -1 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		offsets[line[:i]] = value
+	}
+
+	metricsLock.Lock()
+	handoffOffsets = offsets
+	handoffStart = started
+	metricsLock.Unlock()
+	log.Printf("handoff: %d series carried over from the previous process", len(offsets))
+}
+
+// handoffSocket is where the process bound to the exporter address waits
+// for the next one, to which it passes its listening socket once the
+// handoff file is written, so that the endpoint never goes down.
+func handoffSocket() string {
+	return *handoffFile + ".sock"
+}
+
+var handoffListener net.Listener
+var handoffSuccessor = make(chan *net.UnixConn, 1)
+
+// handoffListen waits for the next process, which is only handed the
+// socket once this one exits because smtpd closed its pipe or SIGTERM was
+// received: a filter started with the same handoff file while this one is
+// still fed events must not take it down.
+func handoffListen(listener net.Listener) {
+	path := handoffSocket()
+	os.Remove(path)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		log.Printf("handoff: %v", err)
+		return
+	}
+	// the next process binds the same path before this one exits
+	l.SetUnlinkOnClose(false)
+	handoffListener = listener
+
+	go func() {
+		for {
+			conn, err := l.AcceptUnix()
+			if err != nil {
+				log.Printf("handoff: %v", err)
+				return
+			}
+			log.Printf("handoff: next process waiting for this one to exit")
+			// the latest process to connect is the one handed over to
+			select {
+			case previous := <-handoffSuccessor:
+				previous.Close()
+			default:
+			}
+			handoffSuccessor <- conn
+		}
+	}()
+}
+
+// handoffRelease passes the exporter listening socket to the next process
+// if it is waiting for it, it is called once the handoff file is written.
+func handoffRelease() {
+	var conn *net.UnixConn
+	select {
+	case conn = <-handoffSuccessor:
+	default:
+		return
+	}
+	defer conn.Close()
+
+	tcp, ok := handoffListener.(*net.TCPListener)
+	if !ok {
+		return
+	}
+	f, err := tcp.File()
+	if err != nil {
+		log.Printf("handoff: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil); err != nil {
+		log.Printf("handoff: %v", err)
+	}
+}
+
+// handoffAcquire asks the process bound to the exporter address for its
+// listening socket, it returns nil if there is none or it went away, the
+// address is then bound once released.
+func handoffAcquire() net.Listener {
+	c, err := net.DialTimeout("unix", handoffSocket(), time.Second)
+	if err != nil {
+		return nil
+	}
+	conn := c.(*net.UnixConn)
+	defer conn.Close()
+
+	// the previous process first drains its events
+	conn.SetReadDeadline(time.Now().Add(*exporterRetry))
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		log.Printf("handoff: %v", err)
+		return nil
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) != 1 {
+		log.Printf("handoff: no listening socket received")
+		return nil
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) != 1 {
+		log.Printf("handoff: no listening socket received")
+		return nil
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "exporter")
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		log.Printf("handoff: %v", err)
+		return nil
+	}
+	log.Printf("handoff: listening socket taken over from the previous process")
+	return listener
+}
+
+func handoffInit() {
+	if *handoffFile == "" {
+		return
+	}
+	if *exporterRetry == 0 {
+		log.Fatal("-handoff-file requires -exporter-retry to wait for the previous process")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		shutdown()
+	}()
+}
@@ -0,0 +1,181 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+)
+
+var subsystemsList *string
+
+// subsystems registered regardless of the handshake when -subsystems is
+// set, nil otherwise.
+var forcedSubsystems map[string]bool
+
+// subsystems the filter registered for, protected by metricsLock.
+var registered = map[string]bool{"smtp-in": false, "smtp-out": false}
+
+// smtpd version told by the config handshake. handshakeInfo holds the
+// one of the last completed handshake and the filter protocol version of
+// the last event, see protocolSeen, protected by metricsLock.
+var smtpdVersion string
+var handshakeInfo struct {
+	smtpdVersion    string
+	protocolVersion string
+}
+
+// handshaking is set while config lines are being received, smtpd sends
+// them again when it restarts without restarting the filter.
+var handshaking = true
+
+var reconnects uint64
+
+// configLine accounts for a line of the config handshake and returns true
+// once it is over.
+func configLine(line string) bool {
+	if !handshaking {
+		// a new handshake, subsystems are registered anew
+		handshaking = true
+		registerSMTPIn = false
+		registerSMTPOut = false
+		smtpdVersion = ""
+	}
+	// a filter attached to both listeners and relays may be told about
+	// each subsystem several times and in any order
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, "config|smtpd-version|"):
+		smtpdVersion = strings.TrimPrefix(line, "config|smtpd-version|")
+	case line == "config|subsystem|smtp-in":
+		registerSMTPIn = true
+	case line == "config|subsystem|smtp-out":
+		registerSMTPOut = true
+	case line == "config|ready":
+		handshaking = false
+		if forcedSubsystems != nil {
+			registerSMTPIn = forcedSubsystems["smtp-in"]
+			registerSMTPOut = forcedSubsystems["smtp-out"]
+		}
+		return true
+	}
+	return false
+}
+
+// protocolSeen records the protocol version of an event, it is called
+// with metricsLock held.
+func protocolSeen(version string) {
+	if handshakeInfo.protocolVersion != version {
+		// copied so that it doesn't pin the whole line in memory
+		handshakeInfo.protocolVersion = string([]byte(version))
+	}
+}
+
+func subsystemsInit() {
+	if *subsystemsList == "" {
+		return
+	}
+	forcedSubsystems = make(map[string]bool)
+	for _, subsystem := range strings.Split(*subsystemsList, ",") {
+		switch subsystem {
+		case "smtp-in", "smtp-out":
+			forcedSubsystems[subsystem] = true
+		case "both":
+			forcedSubsystems["smtp-in"] = true
+			forcedSubsystems["smtp-out"] = true
+		default:
+			log.Fatalf("invalid subsystem: %s", subsystem)
+		}
+	}
+}
+
+func registrationCollector(e *exposition) {
+	if *daemonSocket != "" {
+		return
+	}
+	e.header("smtpd_filter_registered", "Whether the filter registered for the events of a subsystem.", "gauge", nil, "subsystem")
+	for _, subsystem := range []string{"smtp-in", "smtp-out"} {
+		value := 0.0
+		if registered[subsystem] {
+			value = 1
+		}
+		e.sample("smtpd_filter_registered", label("subsystem", subsystem), value)
+	}
+	e.end()
+}
+
+// handshakeCollector makes protocol drift across a fleet visible, the
+// protocol version is empty until an event was received.
+func handshakeCollector(e *exposition) {
+	if *daemonSocket != "" {
+		return
+	}
+	subsystems := []string{}
+	for _, subsystem := range []string{"smtp-in", "smtp-out"} {
+		if registered[subsystem] {
+			subsystems = append(subsystems, subsystem)
+		}
+	}
+	labels := label("smtpd_version", handshakeInfo.smtpdVersion) + "," +
+		label("protocol", handshakeInfo.protocolVersion) + "," +
+		label("subsystems", strings.Join(subsystems, ","))
+
+	e.header("smtpd_filter_handshake_info", "The smtpd version and subsystems of the config handshake, and the filter protocol version of events.", "gauge", nil, "smtpd_version", "protocol", "subsystems")
+	e.sample("smtpd_filter_handshake_info", labels, 1)
+	e.end()
+}
+
+func skipConfig(scanner *bufio.Scanner) {
+	for {
+		if !scanner.Scan() {
+			queueDrain()
+			os.Exit(0)
+		}
+		if configLine(scanner.Text()) {
+			return
+		}
+	}
+}
+
+// resetSessions forgets the sessions of a previous smtpd instance, they
+// will never be disconnected.
+func resetSessions() {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	sessions = newSessionStore(len(sessions.shards))
+	for _, m := range metricSets {
+		m.sessionsActive = 0
+		m.sessionsUnixActive = 0
+		m.sessionsInet4Active = 0
+		m.sessionsInet6Active = 0
+		m.sessionsTLSActive = 0
+		m.sessionsAuthActive = 0
+		m.sessionsSeeded = 0
+		m.txActive = 0
+		m.peers.reset()
+	}
+	reconnects++
+}
+
+func reconnectsCollector(e *exposition) {
+	e.header("smtpd_reconnects_total", "The number of times smtpd restarted the filter handshake.", "counter", nil)
+	e.sample("smtpd_reconnects_total", "", float64(reconnects))
+	e.end()
+}
@@ -0,0 +1,161 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+var maxHeloNames *int
+var topHelo *int
+
+// heloStats are the sessions seen with a HELO/EHLO name and how many of
+// them were refused something, sessions including those inherited from
+// an evicted name.
+type heloStats struct {
+	sessions  uint64
+	inherited uint64
+	rejected  uint64
+}
+
+// ratio is the share of sessions actually seen with the name that were
+// refused something, inherited sessions are of another name.
+func (s heloStats) ratio() float64 {
+	return float64(s.rejected) / float64(s.sessions-s.inherited)
+}
+
+// heloTable keeps the most frequent HELO names with the space-saving
+// algorithm: once full, a new name replaces the least frequent one and
+// inherits its count, so frequent names are never evicted by a flood of
+// one-off forged names. Protected by metricsLock.
+type heloTable struct {
+	names   map[string]*heloStats
+	evicted uint64
+}
+
+func newHeloTable() *heloTable {
+	return &heloTable{names: make(map[string]*heloStats)}
+}
+
+func (t *heloTable) account(name string, rejected bool) {
+	stats, ok := t.names[name]
+	if !ok {
+		stats = &heloStats{}
+		if len(t.names) >= *maxHeloNames {
+			least := ""
+			for candidate, s := range t.names {
+				if least == "" || s.sessions < t.names[least].sessions {
+					least = candidate
+				}
+			}
+			stats.sessions = t.names[least].sessions
+			stats.inherited = t.names[least].sessions
+			delete(t.names, least)
+			t.evicted++
+		}
+		t.names[name] = stats
+	}
+	stats.sessions++
+	if rejected {
+		stats.rejected++
+	}
+}
+
+type heloCount struct {
+	name  string
+	stats heloStats
+}
+
+func (t *heloTable) top(n int) []heloCount {
+	names := make([]heloCount, 0, len(t.names))
+	for name, stats := range t.names {
+		names = append(names, heloCount{name, *stats})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].stats.sessions != names[j].stats.sessions {
+			return names[i].stats.sessions > names[j].stats.sessions
+		}
+		return names[i].name < names[j].name
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+// heloName is the label value of a HELO name, address literals are masked
+// like peer addresses.
+func heloName(name string) (string, bool) {
+	if bucket, ok := bucketOf("helo", name); ok {
+		return bucket, true
+	}
+	normalized := normalizeHostname(name)
+	if normalized == "" {
+		return sanitizeLabel(name)
+	}
+	if strings.HasPrefix(normalized, "[") {
+		normalized = "[" + privateIP(strings.TrimPrefix(strings.Trim(normalized, "[]"), "IPv6:")) + "]"
+	}
+	return sanitizeLabel(normalized)
+}
+
+// accountHelo is called when smtp-in sessions end.
+func accountHelo(m *metrics, s *session) {
+	if s.subsystem != "smtp-in" || s.helo == "" || *maxHeloNames < 1 {
+		return
+	}
+	if name, ok := heloName(s.helo); ok {
+		m.helos.account(name, s.refused || s.rejected != "")
+	}
+}
+
+func heloCollector(e *exposition) {
+	tops := make(map[*metrics][]heloCount)
+	for _, m := range e.inbound() {
+		tops[m] = m.helos.top(*topHelo)
+	}
+
+	// space-saving counts are estimates, a name evicted and seen again
+	// starts over from another name's count, so they are no counters
+	e.header("smtpd_helo_sessions", "The estimated number of sessions of the top HELO/EHLO names.", "gauge", e.inbound(), "helo")
+	for _, m := range e.inbound() {
+		for _, helo := range tops[m] {
+			e.sample("smtpd_helo_sessions", m.labels()+","+label("helo", helo.name), float64(helo.stats.sessions))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_helo_rejected", "The number of sessions of the top HELO/EHLO names that were refused something since they were last tracked.", "gauge", e.inbound(), "helo")
+	for _, m := range e.inbound() {
+		for _, helo := range tops[m] {
+			e.sample("smtpd_helo_rejected", m.labels()+","+label("helo", helo.name), float64(helo.stats.rejected))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_helo_rejection_ratio", "The ratio of sessions of the top HELO/EHLO names that were refused something.", "gauge", e.inbound(), "helo")
+	for _, m := range e.inbound() {
+		for _, helo := range tops[m] {
+			e.sample("smtpd_helo_rejection_ratio", m.labels()+","+label("helo", helo.name), helo.stats.ratio())
+		}
+	}
+	e.end()
+
+	e.counter("smtpd_helo_names_evicted_total", "The number of HELO/EHLO names evicted from the table of the most frequent ones.",
+		func(m *metrics) uint64 { return m.helos.evicted })
+}
@@ -0,0 +1,72 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"strconv"
+)
+
+type histogram struct {
+	bounds []float64
+	les    []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	// bucket labels are computed once rather than on every scrape
+	les := make([]string, len(bounds)+1)
+	for i, bound := range bounds {
+		les[i] = label("le", strconv.FormatFloat(bound, 'f', -1, 64))
+	}
+	les[len(bounds)] = label("le", "+Inf")
+
+	return &histogram{
+		bounds: bounds,
+		les:    les,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (e *exposition) histogram(name string, labels string, h *histogram) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+
+	bucket := name + "_bucket"
+	cumulative := uint64(0)
+	for i := range h.bounds {
+		cumulative += h.counts[i]
+		e.sample(bucket, prefix+h.les[i], float64(cumulative))
+	}
+	e.sample(bucket, prefix+h.les[len(h.bounds)], float64(h.count))
+	e.sample(name+"_sum", labels, h.sum)
+	e.sample(name+"_count", labels, float64(h.count))
+}
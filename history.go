@@ -0,0 +1,295 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var historyRetention *time.Duration
+var historyBucket *time.Duration
+var historyMaxKeys *int
+
+// historyCounts is what happened for a key during a bucket.
+type historyCounts struct {
+	Connections   uint64 `json:"connections"`
+	AuthSuccesses uint64 `json:"auth_successes"`
+	AuthFailures  uint64 `json:"auth_failures"`
+	Commits       uint64 `json:"commits"`
+	Rollbacks     uint64 `json:"rollbacks"`
+	Recipients    uint64 `json:"recipients"`
+}
+
+func (c *historyCounts) add(o *historyCounts) {
+	c.Connections += o.Connections
+	c.AuthSuccesses += o.AuthSuccesses
+	c.AuthFailures += o.AuthFailures
+	c.Commits += o.Commits
+	c.Rollbacks += o.Rollbacks
+	c.Recipients += o.Recipients
+}
+
+type historyKey struct {
+	kind string
+	name string
+}
+
+type historyBucketData struct {
+	start  time.Time
+	counts map[historyKey]*historyCounts
+}
+
+// history keeps per-IP and per-sender domain statistics in time buckets for a retention period,
+// for investigations that don't justify high-cardinality metrics.
+var history = struct {
+	sync.Mutex
+	buckets  []*historyBucketData
+	overflow uint64
+}{}
+
+func historyEnabled() bool {
+	return *historyRetention > 0
+}
+
+func historyRecord(now time.Time, kind string, name string, update func(*historyCounts)) {
+	if !historyEnabled() || name == "" {
+		return
+	}
+	start := now.Truncate(*historyBucket)
+
+	history.Lock()
+	defer history.Unlock()
+
+	var bucket *historyBucketData
+	if n := len(history.buckets); n != 0 && !history.buckets[n-1].start.Before(start) {
+		// events are mostly in order, late ones land in their bucket
+		for i := n - 1; i >= 0; i-- {
+			if history.buckets[i].start.Equal(start) {
+				bucket = history.buckets[i]
+				break
+			}
+		}
+		if bucket == nil {
+			return
+		}
+	} else {
+		bucket = &historyBucketData{start: start, counts: make(map[historyKey]*historyCounts)}
+		history.buckets = append(history.buckets, bucket)
+
+		expired := 0
+		for expired < len(history.buckets) && now.Sub(history.buckets[expired].start) > *historyRetention {
+			expired++
+		}
+		history.buckets = history.buckets[expired:]
+	}
+
+	key := historyKey{kind, name}
+	counts, ok := bucket.counts[key]
+	if !ok {
+		if len(bucket.counts) >= *historyMaxKeys {
+			history.overflow++
+			return
+		}
+		counts = &historyCounts{}
+		bucket.counts[key] = counts
+	}
+	update(counts)
+}
+
+// historyIP records an event of a peer, masked like everywhere else in
+// privacy mode.
+func historyIP(s *session, update func(*historyCounts)) {
+	if s.subsystem != "smtp-in" || s.peer == "" {
+		return
+	}
+	historyRecord(s.timestamp, "ip", privateIP(s.peer), update)
+}
+
+// historyDomain records a transaction event of the sender domain of an
+// smtp-in session, null senders aren't accounted.
+func historyDomain(s *session, update func(*historyCounts)) {
+	if s.subsystem != "smtp-in" || s.mailDomain == "" {
+		return
+	}
+	historyRecord(s.timestamp, "domain", s.mailDomain, update)
+}
+
+// historyTransaction records a transaction event both for the peer and the
+// sender domain.
+func historyTransaction(s *session, update func(*historyCounts)) {
+	historyIP(s, update)
+	historyDomain(s, update)
+}
+
+type historyEntry struct {
+	Start time.Time `json:"start"`
+	historyCounts
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimPrefix(r.URL.Path, "/api/v1/ips/")
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	if addr.To4() != nil {
+		addr = addr.To4()
+	}
+	name := privateIP(addr.String())
+
+	reply := struct {
+		IP      string         `json:"ip"`
+		Total   historyCounts  `json:"total"`
+		Buckets []historyEntry `json:"buckets"`
+	}{IP: name, Buckets: []historyEntry{}}
+
+	history.Lock()
+	for _, bucket := range history.buckets {
+		if counts, ok := bucket.counts[historyKey{"ip", name}]; ok {
+			reply.Buckets = append(reply.Buckets, historyEntry{bucket.start, *counts})
+			reply.Total.add(counts)
+		}
+	}
+	history.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// parseHistoryTime accepts either an RFC 3339 time or a Unix timestamp.
+func parseHistoryTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+type historyRow struct {
+	Start time.Time `json:"start"`
+	Kind  string    `json:"kind"`
+	Key   string    `json:"key"`
+	historyCounts
+}
+
+// exportHandler dumps the buckets starting within [from, to) for offline
+// analysis, as CSV by default.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var from, to time.Time
+	var err error
+	if value := query.Get("from"); value != "" {
+		if from, err = parseHistoryTime(value); err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = parseHistoryTime(value); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+
+	rows := []historyRow{}
+	history.Lock()
+	for _, bucket := range history.buckets {
+		if bucket.start.Before(from) || (!to.IsZero() && !bucket.start.Before(to)) {
+			continue
+		}
+		first := len(rows)
+		for key, counts := range bucket.counts {
+			rows = append(rows, historyRow{bucket.start, key.kind, key.name, *counts})
+		}
+		sort.Slice(rows[first:], func(i, j int) bool {
+			a, b := rows[first+i], rows[first+j]
+			if a.Kind != b.Kind {
+				return a.Kind < b.Kind
+			}
+			return a.Key < b.Key
+		})
+	}
+	history.Unlock()
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	out := csv.NewWriter(w)
+	out.Write([]string{"start", "kind", "key", "connections", "auth_successes", "auth_failures", "commits", "rollbacks", "recipients"})
+	for _, row := range rows {
+		out.Write([]string{
+			row.Start.UTC().Format(time.RFC3339), row.Kind, row.Key,
+			strconv.FormatUint(row.Connections, 10),
+			strconv.FormatUint(row.AuthSuccesses, 10),
+			strconv.FormatUint(row.AuthFailures, 10),
+			strconv.FormatUint(row.Commits, 10),
+			strconv.FormatUint(row.Rollbacks, 10),
+			strconv.FormatUint(row.Recipients, 10),
+		})
+	}
+	out.Flush()
+}
+
+func historyCollector(e *exposition) {
+	if !historyEnabled() {
+		return
+	}
+	history.Lock()
+	buckets, overflow := len(history.buckets), history.overflow
+	history.Unlock()
+
+	e.header("smtpd_history_buckets", "The number of time buckets of per-IP and per-domain statistics kept.", "gauge", nil)
+	e.sample("smtpd_history_buckets", "", float64(buckets))
+	e.end()
+
+	e.header("smtpd_history_overflow_total", "The number of events not kept because a bucket was full.", "counter", nil)
+	e.sample("smtpd_history_overflow_total", "", float64(overflow))
+	e.end()
+}
+
+func historyInit() {
+	if !historyEnabled() {
+		return
+	}
+	if *historyBucket <= 0 || *historyBucket > *historyRetention {
+		log.Fatalf("invalid history bucket: %s", *historyBucket)
+	}
+	http.HandleFunc("/api/v1/ips/", historyHandler)
+	http.HandleFunc("/api/v1/export", exportHandler)
+}
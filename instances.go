@@ -0,0 +1,148 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var instanceName *string
+var heartbeatInterval *time.Duration
+var heartbeatTimeout *time.Duration
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+// instance is an smtpd instance forwarding events to the daemon through a
+// shim, along with the sessions it has active.
+type instance struct {
+	name     string
+	sessions map[string]bool
+	lastSeen time.Time
+}
+
+var instances = struct {
+	sync.Mutex
+	active  map[string]*instance
+	expired uint64
+}{active: make(map[string]*instance)}
+
+func (inst *instance) register(name string) {
+	instances.Lock()
+	defer instances.Unlock()
+	inst.name = name
+	instances.active[name] = inst
+}
+
+func (inst *instance) unregister() {
+	instances.Lock()
+	defer instances.Unlock()
+	if instances.active[inst.name] == inst {
+		delete(instances.active, inst.name)
+	}
+}
+
+func (inst *instance) seen(now time.Time) {
+	instances.Lock()
+	defer instances.Unlock()
+	inst.lastSeen = now
+}
+
+func (inst *instance) track(atoms []string) {
+	if atoms[0] != "report" {
+		return
+	}
+	instances.Lock()
+	defer instances.Unlock()
+	switch atoms[4] {
+	case "link-connect":
+		inst.sessions[atoms[5]] = true
+	case "link-disconnect":
+		delete(inst.sessions, atoms[5])
+	}
+}
+
+// forget has the worker release the sessions of the instance, in order
+// with the events already queued.
+func (inst *instance) forget(reason string) {
+	instances.Lock()
+	marker := []string{"forget", reason}
+	for id := range inst.sessions {
+		marker = append(marker, id)
+	}
+	inst.sessions = make(map[string]bool)
+	if reason == "expired" {
+		instances.expired++
+	}
+	instances.Unlock()
+
+	enqueueWait(marker)
+}
+
+// forgetSessions releases sessions that will never be disconnected.
+func forgetSessions(reason string, ids []string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	for _, id := range ids {
+		if s, ok := sessions.get(id); ok {
+			releaseSession(s, s.metrics())
+		}
+	}
+	if reason == "reconnect" {
+		reconnects++
+	}
+}
+
+func instancesCollector(e *exposition) {
+	if !daemonMode() {
+		return
+	}
+
+	instances.Lock()
+	defer instances.Unlock()
+
+	names := []string{}
+	for name := range instances.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e.header("smtpd_instance_sessions_active", "The number of active sessions per smtpd instance.", "gauge", nil, "instance")
+	for _, name := range names {
+		e.sample("smtpd_instance_sessions_active", label("instance", name), float64(len(instances.active[name].sessions)))
+	}
+	e.end()
+
+	e.header("smtpd_instance_last_seen_timestamp_seconds", "The last time an smtpd instance forwarded an event or heartbeat.", "gauge", nil, "instance")
+	for _, name := range names {
+		e.sample("smtpd_instance_last_seen_timestamp_seconds", label("instance", name), float64(instances.active[name].lastSeen.Unix()))
+	}
+	e.end()
+
+	e.header("smtpd_instances_expired_total", "The number of smtpd instances whose sessions expired after heartbeats stopped.", "counter", nil)
+	e.sample("smtpd_instances_expired_total", "", float64(instances.expired))
+	e.end()
+}
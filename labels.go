@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var labelPolicy *string
+var labelMaxLength *int
+var maxSeries *int
+
+// collapsedValues is how many of the values collapsed into the other
+// bucket are remembered, so that each is only counted once as dropped.
+const collapsedValues = 100000
+
+// series keeps track of the dynamic label combinations handed out so far,
+// and of the values that were collapsed in bounded memory.
+var series = struct {
+	sync.Mutex
+	known     map[string]map[string]bool
+	count     int
+	collapsed *bloom
+	dropped   uint64
+}{known: make(map[string]map[string]bool), collapsed: newBloom(collapsedValues)}
+
+func checkLabelPolicy() {
+	switch *labelPolicy {
+	case "drop", "hash", "truncate":
+	default:
+		log.Fatalf("invalid label policy: %s", *labelPolicy)
+	}
+}
+
+// cleanLabel replaces invalid UTF-8 sequences and control characters,
+// it reports whether the value had to be modified.
+func cleanLabel(value string) (string, bool) {
+	clean := true
+	for _, r := range value {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return value, true
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); {
+		r, size := utf8.DecodeRuneInString(value[i:])
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			b.WriteRune(utf8.RuneError)
+		} else {
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	return b.String(), false
+}
+
+func hashLabel(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "h:" + hex.EncodeToString(sum[:8])
+}
+
+func truncateLabel(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	for max > 0 && !utf8.RuneStart(value[max]) {
+		max--
+	}
+	return value[:max]
+}
+
+// sanitizeLabel must be applied to all user-controlled values (domains,
+// HELO names, auth users, ...) before they are used as label values, the
+// configured policy decides what happens to unsafe or oversized values.
+// The second return value is false if the value must not be exposed.
+func sanitizeLabel(value string) (string, bool) {
+	value, clean := cleanLabel(value)
+	if clean && len(value) <= *labelMaxLength {
+		return value, true
+	}
+
+	switch *labelPolicy {
+	case "drop":
+		return "", false
+	case "hash":
+		return hashLabel(value), true
+	}
+	return truncateLabel(value, *labelMaxLength), true
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func label(name string, value string) string {
+	return name + "=\"" + labelEscaper.Replace(value) + "\""
+}
+
+// dynamicLabel sanitizes a user-controlled value and accounts for it in
+// the global series budget of family: once the budget is exhausted, new
+// combinations collapse into the "other" bucket.
+func dynamicLabel(family string, value string) (string, bool) {
+	value, ok := sanitizeLabel(value)
+	if !ok {
+		return "", false
+	}
+
+	series.Lock()
+	defer series.Unlock()
+
+	values, ok := series.known[family]
+	if !ok {
+		values = make(map[string]bool)
+		series.known[family] = values
+	}
+	if values[value] {
+		return value, true
+	}
+	if series.count >= *maxSeries {
+		if !series.collapsed.seen(family + "\x00" + value) {
+			series.dropped++
+		}
+		return "other", true
+	}
+	values[value] = true
+	series.count++
+	return value, true
+}
+
+func seriesCollector(e *exposition) {
+	series.Lock()
+	count, dropped := series.count, series.dropped
+	series.Unlock()
+
+	e.header("smtpd_metric_series", "The number of dynamic label combinations exposed.", "gauge", nil)
+	e.sample("smtpd_metric_series", "", float64(count))
+	e.end()
+
+	e.header("smtpd_metric_series_dropped_total", "The number of label combinations collapsed into the other bucket.", "counter", nil)
+	e.sample("smtpd_metric_series_dropped_total", "", float64(dropped))
+	e.end()
+}
@@ -0,0 +1,138 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// phases are named after the event that ends them:
+//
+//	banner: connect -> banner
+//	helo:   banner -> HELO/EHLO
+//	mail:   HELO/EHLO (or end of previous transaction) -> MAIL
+//	data:   MAIL -> DATA
+//	commit: DATA -> commit
+var phases = []string{"banner", "helo", "mail", "data", "commit"}
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// latency is also broken down by address family so that path problems
+// specific to one of them, such as IPv6 PMTU blackholes, stand out.
+var families = []string{"inet4", "inet6", "unix"}
+
+func (s *session) family() string {
+	if s.inet4 {
+		return "inet4"
+	} else if s.inet6 {
+		return "inet6"
+	}
+	return "unix"
+}
+
+func newPhaseHistograms() map[string]map[string]*histogram {
+	histograms := make(map[string]map[string]*histogram)
+	for _, family := range families {
+		histograms[family] = make(map[string]*histogram)
+		for _, phase := range phases {
+			histograms[family][phase] = newHistogram(latencyBuckets...)
+		}
+	}
+	return histograms
+}
+
+// commands whose processing time by smtpd, including the filter chain,
+// is measured between protocol-client and protocol-server events.
+var commands = []string{"helo", "ehlo", "starttls", "auth", "mail", "rcpt", "data", "rset", "noop", "quit", "other"}
+
+func newCommandHistograms() map[string]map[string]*histogram {
+	histograms := make(map[string]map[string]*histogram)
+	for _, family := range families {
+		histograms[family] = make(map[string]*histogram)
+		for _, command := range commands {
+			histograms[family][command] = newHistogram(latencyBuckets...)
+		}
+	}
+	return histograms
+}
+
+func commandVerb(line string) string {
+	verb := line
+	if i := strings.IndexByte(line, ' '); i != -1 {
+		verb = line[:i]
+	}
+	verb = strings.ToLower(verb)
+	for _, command := range commands {
+		if command == verb {
+			return verb
+		}
+	}
+	return "other"
+}
+
+func observePhase(m *metrics, s *session, phase string, start time.Time, end time.Time) {
+	if start.IsZero() || end.Before(start) {
+		return
+	}
+	m.phases[s.family()][phase].observe(end.Sub(start).Seconds())
+	m.phaseQuantiles[phase].observe(time.Now(), end.Sub(start).Seconds())
+}
+
+func latencyCollector(e *exposition) {
+	e.header("smtpd_phase_duration_seconds", "The time spent in each SMTP phase.", "histogram", e.sets, "family", "phase")
+	for _, m := range e.sets {
+		for _, family := range families {
+			for _, phase := range phases {
+				e.histogram("smtpd_phase_duration_seconds", m.labels()+","+label("family", family)+","+label("phase", phase), m.phases[family][phase])
+			}
+		}
+	}
+	e.end()
+
+	if *quantileWindowWidth != 0 {
+		e.header("smtpd_phase_duration_quantile_seconds", "The quantiles of the time spent in each SMTP phase over the quantile window.", "gauge", e.sets, "phase", "quantile")
+		for _, m := range e.sets {
+			for _, phase := range phases {
+				e.quantileGauges("smtpd_phase_duration_quantile_seconds", m.labels()+","+label("phase", phase), m.phaseQuantiles[phase])
+			}
+		}
+		e.end()
+	}
+
+	filterChainCollector(e)
+}
+
+func filterChainCollector(e *exposition) {
+	e.header("smtpd_filter_chain_delay_seconds", "The time between a client command and the server response, including the filter chain.", "histogram", e.inbound(), "family", "command")
+	for _, m := range e.inbound() {
+		for _, family := range families {
+			for _, command := range commands {
+				e.histogram("smtpd_filter_chain_delay_seconds", m.labels()+","+label("family", family)+","+label("command", command), m.filterDelay[family][command])
+			}
+		}
+	}
+	e.end()
+
+	if *quantileWindowWidth != 0 {
+		e.header("smtpd_filter_chain_delay_quantile_seconds", "The quantiles of the time between a client command and the server response over the quantile window.", "gauge", e.inbound(), "quantile")
+		for _, m := range e.inbound() {
+			e.quantileGauges("smtpd_filter_chain_delay_quantile_seconds", m.labels(), m.filterDelayQuantiles)
+		}
+		e.end()
+	}
+}
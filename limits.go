@@ -0,0 +1,73 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"strings"
+)
+
+// limits are recognized in server responses by their enhanced status
+// code or, failing that, by smtpd's wording.
+var limits = []struct {
+	name   string
+	code   string
+	phrase string
+}{
+	{"recipients", "4.5.3", "too many recipients"},
+	{"errors", "", "too many errors"},
+	{"messages", "", "too many messages"},
+	{"message_size", "5.3.4", "too big"},
+	{"line_length", "", "line too long"},
+	{"connections", "", "too many connections"},
+	{"timeout", "", ""},
+}
+
+func newLimits() map[string]uint64 {
+	hits := make(map[string]uint64)
+	for _, limit := range limits {
+		hits[limit.name] = 0
+	}
+	return hits
+}
+
+// classifyLimit returns the limit a response reports hitting, if any.
+func classifyLimit(response string) string {
+	if len(response) == 0 || response[0] != '4' && response[0] != '5' {
+		return ""
+	}
+	fields := strings.Fields(response)
+	lower := strings.ToLower(response)
+	for _, limit := range limits {
+		if limit.code != "" && len(fields) > 1 && fields[1] == limit.code {
+			return limit.name
+		}
+		if limit.phrase != "" && strings.Contains(lower, limit.phrase) {
+			return limit.name
+		}
+	}
+	return ""
+}
+
+func limitsCollector(e *exposition) {
+	e.header("smtpd_limit_hits_total", "The number of responses reporting a limit was hit.", "counter", e.sets, "limit")
+	for _, m := range e.sets {
+		for _, limit := range limits {
+			e.sample("smtpd_limit_hits_total", m.labels()+","+label("limit", limit.name), float64(m.limitHits[limit.name]))
+		}
+	}
+	e.end()
+}
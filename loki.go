@@ -0,0 +1,181 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var lokiURL *string
+var lokiLabels = namedValues{}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// lokiBatch groups the lines of a push per label set.
+type lokiBatch struct {
+	streams map[string]*lokiStream
+	lines   int
+}
+
+func (b *lokiBatch) add(labels map[string]string, timestamp time.Time, line string) {
+	for name, value := range lokiLabels {
+		labels[name] = value
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := ""
+	for _, name := range names {
+		key += label(name, labels[name]) + ","
+	}
+
+	stream, ok := b.streams[key]
+	if !ok {
+		stream = &lokiStream{Stream: labels}
+		b.streams[key] = stream
+	}
+	stream.Values = append(stream.Values, [2]string{strconv.FormatInt(timestamp.UnixNano(), 10), line})
+	b.lines++
+}
+
+// logfmt renders fields as a logfmt line, in the given order.
+func logfmt(fields ...string) string {
+	b := strings.Builder{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == "" {
+			continue
+		}
+		if b.Len() != 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fields[i])
+		b.WriteByte('=')
+		if strings.ContainsAny(fields[i+1], " \"=") {
+			b.WriteString(strconv.Quote(fields[i+1]))
+		} else {
+			b.WriteString(fields[i+1])
+		}
+	}
+	return b.String()
+}
+
+// lokiEntry turns a record into a line, labelled like the metrics so that
+// Grafana can pivot from one to the other.
+func lokiEntry(r interface{}) (map[string]string, time.Time, string) {
+	switch r := r.(type) {
+	case *txRecord:
+		labels := map[string]string{"direction": r.Direction, "event": r.Result}
+		if r.Role != "" {
+			labels["session_role"] = r.Role
+		}
+		return labels, r.EndedAt, logfmt(
+			"session", r.Session,
+			"msgid", r.Message,
+			"sender_domain", r.Sender,
+			"recipients", strconv.FormatUint(r.Recipients, 10),
+			"recipient_domains", recordDomains(r),
+			"size", strconv.FormatUint(r.Size, 10),
+			"duration", r.EndedAt.Sub(r.BeganAt).String())
+	case *notableRecord:
+		labels := map[string]string{"event": r.Kind}
+		fields := []string{}
+		names := make([]string, 0, len(r.Fields))
+		for name := range r.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if name == "direction" {
+				labels[name] = r.Fields[name]
+				continue
+			}
+			if name == "role" {
+				labels["session_role"] = r.Fields[name]
+				continue
+			}
+			fields = append(fields, name, r.Fields[name])
+		}
+		return labels, r.Timestamp, logfmt(fields...)
+	}
+	return nil, time.Time{}, ""
+}
+
+func lokiInit() {
+	if *lokiURL == "" {
+		return
+	}
+	endpoint := strings.TrimSuffix(*lokiURL, "/") + "/loki/api/v1/push"
+	client := &http.Client{Timeout: 10 * time.Second}
+	batch := &lokiBatch{streams: make(map[string]*lokiStream)}
+
+	write := func(r interface{}) error {
+		labels, timestamp, line := lokiEntry(r)
+		if labels != nil {
+			batch.add(labels, timestamp, line)
+		}
+		if batch.lines < 1000 {
+			return nil
+		}
+		return flushLoki(client, endpoint, batch)
+	}
+	flush := func() error {
+		return flushLoki(client, endpoint, batch)
+	}
+	addBatchSink("loki", []string{"transaction", "security"}, write, flush)
+}
+
+func flushLoki(client *http.Client, endpoint string, batch *lokiBatch) error {
+	if batch.lines == 0 {
+		return nil
+	}
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, stream := range batch.streams {
+		push.Streams = append(push.Streams, stream)
+	}
+	// the batch is dropped even if the push fails, Loki rejects lines
+	// older than what it already has for a stream
+	batch.streams = make(map[string]*lokiStream)
+	batch.lines = 0
+
+	data, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,518 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var passthrough *bool
+var hopsWarning *int
+var messageIDWindow *int
+var trickleRate *int
+
+// transfers shorter than this are never considered trickling, a small
+// message sent over a slow link isn't tying up a session.
+const trickleMinDuration = 10 * time.Second
+
+var messageIDs *bloom
+
+var messageClasses = []string{"list", "auto", "transactional", "other"}
+
+// buckets of the top-level Content-Type and charset of messages.
+var contentTypes = []string{"text/plain", "text/html", "multipart/*", "other"}
+var charsets = []string{"us-ascii", "utf-8", "iso-8859-*", "windows-*", "other", "none"}
+
+var executableExtensions = []string{
+	"bat", "cmd", "com", "cpl", "dll", "exe", "hta", "jar", "js", "jse",
+	"lnk", "msi", "pif", "ps1", "scr", "vbe", "vbs", "wsf", "wsh",
+}
+
+// format anomalies of a message, smtpd hands lines over with their line
+// ending stripped so that a bare LF can't be told from a CRLF, while a
+// bare CR is left within the line.
+var formatAnomalies = []string{"long_line", "bare_cr", "nul"}
+
+// maxLineLength is the RFC 5321 limit of 1000 octets, CRLF excluded.
+const maxLineLength = 998
+
+// message is the state kept while data lines of a message flow through
+// the filter, nothing is ever modified: lines are echoed back untouched.
+type message struct {
+	inHeaders bool
+	inBody    bool
+
+	headerBytes uint64
+	bodyBytes   uint64
+	hops        uint64
+	messageID   string
+
+	// header currently being unfolded
+	header string
+
+	// MIME structure, part headers are parsed like message headers
+	boundaries  []string
+	parts       uint64
+	attachment  bool
+	executables []string
+
+	// attachment described by the header block being parsed
+	partAttachment bool
+	partFilename   string
+
+	listID        bool
+	precedence    string
+	autoSubmitted string
+	autoReply     bool
+
+	// top-level Content-Type and charset, empty if missing
+	contentType string
+	charset     string
+
+	// format anomalies seen in the message
+	anomalies map[string]bool
+
+	// spam score reported in one of -spam-score-headers
+	score  float64
+	scored bool
+}
+
+func newMessage() *message {
+	return &message{inHeaders: true}
+}
+
+func (msg *message) onHeader(name string, value string) {
+	switch strings.ToLower(name) {
+	case "received":
+		if !msg.inBody {
+			msg.hops++
+		}
+	case "message-id":
+		if !msg.inBody {
+			msg.messageID = value
+		}
+	case "list-id", "list-unsubscribe":
+		msg.listID = true
+	case "precedence":
+		msg.precedence = strings.ToLower(value)
+	case "auto-submitted":
+		msg.autoSubmitted = strings.ToLower(value)
+	case "x-autoreply", "x-autorespond":
+		msg.autoReply = true
+	case "content-type":
+		mediatype, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			return
+		}
+		if !msg.inBody {
+			msg.contentType = mediatype
+			msg.charset = strings.ToLower(params["charset"])
+		}
+		if strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "" {
+			msg.boundaries = append(msg.boundaries, params["boundary"])
+		}
+		if params["name"] != "" {
+			msg.partAttachment = true
+			if msg.partFilename == "" {
+				msg.partFilename = params["name"]
+			}
+		}
+	case "content-disposition":
+		disposition, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			return
+		}
+		if disposition == "attachment" || params["filename"] != "" {
+			msg.partAttachment = true
+			if params["filename"] != "" {
+				msg.partFilename = params["filename"]
+			}
+		}
+	default:
+		msg.scoreHeader(name, value)
+	}
+}
+
+// endHeaders is called at the end of the message or part headers.
+func (msg *message) endHeaders() {
+	msg.flushHeader()
+	msg.inHeaders = false
+	msg.inBody = true
+
+	if msg.partAttachment {
+		msg.onAttachment(msg.partFilename)
+	}
+	msg.partAttachment = false
+	msg.partFilename = ""
+}
+
+func (msg *message) onAttachment(filename string) {
+	msg.attachment = true
+
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(strings.TrimSpace(filename)), "."))
+	for _, executable := range executableExtensions {
+		if extension == executable {
+			msg.executables = append(msg.executables, extension)
+			return
+		}
+	}
+}
+
+// boundary checks if a body line delimits a MIME part.
+func (msg *message) boundary(line string) {
+	if !strings.HasPrefix(line, "--") {
+		return
+	}
+	line = strings.TrimRight(line, " \t")
+	for i, boundary := range msg.boundaries {
+		if line == "--"+boundary {
+			msg.parts++
+			msg.inHeaders = true
+			return
+		}
+		if line == "--"+boundary+"--" {
+			msg.boundaries = msg.boundaries[:i]
+			return
+		}
+	}
+}
+
+func (msg *message) flushHeader() {
+	if msg.header == "" {
+		return
+	}
+	if i := strings.IndexByte(msg.header, ':'); i != -1 {
+		msg.onHeader(strings.TrimSpace(msg.header[:i]), strings.TrimSpace(msg.header[i+1:]))
+	}
+	msg.header = ""
+}
+
+// format flags lines that a strict smtpd would reject.
+func (msg *message) format(line string) {
+	if len(line) > maxLineLength {
+		msg.anomaly("long_line")
+	}
+	if strings.IndexByte(line, '\r') != -1 {
+		msg.anomaly("bare_cr")
+	}
+	if strings.IndexByte(line, 0) != -1 {
+		msg.anomaly("nul")
+	}
+}
+
+func (msg *message) anomaly(kind string) {
+	if msg.anomalies == nil {
+		msg.anomalies = make(map[string]bool)
+	}
+	msg.anomalies[kind] = true
+}
+
+func (msg *message) line(line string) {
+	msg.format(line)
+
+	// lines are counted with their CRLF, the separator belongs to the headers
+	if msg.inBody {
+		msg.bodyBytes += uint64(len(line)) + 2
+	} else {
+		msg.headerBytes += uint64(len(line)) + 2
+	}
+
+	if !msg.inHeaders {
+		msg.boundary(line)
+		return
+	}
+
+	if line == "" {
+		msg.endHeaders()
+		return
+	}
+	if line[0] == ' ' || line[0] == '\t' {
+		msg.header += " " + strings.TrimSpace(line)
+		return
+	}
+	msg.flushHeader()
+	msg.header = line
+}
+
+func (msg *message) class() string {
+	switch {
+	case msg.listID || msg.precedence == "list" || msg.precedence == "bulk":
+		return "list"
+	case strings.HasPrefix(msg.autoSubmitted, "auto-replied") || msg.autoReply || msg.precedence == "junk":
+		return "auto"
+	case msg.autoSubmitted != "" && msg.autoSubmitted != "no":
+		return "transactional"
+	}
+	return "other"
+}
+
+// contentTypeBucket defaults to text/plain as per RFC 2045 when the
+// message has no Content-Type.
+func (msg *message) contentTypeBucket() string {
+	switch {
+	case msg.contentType == "" || msg.contentType == "text/plain":
+		return "text/plain"
+	case msg.contentType == "text/html":
+		return "text/html"
+	case strings.HasPrefix(msg.contentType, "multipart/"):
+		return "multipart/*"
+	}
+	return "other"
+}
+
+func (msg *message) charsetBucket() string {
+	switch {
+	case msg.charset == "":
+		return "none"
+	case msg.charset == "us-ascii" || msg.charset == "utf-8":
+		return msg.charset
+	case msg.charset == "utf8":
+		return "utf-8"
+	case strings.HasPrefix(msg.charset, "iso-8859-"):
+		return "iso-8859-*"
+	case strings.HasPrefix(msg.charset, "windows-"):
+		return "windows-*"
+	}
+	return "other"
+}
+
+func (msg *message) done(m *metrics) {
+	if msg.inHeaders {
+		msg.endHeaders()
+	}
+	m.messageClass[msg.class()]++
+	m.messageContentType[msg.contentTypeBucket()]++
+	m.messageCharset[msg.charsetBucket()]++
+	for kind := range msg.anomalies {
+		m.messageFormat[kind]++
+	}
+
+	if msg.attachment {
+		m.messageAttachments++
+	}
+	for _, extension := range msg.executables {
+		m.messageExecutables[extension]++
+	}
+
+	parts := msg.parts
+	if parts == 0 {
+		parts = 1
+	}
+	m.messageParts.observe(float64(parts))
+
+	m.messageHeaderBytes.observe(float64(msg.headerBytes))
+	m.messageBodyBytes.observe(float64(msg.bodyBytes))
+
+	// an early warning for mail loops, before smtpd hits its own limit
+	m.messageHops.observe(float64(msg.hops))
+	if msg.hops > uint64(*hopsWarning) {
+		m.messageHopsExceeded++
+	}
+
+	// retry storms and senders re-injecting the same message
+	if msg.messageID != "" && messageIDs.seen(msg.messageID) {
+		m.messageDuplicateID++
+	}
+}
+
+func dataLine(s *session, subsystem string, timestamp time.Time, line string) {
+	if s.msg == nil {
+		s.msg = newMessage()
+		// the first line only reaches the filter once the client sent
+		// it and the filters before this one in the chain processed it
+		if !s.dataAt.IsZero() && !timestamp.Before(s.dataAt) {
+			s.metrics().dataFirstLine.observe(timestamp.Sub(s.dataAt).Seconds())
+		}
+	}
+	if line == "." {
+		s.msg.done(s.metrics())
+		accountSpamScore(s.metrics(), s)
+		dataThroughput(s, timestamp)
+		s.msgBytes = s.msg.headerBytes + s.msg.bodyBytes
+		s.msg = nil
+		return
+	}
+	s.msg.line(line)
+}
+
+// dataThroughput accounts for the rate at which the message was received,
+// from DATA being accepted to its final dot, so that clients trickling
+// their message to hold sessions open stand out.
+func dataThroughput(s *session, timestamp time.Time) {
+	if s.dataAt.IsZero() || !timestamp.After(s.dataAt) {
+		return
+	}
+	m := s.metrics()
+	duration := timestamp.Sub(s.dataAt)
+	rate := float64(s.msg.headerBytes+s.msg.bodyBytes) / duration.Seconds()
+	m.dataThroughput.observe(rate)
+
+	if *trickleRate == 0 || duration < trickleMinDuration || rate >= float64(*trickleRate) {
+		return
+	}
+	m.dataTrickling++
+	notable(timestamp, "data_trickle", map[string]string{
+		"ip":       s.peer,
+		"rate":     strconv.FormatFloat(rate, 'f', 0, 64),
+		"duration": duration.Round(time.Second).String(),
+	})
+}
+
+// wastedBytes accounts for the data received for a transaction rolled
+// back, the cost of rejecting at the end of DATA rather than at RCPT.
+func wastedBytes(s *session) {
+	bytes := s.msgBytes
+	if s.msg != nil {
+		bytes += s.msg.headerBytes + s.msg.bodyBytes
+	}
+	s.metrics().wastedBytes += bytes
+}
+
+// filterDataLine echoes a data line back to smtpd, it is never delayed.
+func filterDataLine(atoms []string) {
+	os.Stdout.WriteString("filter-dataline|" + atoms[5] + "|" + atoms[6] + "|" + atoms[7] + "\n")
+}
+
+// analyzeDataLine looks at a data line already echoed by filterDataLine.
+func analyzeDataLine(atoms []string) {
+	metricsLock.Lock()
+	if s, ok := sessions.get(atoms[5]); ok {
+		if timestamp, err := parseTimestamp(atoms[2]); err != nil {
+			invalidEvent(fmt.Errorf("invalid timestamp: %s", atoms[2]))
+		} else {
+			dataLine(s, atoms[3], timestamp, atoms[7])
+		}
+	}
+	metricsLock.Unlock()
+}
+
+func messagesCollector(e *exposition) {
+	e.header("smtpd_message_class_total", "The number of messages per class.", "counter", e.inbound(), "class")
+	for _, m := range e.inbound() {
+		for _, class := range messageClasses {
+			e.sample("smtpd_message_class_total", m.labels()+","+label("class", class), float64(m.messageClass[class]))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_message_content_type_total", "The number of messages per top-level Content-Type.", "counter", e.inbound(), "type")
+	for _, m := range e.inbound() {
+		for _, contentType := range contentTypes {
+			e.sample("smtpd_message_content_type_total", m.labels()+","+label("type", contentType), float64(m.messageContentType[contentType]))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_message_charset_total", "The number of messages per top-level charset.", "counter", e.inbound(), "charset")
+	for _, m := range e.inbound() {
+		for _, charset := range charsets {
+			e.sample("smtpd_message_charset_total", m.labels()+","+label("charset", charset), float64(m.messageCharset[charset]))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_messages_with_attachments_total", "The number of messages with attachments.", "counter", e.inbound())
+	for _, m := range e.inbound() {
+		e.sample("smtpd_messages_with_attachments_total", m.labels(), float64(m.messageAttachments))
+	}
+	e.end()
+
+	e.header("smtpd_message_executable_attachments_total", "The number of executable attachments per extension.", "counter", e.inbound(), "extension")
+	for _, m := range e.inbound() {
+		for _, extension := range executableExtensions {
+			e.sample("smtpd_message_executable_attachments_total", m.labels()+","+label("extension", extension), float64(m.messageExecutables[extension]))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_message_mime_parts", "The number of MIME parts per message.", "histogram", e.inbound())
+	for _, m := range e.inbound() {
+		e.histogram("smtpd_message_mime_parts", m.labels(), m.messageParts)
+	}
+	e.end()
+
+	e.header("smtpd_message_header_bytes", "The size of message headers.", "histogram", e.inbound())
+	for _, m := range e.inbound() {
+		e.histogram("smtpd_message_header_bytes", m.labels(), m.messageHeaderBytes)
+	}
+	e.end()
+
+	e.header("smtpd_message_body_bytes", "The size of message bodies.", "histogram", e.inbound())
+	for _, m := range e.inbound() {
+		e.histogram("smtpd_message_body_bytes", m.labels(), m.messageBodyBytes)
+	}
+	e.end()
+
+	e.header("smtpd_data_first_line_seconds", "The time between DATA being accepted and the first data line reaching the filter.", "histogram", e.inbound())
+	for _, m := range e.inbound() {
+		e.histogram("smtpd_data_first_line_seconds", m.labels(), m.dataFirstLine)
+	}
+	e.end()
+
+	e.header("smtpd_data_throughput_bytes_per_second", "The rate at which messages were received, from DATA to the final dot.", "histogram", e.inbound())
+	for _, m := range e.inbound() {
+		e.histogram("smtpd_data_throughput_bytes_per_second", m.labels(), m.dataThroughput)
+	}
+	e.end()
+
+	e.header("smtpd_data_trickling_total", "The number of messages received slower than the trickle rate.", "counter", e.inbound())
+	for _, m := range e.inbound() {
+		e.sample("smtpd_data_trickling_total", m.labels(), float64(m.dataTrickling))
+	}
+	e.end()
+
+	e.header("smtpd_message_format_anomalies_total", "The number of messages per format anomaly.", "counter", e.inbound(), "kind")
+	for _, m := range e.inbound() {
+		for _, kind := range formatAnomalies {
+			e.sample("smtpd_message_format_anomalies_total", m.labels()+","+label("kind", kind), float64(m.messageFormat[kind]))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_wasted_bytes_total", "The size of the data received for transactions that were rolled back.", "counter", e.inbound())
+	for _, m := range e.inbound() {
+		e.sample("smtpd_wasted_bytes_total", m.labels(), float64(m.wastedBytes))
+	}
+	e.end()
+
+	e.header("smtpd_message_received_hops", "The number of Received headers per message.", "histogram", e.inbound())
+	for _, m := range e.inbound() {
+		e.histogram("smtpd_message_received_hops", m.labels(), m.messageHops)
+	}
+	e.end()
+
+	e.header("smtpd_message_hops_exceeded_total", "The number of messages with more Received headers than the warning threshold.", "counter", e.inbound())
+	for _, m := range e.inbound() {
+		e.sample("smtpd_message_hops_exceeded_total", m.labels(), float64(m.messageHopsExceeded))
+	}
+	e.end()
+
+	e.header("smtpd_duplicate_message_id_total", "The number of messages with a recently seen Message-ID.", "counter", e.inbound())
+	for _, m := range e.inbound() {
+		e.sample("smtpd_duplicate_message_id_total", m.labels(), float64(m.messageDuplicateID))
+	}
+	e.end()
+}
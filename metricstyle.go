@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"strings"
+)
+
+// metricStyle is how directions are told apart: a direction label on
+// every series, or smtpd_in_ and smtpd_out_ metric name prefixes for
+// dashboards built around them. Metrics are always collected with the
+// label, the prefixes are derived from it when serving them.
+var metricStyle *string
+
+var directionPrefixes = map[string]string{
+	"smtp-in":  "smtpd_in_",
+	"smtp-out": "smtpd_out_",
+}
+
+func metricStyleInit() {
+	switch *metricStyle {
+	case "label", "prefix":
+	default:
+		log.Fatalf("invalid metric style: %s", *metricStyle)
+	}
+}
+
+// splitSeries splits a sample line into its name, labels and what follows
+// them, label values may contain braces.
+func splitSeries(line string) (string, string, string) {
+	i := strings.IndexAny(line, "{ ")
+	if i == -1 {
+		return line, "", ""
+	}
+	if line[i] == ' ' {
+		return line[:i], "", line[i:]
+	}
+	quoted := false
+	for j := i + 1; j < len(line); j++ {
+		switch {
+		case quoted && line[j] == '\\':
+			j++
+		case line[j] == '"':
+			quoted = !quoted
+		case !quoted && line[j] == '}':
+			return line[:i], line[i+1 : j], line[j+1:]
+		}
+	}
+	return line, "", ""
+}
+
+// withoutDirection removes the direction label from a label set and
+// returns its value.
+func withoutDirection(labels string) (string, string) {
+	pairs := []string{}
+	direction := ""
+	quoted := false
+	start := 0
+	for i := 0; i <= len(labels); i++ {
+		if i < len(labels) {
+			switch {
+			case quoted && labels[i] == '\\':
+				i++
+				continue
+			case labels[i] == '"':
+				quoted = !quoted
+				continue
+			case quoted || labels[i] != ',':
+				continue
+			}
+		}
+		pair := labels[start:i]
+		start = i + 1
+		if strings.HasPrefix(pair, "direction=\"") && strings.HasSuffix(pair, "\"") {
+			direction = pair[len("direction=\"") : len(pair)-1]
+			continue
+		}
+		if pair != "" {
+			pairs = append(pairs, pair)
+		}
+	}
+	return strings.Join(pairs, ","), direction
+}
+
+// prefixStyle rewrites an exposition in the prefix style, each family
+// being split into a family per direction, series without a direction
+// keeping their name.
+func prefixStyle(in *bytes.Buffer, openMetrics bool) *bytes.Buffer {
+	out := &bytes.Buffer{}
+
+	var family, help, kind string
+	groups := make(map[string][]string)
+	flush := func() {
+		for _, direction := range []string{"", "smtp-in", "smtp-out"} {
+			samples := groups[direction]
+			if len(samples) == 0 {
+				continue
+			}
+			name := family
+			if direction != "" {
+				name = directionPrefixes[direction] + strings.TrimPrefix(family, "smtpd_")
+			}
+			out.WriteString("# HELP " + name + " " + help + "\n")
+			out.WriteString("# TYPE " + name + " " + kind + "\n")
+			for _, sample := range samples {
+				out.WriteString(sample + "\n")
+			}
+			if !openMetrics {
+				out.WriteString("\n")
+			}
+		}
+		groups = make(map[string][]string)
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			flush()
+			fields := strings.SplitN(strings.TrimPrefix(line, "# HELP "), " ", 2)
+			family, help = fields[0], ""
+			if len(fields) == 2 {
+				help = fields[1]
+			}
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(line)
+			kind = fields[len(fields)-1]
+		case line == "# EOF":
+			flush()
+			out.WriteString(line + "\n")
+		case line == "":
+		default:
+			name, labels, rest := splitSeries(line)
+			labels, direction := withoutDirection(labels)
+			if _, ok := directionPrefixes[direction]; !ok || !strings.HasPrefix(name, "smtpd_") {
+				groups[""] = append(groups[""], line)
+				continue
+			}
+			name = directionPrefixes[direction] + strings.TrimPrefix(name, "smtpd_")
+			if labels != "" {
+				name += "{" + labels + "}"
+			}
+			groups[direction] = append(groups[direction], name+rest)
+		}
+	}
+	flush()
+	return out
+}
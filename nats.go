@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsConn is a minimal NATS publisher speaking the text protocol, it
+// reconnects lazily on the next publish after a failure.
+type natsConn struct {
+	sync.Mutex
+	url  *url.URL
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func newNATSConn(rawurl string) (*natsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("%s: unsupported scheme", rawurl)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return &natsConn{url: u}, nil
+}
+
+func (n *natsConn) connect() error {
+	conn, err := net.DialTimeout("tcp", n.url.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// the server greets with an INFO line before anything else
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return errors.New("nats: unexpected greeting")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "filter-prometheus",
+	}
+	if user := n.url.User; user != nil {
+		if password, ok := user.Password(); ok {
+			options["user"] = user.Username()
+			options["pass"] = password
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	n.conn = conn
+	n.w = bufio.NewWriter(conn)
+	fmt.Fprintf(n.w, "CONNECT %s\r\n", data)
+	if err := n.w.Flush(); err != nil {
+		n.close()
+		return err
+	}
+
+	go n.read(conn, r)
+	return nil
+}
+
+// read answers the server's keepalives and reports its errors.
+func (n *natsConn) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			n.Lock()
+			if n.conn == conn {
+				n.w.WriteString("PONG\r\n")
+				n.w.Flush()
+			}
+			n.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("nats: %s", line)
+		}
+	}
+
+	n.Lock()
+	if n.conn == conn {
+		n.close()
+	}
+	n.Unlock()
+}
+
+func (n *natsConn) close() {
+	n.conn.Close()
+	n.conn = nil
+	n.w = nil
+}
+
+func (n *natsConn) publish(subject string, payload []byte) error {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(n.w, "PUB %s %d\r\n", subject, len(payload))
+	n.w.Write(payload)
+	n.w.WriteString("\r\n")
+	if err := n.w.Flush(); err != nil {
+		n.close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var maxOffenders *int
+var offenderAuthFailures *int
+var offenderTTL *time.Duration
+var offendersFile *string
+
+var offendersLog *os.File
+
+type offender struct {
+	IP           string    `json:"ip"`
+	Reasons      []string  `json:"reasons"`
+	AuthFailures uint64    `json:"auth_failures"`
+	EarlyTalker  uint64    `json:"early_talker"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+func (o *offender) listed() bool {
+	return len(o.Reasons) != 0
+}
+
+func (o *offender) hasReason(reason string) bool {
+	for _, r := range o.Reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+var offenders = struct {
+	sync.Mutex
+	table map[string]*offender
+}{table: make(map[string]*offender)}
+
+func offendersInit() {
+	if *offendersFile == "" {
+		return
+	}
+	fp, err := os.OpenFile(*offendersFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Fatal(err)
+	}
+	offendersLog = fp
+}
+
+// expireOffenders must be called with the offenders lock held.
+func expireOffenders(now time.Time) {
+	for ip, o := range offenders.table {
+		if now.Sub(o.LastSeen) > *offenderTTL {
+			delete(offenders.table, ip)
+		}
+	}
+}
+
+func getOffender(ip string, now time.Time) *offender {
+	o, ok := offenders.table[ip]
+	if ok {
+		o.LastSeen = now
+		return o
+	}
+	if len(offenders.table) >= *maxOffenders {
+		expireOffenders(now)
+		if len(offenders.table) >= *maxOffenders {
+			return nil
+		}
+	}
+	o = &offender{IP: ip, FirstSeen: now, LastSeen: now}
+	offenders.table[ip] = o
+	return o
+}
+
+// offenderNotables maps listing reasons to the notable event they raise.
+var offenderNotables = map[string]string{
+	"auth-failures": "auth_brute_force",
+	"early-talker":  "early_talker",
+}
+
+// listOffender must be called with the offenders lock held.
+func listOffender(o *offender, reason string, now time.Time) {
+	if o.hasReason(reason) {
+		return
+	}
+	o.Reasons = append(o.Reasons, reason)
+
+	if offendersLog != nil {
+		// fail2ban: failregex = ^\S+ offender <HOST> reason=\S+$
+		fmt.Fprintf(offendersLog, "%s offender %s reason=%s\n", now.UTC().Format(time.RFC3339), o.IP, reason)
+	}
+	firewallAdd(o.IP, reason)
+	notable(now, offenderNotables[reason], map[string]string{"ip": o.IP, "reason": reason})
+}
+
+func offenderAuthFailure(ip string) {
+	offenders.Lock()
+	defer offenders.Unlock()
+
+	now := time.Now()
+	o := getOffender(ip, now)
+	if o == nil {
+		return
+	}
+	o.AuthFailures++
+	if o.AuthFailures >= uint64(*offenderAuthFailures) {
+		listOffender(o, "auth-failures", now)
+	}
+}
+
+func offenderEarlyTalker(ip string) {
+	offenders.Lock()
+	defer offenders.Unlock()
+
+	now := time.Now()
+	o := getOffender(ip, now)
+	if o == nil {
+		return
+	}
+	o.EarlyTalker++
+	listOffender(o, "early-talker", now)
+}
+
+func listedOffenders() []offender {
+	offenders.Lock()
+	defer offenders.Unlock()
+
+	expireOffenders(time.Now())
+
+	list := make([]offender, 0)
+	for _, o := range offenders.table {
+		if o.listed() {
+			list = append(list, *o)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IP < list[j].IP
+	})
+	return list
+}
+
+func offendersHandler(w http.ResponseWriter, r *http.Request) {
+	list := listedOffenders()
+	if private() {
+		for i := range list {
+			list[i].IP = privateIP(list[i].IP)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func offendersCollector(e *exposition) {
+	e.header("smtpd_offenders", "The number of listed offenders.", "gauge", nil)
+	e.sample("smtpd_offenders", "", float64(len(listedOffenders())))
+	e.end()
+}
@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var otlpURL *string
+var otlpSampleRatio *float64
+var otlpSampleFailed *bool
+
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID    string          `json:"traceId"`
+	SpanID     string          `json:"spanId"`
+	Name       string          `json:"name"`
+	Kind       int             `json:"kind"`
+	Start      string          `json:"startTimeUnixNano"`
+	End        string          `json:"endTimeUnixNano"`
+	Attributes []otlpAttribute `json:"attributes"`
+	Status     struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// sampled makes the head-based decision of the trace ratio sampler: the
+// trace ID is compared to the ratio so that every span of a trace gets
+// the same decision. Failed transactions may be kept regardless.
+func sampled(traceID []byte, failed bool) bool {
+	if failed && *otlpSampleFailed {
+		return true
+	}
+	if *otlpSampleRatio >= 1 {
+		return true
+	}
+	bound := uint64(*otlpSampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+func newSpan(r *txRecord) *otlpSpan {
+	ids := make([]byte, 24)
+	rand.Read(ids)
+	if !sampled(ids[:16], r.Result != "commit") {
+		return nil
+	}
+
+	span := &otlpSpan{
+		TraceID: hex.EncodeToString(ids[:16]),
+		SpanID:  hex.EncodeToString(ids[16:]),
+		Name:    r.Direction + " " + r.Result,
+		Start:   strconv.FormatInt(r.BeganAt.UnixNano(), 10),
+		End:     strconv.FormatInt(r.EndedAt.UnixNano(), 10),
+	}
+	// server for mail received, client for mail relayed
+	span.Kind = 2
+	if r.Direction == "smtp-out" {
+		span.Kind = 3
+	}
+	// unset for commits, error for rollbacks
+	if r.Result != "commit" {
+		span.Status.Code = 2
+	}
+
+	attribute := func(key string, value string) {
+		if value != "" {
+			span.Attributes = append(span.Attributes, otlpAttribute{key, otlpValue{StringValue: value}})
+		}
+	}
+	attribute("smtp.session", r.Session)
+	attribute("smtp.message_id", r.Message)
+	attribute("smtp.direction", r.Direction)
+	attribute("smtp.role", r.Role)
+	attribute("smtp.sender_domain", r.Sender)
+	attribute("smtp.recipient_domains", recordDomains(r))
+	span.Attributes = append(span.Attributes,
+		otlpAttribute{"smtp.recipients", otlpValue{IntValue: strconv.FormatUint(r.Recipients, 10)}},
+		otlpAttribute{"smtp.size", otlpValue{IntValue: strconv.FormatUint(r.Size, 10)}})
+	return span
+}
+
+func otlpInit() {
+	if *otlpURL == "" {
+		return
+	}
+	if *otlpSampleRatio < 0 || *otlpSampleRatio > 1 {
+		log.Fatalf("invalid sample ratio: %v", *otlpSampleRatio)
+	}
+	endpoint := strings.TrimSuffix(*otlpURL, "/") + "/v1/traces"
+	client := &http.Client{Timeout: 10 * time.Second}
+	spans := []*otlpSpan{}
+
+	flush := func() error {
+		if len(spans) == 0 {
+			return nil
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"resourceSpans": []interface{}{map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{{"service.name", otlpValue{StringValue: "smtpd"}}},
+				},
+				"scopeSpans": []interface{}{map[string]interface{}{
+					"scope": map[string]string{"name": "filter-prometheus"},
+					"spans": spans,
+				}},
+			}},
+		})
+		spans = spans[:0]
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(endpoint, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s: %s", endpoint, resp.Status)
+		}
+		return nil
+	}
+	write := func(r interface{}) error {
+		if r, ok := r.(*txRecord); ok {
+			if span := newSpan(r); span != nil {
+				spans = append(spans, span)
+			}
+		}
+		if len(spans) < 512 {
+			return nil
+		}
+		return flush()
+	}
+	addBatchSink("otlp", []string{"transaction"}, write, flush)
+}
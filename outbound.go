@@ -0,0 +1,271 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var maxDeferred *int
+var smtpctl *string
+var queuePoll *time.Duration
+var deferredExpiry *time.Duration
+var deliveryFailureSpike *int
+
+var outboundFailures = struct {
+	sync.Mutex
+	relays map[string]uint64
+}{relays: make(map[string]uint64)}
+
+type deferral struct {
+	firstSeen time.Time
+	attempts  uint64
+}
+
+// deferred keeps track of envelopes that smtp-out failed to deliver so
+// that the total delivery time, retries included, can be computed once
+// they are eventually delivered.
+var deferred = struct {
+	sync.Mutex
+	envelopes map[string]*deferral
+	expired   uint64
+	attempts  *histogram
+	duration  *histogram
+}{
+	envelopes: make(map[string]*deferral),
+	attempts:  newHistogram(1, 2, 3, 5, 10, 20, 50),
+	duration:  newHistogram(1, 10, 60, 300, 900, 3600, 4*3600, 12*3600, 24*3600, 3*24*3600, 7*24*3600),
+}
+
+// deliveryDeferred is called on smtp-out rollbacks, envelopes that got a
+// permanent error won't be retried and are forgotten.
+func deliveryDeferred(envelopes []string, now time.Time, permanent bool) {
+	deferred.Lock()
+	defer deferred.Unlock()
+
+	for _, evpid := range envelopes {
+		if permanent {
+			if _, ok := deferred.envelopes[evpid]; ok {
+				delete(deferred.envelopes, evpid)
+				deferred.expired++
+			}
+			continue
+		}
+		d, ok := deferred.envelopes[evpid]
+		if !ok {
+			if len(deferred.envelopes) >= *maxDeferred {
+				continue
+			}
+			d = &deferral{firstSeen: now}
+			deferred.envelopes[evpid] = d
+		}
+		d.attempts++
+	}
+}
+
+func deliveryDone(envelopes []string, now time.Time) {
+	deferred.Lock()
+	defer deferred.Unlock()
+
+	for _, evpid := range envelopes {
+		attempts, duration := uint64(1), float64(0)
+		if d, ok := deferred.envelopes[evpid]; ok {
+			attempts += d.attempts
+			duration = now.Sub(d.firstSeen).Seconds()
+			delete(deferred.envelopes, evpid)
+		}
+		deferred.attempts.observe(float64(attempts))
+		deferred.duration.observe(duration)
+	}
+}
+
+// queuePoller forgets deferred envelopes that left the queue without being
+// delivered (bounced or expired), according to smtpctl show queue.
+func queuePoller() {
+	for range time.Tick(*queuePoll) {
+		out, err := exec.Command(*smtpctl, "show", "queue").Output()
+		if err != nil {
+			log.Printf("%s show queue: %v", *smtpctl, err)
+			continue
+		}
+
+		queued := make(map[string]bool)
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), "|", 2)
+			queued[fields[0]] = true
+		}
+
+		deferred.Lock()
+		for evpid := range deferred.envelopes {
+			if !queued[evpid] {
+				delete(deferred.envelopes, evpid)
+				deferred.expired++
+			}
+		}
+		deferred.Unlock()
+	}
+}
+
+// deferredExpirer forgets deferred envelopes that were first seen longer
+// ago than smtpd keeps envelopes in its queue, -queue-poll telling more
+// precisely when they leave it.
+func deferredExpirer() {
+	for now := range time.Tick(time.Minute) {
+		deferred.Lock()
+		for evpid, d := range deferred.envelopes {
+			if now.Sub(d.firstSeen) > *deferredExpiry {
+				delete(deferred.envelopes, evpid)
+				deferred.expired++
+			}
+		}
+		deferred.Unlock()
+	}
+}
+
+func outboundInit() {
+	if *queuePoll > 0 {
+		go queuePoller()
+	}
+	if *deferredExpiry > 0 {
+		go deferredExpirer()
+	}
+}
+
+// outboundConnectFailure is called for smtp-out sessions that ended
+// before the remote server displayed its banner.
+func outboundConnectFailure(s *session) {
+	if s.failed {
+		return
+	}
+	s.failed = true
+
+	deliveryFailure(s.timestamp)
+
+	relay, ok := bucketOf("relays", s.relay)
+	if !ok {
+		relay, ok = dynamicLabel("smtpd_outbound_connect_failures_total", privateHost(s.relay))
+	}
+	if !ok {
+		return
+	}
+
+	outboundFailures.Lock()
+	defer outboundFailures.Unlock()
+	outboundFailures.relays[relay]++
+}
+
+// outbound sessions per TLS verification result, none being plaintext
+// sessions, protected by metricsLock.
+var tlsVerifyResults = []string{"verified", "unverified", "failed", "unknown", "none"}
+var outboundTLSVerify = make(map[string]uint64)
+
+// tlsVerifyResult classifies the verification reported in smtp-out link-tls
+// parameters, smtpd versions not reporting it are accounted as unknown.
+func tlsVerifyResult(params string) string {
+	value := tlsParam(params, "verified")
+	if value == "" {
+		value = tlsParam(params, "verify")
+	}
+	switch strings.ToLower(value) {
+	case "":
+		return "unknown"
+	case "yes", "ok", "true", "success", "verified":
+		return "verified"
+	case "no", "none", "false", "unverified":
+		return "unverified"
+	}
+	return "failed"
+}
+
+// deliveryFailures over the last 5 minutes raise a notable event when
+// they reach -delivery-failure-spike, and again once they went back under
+// half of it.
+var deliveryFailures = newWindow(5 * time.Minute)
+var deliverySpiking bool
+
+func deliveryFailure(now time.Time) {
+	if *deliveryFailureSpike == 0 {
+		return
+	}
+	deliveryFailures.add(now, 1)
+	failures := deliveryFailures.sum(now)
+	if !deliverySpiking && failures >= uint64(*deliveryFailureSpike) {
+		deliverySpiking = true
+		notable(now, "delivery_failure_spike", map[string]string{
+			"failures": strconv.FormatUint(failures, 10),
+			"window":   "5m",
+		})
+	} else if deliverySpiking && failures < uint64(*deliveryFailureSpike)/2 {
+		deliverySpiking = false
+	}
+}
+
+func outboundCollector(e *exposition) {
+	outboundFailures.Lock()
+	relays := make([]string, 0, len(outboundFailures.relays))
+	for relay := range outboundFailures.relays {
+		relays = append(relays, relay)
+	}
+	sort.Strings(relays)
+
+	e.header("smtpd_outbound_connect_failures_total", "The number of outbound connections that never got a banner.", "counter", []*metrics{&smtpOut}, "relay")
+	for _, relay := range relays {
+		e.sample("smtpd_outbound_connect_failures_total", smtpOut.labels()+","+label("relay", relay), float64(outboundFailures.relays[relay]))
+	}
+	e.end()
+
+	e.header("smtpd_outbound_tls_verify_total", "The number of outbound sessions per TLS certificate verification result.", "counter", []*metrics{&smtpOut}, "result")
+	for _, result := range tlsVerifyResults {
+		e.sample("smtpd_outbound_tls_verify_total", smtpOut.labels()+","+label("result", result), float64(outboundTLSVerify[result]))
+	}
+	e.end()
+
+	e.header("smtpd_outbound_deferral_category_total", "The number of failed outbound transactions per category of remote error.", "counter", []*metrics{&smtpOut}, "category")
+	for _, category := range deferralCategories {
+		e.sample("smtpd_outbound_deferral_category_total", smtpOut.labels()+","+label("category", category), float64(outboundDeferrals[category]))
+	}
+	e.end()
+	outboundFailures.Unlock()
+
+	deferred.Lock()
+	defer deferred.Unlock()
+
+	e.header("smtpd_deferred_envelopes", "The number of envelopes waiting for a delivery retry.", "gauge", []*metrics{&smtpOut})
+	e.sample("smtpd_deferred_envelopes", smtpOut.labels(), float64(len(deferred.envelopes)))
+	e.end()
+
+	e.header("smtpd_deferred_envelopes_expired_total", "The number of deferred envelopes that left the queue undelivered.", "counter", []*metrics{&smtpOut})
+	e.sample("smtpd_deferred_envelopes_expired_total", smtpOut.labels(), float64(deferred.expired))
+	e.end()
+
+	e.header("smtpd_delivery_attempts", "The number of attempts it took to deliver an envelope.", "histogram", []*metrics{&smtpOut})
+	e.histogram("smtpd_delivery_attempts", smtpOut.labels(), deferred.attempts)
+	e.end()
+
+	e.header("smtpd_delivery_duration_seconds", "The time it took to deliver an envelope, retries included.", "histogram", []*metrics{&smtpOut})
+	e.histogram("smtpd_delivery_duration_seconds", smtpOut.labels(), deferred.duration)
+	e.end()
+}
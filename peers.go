@@ -0,0 +1,219 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var maxPeers *int
+var topPeers *int
+var proxyPortsList *string
+var proxiesList *string
+
+// addresses of the proxies (HAProxy, ...) smtpd runs behind, the address
+// they report isn't the client's and must not feed per-address metrics.
+var proxyNetworks []*net.IPNet
+
+// source ports of well-known proxies, a hint of NAT gateways and open
+// proxies hammering the MX.
+var proxyPorts []string
+
+func peersInit() {
+	for _, port := range strings.Split(*proxyPortsList, ",") {
+		if port == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			log.Fatalf("invalid proxy port: %s", port)
+		}
+		proxyPorts = append(proxyPorts, port)
+	}
+
+	for _, proxy := range strings.Split(*proxiesList, ",") {
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Fatalf("invalid proxy: %s", proxy)
+		}
+		proxyNetworks = append(proxyNetworks, network)
+	}
+
+	for _, m := range metricSets {
+		m.sessionsProxyPort = newBuckets(proxyPorts)
+	}
+}
+
+func isProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range proxyNetworks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourcePort accounts for the client source port of smtp-in sessions.
+func sourcePort(m *metrics, address string) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+	if n < 1024 {
+		m.sessionsPrivilegedPort++
+	}
+	if _, ok := m.sessionsProxyPort[port]; ok {
+		m.sessionsProxyPort[port]++
+	}
+}
+
+// peerTable tracks the number of concurrent sessions per peer address,
+// it is bounded so that a connection flood can't exhaust memory.
+type peerTable struct {
+	sync.Mutex
+	active   map[string]uint64
+	overflow uint64
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{active: make(map[string]uint64)}
+}
+
+func (p *peerTable) reset() {
+	p.Lock()
+	defer p.Unlock()
+	p.active = make(map[string]uint64)
+}
+
+func (p *peerTable) connect(ip string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.active[ip]; !ok && len(p.active) >= *maxPeers {
+		p.overflow++
+		return false
+	}
+	p.active[ip]++
+	return true
+}
+
+func (p *peerTable) disconnect(ip string) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.active[ip] <= 1 {
+		delete(p.active, ip)
+		return
+	}
+	p.active[ip]--
+}
+
+type peerCount struct {
+	ip    string
+	count uint64
+}
+
+func (p *peerTable) snapshot() []peerCount {
+	p.Lock()
+	defer p.Unlock()
+
+	peers := make([]peerCount, 0, len(p.active))
+	for ip, count := range p.active {
+		peers = append(peers, peerCount{ip, count})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].count != peers[j].count {
+			return peers[i].count > peers[j].count
+		}
+		return peers[i].ip < peers[j].ip
+	})
+	return peers
+}
+
+func peersCollector(e *exposition) {
+	snapshots := make(map[*metrics][]peerCount)
+	for _, m := range e.sets {
+		snapshots[m] = m.peers.snapshot()
+	}
+
+	e.header("smtpd_sessions_per_ip", "The distribution of concurrent sessions per peer address.", "histogram", e.sets)
+	for _, m := range e.sets {
+		h := newHistogram(1, 2, 5, 10, 20, 50, 100)
+		for _, peer := range snapshots[m] {
+			h.observe(float64(peer.count))
+		}
+		e.histogram("smtpd_sessions_per_ip", m.labels(), h)
+	}
+	e.end()
+
+	e.header("smtpd_sessions_per_ip_top", "The number of concurrent sessions of the top peer addresses.", "gauge", e.sets, "ip")
+	for _, m := range e.sets {
+		for i, peer := range privatePeers(snapshots[m]) {
+			if i == *topPeers {
+				break
+			}
+			e.sample("smtpd_sessions_per_ip_top", m.labels()+","+label("ip", peer.ip), float64(peer.count))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_sessions_privileged_port_total", "The number of sessions from a privileged source port.", "counter", e.inbound())
+	for _, m := range e.inbound() {
+		e.sample("smtpd_sessions_privileged_port_total", m.labels(), float64(m.sessionsPrivilegedPort))
+	}
+	e.end()
+
+	e.header("smtpd_sessions_proxy_port_total", "The number of sessions from a known proxy source port.", "counter", e.inbound(), "port")
+	for _, m := range e.inbound() {
+		for _, port := range proxyPorts {
+			e.sample("smtpd_sessions_proxy_port_total", m.labels()+","+label("port", port), float64(m.sessionsProxyPort[port]))
+		}
+	}
+	e.end()
+
+	e.counter("smtpd_proxied_sessions_total", "The number of sessions coming through a known proxy.",
+		func(m *metrics) uint64 { return m.sessionsProxied })
+
+	e.counter("smtpd_sessions_per_ip_overflow_total", "The number of sessions not tracked because the peer table was full.",
+		func(m *metrics) uint64 {
+			m.peers.Lock()
+			defer m.peers.Unlock()
+			return m.peers.overflow
+		})
+}
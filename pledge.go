@@ -0,0 +1,173 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/x509"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// shimSocket is the socket a shim forwards events to, set by forward.
+var shimSocket string
+
+// hardeningPreload opens what the standard library opens lazily, so that
+// it needn't be unveiled.
+func hardeningPreload() {
+	time.Now().Zone()
+	x509.SystemCertPool()
+}
+
+// hardening returns the pledge(2) promises and unveil(2) permissions per
+// path the enabled features need once initialized, files read only at
+// startup are left out.
+func hardening() (string, map[string]string) {
+	promises := map[string]bool{"stdio": true}
+	paths := make(map[string]string)
+	unveil := func(path string, permissions string) {
+		for _, c := range permissions {
+			if !strings.ContainsRune(paths[path], c) {
+				paths[path] += string(c)
+			}
+		}
+	}
+	command := func(name string) {
+		if path, err := exec.LookPath(name); err == nil {
+			unveil(path, "x")
+		}
+		promises["proc"] = true
+		promises["exec"] = true
+		// dynamically linked commands need the runtime linker
+		unveil("/usr/libexec/ld.so", "r")
+	}
+	client := func() {
+		promises["inet"] = true
+		promises["dns"] = true
+		unveil("/etc/resolv.conf", "r")
+		unveil("/etc/hosts", "r")
+	}
+	directory := func(path string) {
+		promises["rpath"] = true
+		promises["wpath"] = true
+		promises["cpath"] = true
+		unveil(filepath.Dir(path), "rwc")
+	}
+
+	if shimSocket != "" {
+		promises["unix"] = true
+		unveil(shimSocket, "rw")
+		return joinPromises(promises), paths
+	}
+
+	promises["inet"] = true
+	if exporterDeferred() {
+		client()
+	}
+	if *exporterFile != "" {
+		directory(*exporterFile)
+	}
+	if *handoffFile != "" {
+		directory(*handoffFile)
+		promises["unix"] = true
+		promises["sendfd"] = true
+	}
+	if daemonMode() {
+		promises["unix"] = true
+	}
+
+	if *syslogTarget != "" {
+		if u, err := url.Parse(*syslogTarget); err == nil && u.Scheme == "unix" {
+			promises["unix"] = true
+			unveil(u.Path, "w")
+		} else {
+			client()
+		}
+	}
+	for _, target := range []string{*siemTarget, *publishNATS, *publishKafka, *reportS3, *lokiURL, *otlpURL, *pushURL} {
+		if target != "" {
+			client()
+		}
+	}
+	if len(tlsProbes) != 0 || len(probes) != 0 || len(dnsDomains) != 0 || *dane {
+		client()
+	}
+
+	for _, path := range tlsCerts {
+		promises["rpath"] = true
+		unveil(path, "r")
+	}
+	if *reputationReload > 0 {
+		for _, path := range reputationFiles {
+			promises["rpath"] = true
+			unveil(path, "r")
+		}
+	}
+	if *spoolPath != "" {
+		promises["rpath"] = true
+		unveil(*spoolPath, "r")
+	}
+	if *offendersFile != "" {
+		promises["wpath"] = true
+		promises["cpath"] = true
+		unveil(*offendersFile, "wc")
+	}
+	if *reportDir != "" {
+		promises["rpath"] = true
+		promises["wpath"] = true
+		promises["cpath"] = true
+		unveil(*reportDir, "rwc")
+	}
+	if *archivePath != "" {
+		directory(*archivePath)
+		promises["flock"] = true
+	}
+
+	if *queuePoll > 0 {
+		command(*smtpctl)
+	}
+	switch *firewall {
+	case "pf":
+		command("pfctl")
+	case "nft":
+		command("nft")
+	}
+	if len(plugins) != 0 {
+		command("/bin/sh")
+	}
+	if *selftestInterval > 0 {
+		command(*selftestSendmail)
+	}
+	if *processMetrics && runtime.GOOS == "openbsd" {
+		command("ps")
+	}
+
+	return joinPromises(promises), paths
+}
+
+func joinPromises(promises map[string]bool) string {
+	list := []string{}
+	for promise := range promises {
+		list = append(list, promise)
+	}
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
@@ -0,0 +1,57 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+//go:build openbsd && pledge
+// +build openbsd,pledge
+
+package main
+
+import (
+	"log"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	registerFeature("pledge")
+}
+
+// harden restricts the filter to what the enabled features need, it is
+// called once everything opened at startup is.
+func harden() {
+	hardeningPreload()
+	promises, paths := hardening()
+
+	list := []string{}
+	for path := range paths {
+		list = append(list, path)
+	}
+	sort.Strings(list)
+	for _, path := range list {
+		if err := unix.Unveil(path, paths[path]); err != nil {
+			log.Fatalf("unveil %s: %v", path, err)
+		}
+	}
+	if err := unix.UnveilBlock(); err != nil {
+		log.Fatalf("unveil: %v", err)
+	}
+	// execpromises are left unset, the programs the filter runs are not
+	// restricted by its own promises
+	if err := unix.PledgePromises(promises); err != nil {
+		log.Fatalf("pledge %s: %v", promises, err)
+	}
+}
@@ -0,0 +1,67 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"time"
+)
+
+// Event is a report event as passed to custom collectors.
+type Event struct {
+	Timestamp time.Time `json:"timestamp"`
+	Direction string    `json:"direction"`
+	Role      string    `json:"role,omitempty"`
+	Name      string    `json:"event"`
+	Session   string    `json:"session"`
+	Params    []string  `json:"params"`
+}
+
+// Collector is implemented by collectors compiled in by downstream users,
+// in a file of their own, without touching the event loop. Event is called
+// for every report event after the built-in metrics were updated, with the
+// metrics lock held for writing, and Collect on every scrape with it held
+// for reading: neither may block.
+type Collector interface {
+	Name() string
+	Event(ev *Event)
+	Collect(e *exposition)
+}
+
+var customCollectors []Collector
+
+// RegisterCollector is meant to be called from an init function.
+func RegisterCollector(c Collector) {
+	registerCollector(c.Name(), c.Collect)
+	customCollectors = append(customCollectors, c)
+}
+
+func dispatchEvent(s *session, atoms []string, params []string) {
+	if len(customCollectors) == 0 {
+		return
+	}
+	ev := &Event{
+		Timestamp: s.timestamp,
+		Direction: atoms[3],
+		Role:      s.role,
+		Name:      atoms[4],
+		Session:   s.id,
+		Params:    privateParams(atoms[4], params),
+	}
+	for _, c := range customCollectors {
+		c.Event(ev)
+	}
+}
@@ -0,0 +1,272 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// privacy is how IP addresses and local parts are exposed: off, truncate
+// (networks and domains only) or hash (keyed pseudonyms).
+var privacy *string
+var privacyKeyFile *string
+
+var privacyKey []byte
+
+func privacyInit() {
+	switch *privacy {
+	case "off", "truncate":
+	case "hash":
+		// pseudonyms are only stable across restarts with a key file,
+		// unkeyed hashes of IPv4 addresses are trivially reversed
+		if *privacyKeyFile != "" {
+			key, err := ioutil.ReadFile(*privacyKeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			privacyKey = key
+		} else {
+			privacyKey = make([]byte, 32)
+			if _, err := rand.Read(privacyKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+	default:
+		log.Fatalf("invalid privacy mode: %s", *privacy)
+	}
+}
+
+func private() bool {
+	return *privacy != "off"
+}
+
+func pseudonym(value string) string {
+	mac := hmac.New(sha256.New, privacyKey)
+	mac.Write([]byte(value))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// privateIP masks IPv4 addresses to their /24 and IPv6 ones to their /48.
+func privateIP(ip string) string {
+	if !private() {
+		return ip
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if *privacy == "hash" {
+		return pseudonym(addr.String())
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// privateHost masks hosts that are IP addresses, names are left as is.
+func privateHost(host string) string {
+	if net.ParseIP(host) == nil {
+		return host
+	}
+	return privateIP(host)
+}
+
+// privateHostPort masks a link-connect address, ports are dropped as they
+// identify a client behind a NAT as well.
+func privateHostPort(address string) string {
+	if !private() || strings.HasPrefix(address, "unix:") {
+		return address
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return privateHost(address)
+	}
+	return privateIP(host)
+}
+
+// privateAddress hides the local part of an email address.
+func privateAddress(address string) string {
+	if !private() {
+		return address
+	}
+	bracketed := strings.HasPrefix(address, "<") && strings.HasSuffix(address, ">")
+	inner := strings.TrimSuffix(strings.TrimPrefix(address, "<"), ">")
+	if inner == "" {
+		return address
+	}
+
+	domain := addressDomain(inner)
+	local := "*"
+	if *privacy == "hash" {
+		local = pseudonym(strings.ToLower(inner))
+	}
+	if domain != "" {
+		local += "@" + domain
+	}
+	if bracketed {
+		return "<" + local + ">"
+	}
+	return local
+}
+
+// privateUser hides an authentication user name.
+func privateUser(user string) string {
+	if !private() || user == "" {
+		return user
+	}
+	if strings.Contains(user, "@") {
+		return privateAddress(user)
+	}
+	if *privacy == "hash" {
+		return pseudonym(user)
+	}
+	return "*"
+}
+
+// privateHelo masks HELO names that are address literals.
+func privateHelo(name string) string {
+	if !strings.HasPrefix(name, "[") || !strings.HasSuffix(name, "]") {
+		return privateHost(name)
+	}
+	literal := strings.TrimPrefix(strings.Trim(name, "[]"), "IPv6:")
+	return "[" + privateHost(literal) + "]"
+}
+
+var bracketedAddress = regexp.MustCompile(`<[^<>]*>`)
+
+// privateAddresses hides the bracketed addresses in a command or response.
+func privateAddresses(line string) string {
+	return bracketedAddress.ReplaceAllStringFunc(line, privateAddress)
+}
+
+// privateCommand hides the addresses and credentials in a client command,
+// lines that are no command, such as AUTH exchanges, are hidden as a whole.
+func privateCommand(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return command
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "HELO", "EHLO":
+		if len(fields) > 1 {
+			return fields[0] + " " + privateHelo(fields[1])
+		}
+	case "MAIL", "RCPT":
+		if i := strings.IndexByte(command, ':'); i != -1 && !strings.Contains(command, "<") {
+			return command[:i+1] + "*"
+		}
+		return privateAddresses(command)
+	case "AUTH":
+		// the initial response holds the credentials
+		if len(fields) > 2 {
+			return fields[0] + " " + fields[1] + " *"
+		}
+	case "VRFY", "EXPN":
+		return fields[0] + " *"
+	case "DATA", "RSET", "QUIT", "NOOP", "STARTTLS", "HELP", "BDAT":
+	default:
+		return "*"
+	}
+	return command
+}
+
+// privateParams hides the addresses in the parameters of a report event.
+func privateParams(event string, params []string) []string {
+	if !private() {
+		return params
+	}
+	scrubbed := append([]string{}, params...)
+	switch event {
+	case "link-connect":
+		for i := 2; i < len(scrubbed) && i < 4; i++ {
+			scrubbed[i] = privateHostPort(scrubbed[i])
+		}
+	case "link-identify":
+		if len(scrubbed) > 1 {
+			scrubbed[1] = privateHelo(scrubbed[1])
+		}
+	case "link-auth":
+		if len(scrubbed) > 0 {
+			scrubbed[0] = privateUser(scrubbed[0])
+		}
+	case "protocol-client":
+		if len(scrubbed) > 0 {
+			scrubbed[0] = privateCommand(scrubbed[0])
+		}
+	case "protocol-server":
+		if len(scrubbed) > 0 {
+			scrubbed[0] = privateAddresses(scrubbed[0])
+		}
+	case "filter-response":
+		if len(scrubbed) > 2 {
+			scrubbed[2] = privateAddresses(scrubbed[2])
+		}
+	case "tx-mail", "tx-rcpt":
+		if len(scrubbed) > 2 {
+			scrubbed[2] = privateAddress(scrubbed[2])
+		}
+	}
+	return scrubbed
+}
+
+// privateFields hides the addresses in the fields of a notable record.
+func privateFields(fields map[string]string) map[string]string {
+	if !private() {
+		return fields
+	}
+	for key, value := range fields {
+		switch key {
+		case "ip":
+			fields[key] = privateIP(value)
+		case "user":
+			fields[key] = privateUser(value)
+		}
+	}
+	return fields
+}
+
+// privatePeers merges the peers that are indistinguishable once masked.
+func privatePeers(peers []peerCount) []peerCount {
+	if !private() {
+		return peers
+	}
+	merged := make(map[string]uint64)
+	for _, peer := range peers {
+		merged[privateIP(peer.ip)] += peer.count
+	}
+	peers = make([]peerCount, 0, len(merged))
+	for ip, count := range merged {
+		peers = append(peers, peerCount{ip, count})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].count != peers[j].count {
+			return peers[i].count > peers[j].count
+		}
+		return peers[i].ip < peers[j].ip
+	})
+	return peers
+}
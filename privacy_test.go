@@ -0,0 +1,49 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+func TestPrivateCommand(t *testing.T) {
+	testInit()
+	*privacy = "truncate"
+	defer func() { *privacy = "off" }()
+
+	tests := []struct {
+		command string
+		private string
+	}{
+		{"EHLO mail.example.org", "EHLO mail.example.org"},
+		{"EHLO [192.0.2.1]", "EHLO [192.0.2.0/24]"},
+		{"MAIL FROM:<alice@example.org> SIZE=4242", "MAIL FROM:<*@example.org> SIZE=4242"},
+		{"RCPT TO:<bob@example.com>", "RCPT TO:<*@example.com>"},
+		{"MAIL FROM:<>", "MAIL FROM:<>"},
+		{"MAIL FROM:alice@example.org", "MAIL FROM:*"},
+		{"AUTH PLAIN AGFsaWNlAHNlY3JldA==", "AUTH PLAIN *"},
+		{"AUTH LOGIN", "AUTH LOGIN"},
+		{"YWxpY2U=", "*"},
+		{"VRFY alice", "VRFY *"},
+		{"DATA", "DATA"},
+	}
+	for _, test := range tests {
+		if private := privateCommand(test.command); private != test.private {
+			t.Errorf("privateCommand(%q) = %q, want %q", test.command, private, test.private)
+		}
+	}
+}
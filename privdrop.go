@@ -0,0 +1,79 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+var runUser *string
+var runGroup *string
+var chrootDir *string
+
+// dropPrivileges chroots and switches to an unprivileged user once the
+// exporter and the daemon socket are bound and startup files are read.
+func dropPrivileges() {
+	if *runUser == "" && *runGroup == "" && *chrootDir == "" {
+		return
+	}
+
+	uid, gid := -1, -1
+	if *runUser != "" {
+		u, err := user.Lookup(*runUser)
+		if err != nil {
+			log.Fatal(err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if *runGroup != "" {
+		g, err := user.LookupGroup(*runGroup)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if *chrootDir != "" {
+		// the time zone and CA certificates aren't found in the chroot
+		hardeningPreload()
+		if err := syscall.Chroot(*chrootDir); err != nil {
+			log.Fatalf("chroot %s: %v", *chrootDir, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			log.Fatalf("setgroups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			log.Fatalf("setgid: %v", err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			log.Fatalf("setuid: %v", err)
+		}
+	}
+}
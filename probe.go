@@ -0,0 +1,111 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var probes = namedValues{}
+var probeInterval *time.Duration
+var probeTimeout *time.Duration
+
+type probeResult struct {
+	success  bool
+	tls      bool
+	duration time.Duration
+}
+
+var probeResults = struct {
+	sync.Mutex
+	listeners map[string]probeResult
+}{listeners: make(map[string]probeResult)}
+
+// probe checks a listener from the outside: banner, EHLO and, when it is
+// offered, a STARTTLS handshake.
+func probe(address string) probeResult {
+	start := time.Now()
+	client, state, err := dialSMTP(address, *probeTimeout)
+	if err != nil {
+		log.Printf("probe %s: %v", address, err)
+		return probeResult{duration: time.Since(start)}
+	}
+	client.Quit()
+
+	return probeResult{
+		success:  true,
+		tls:      state != nil,
+		duration: time.Since(start),
+	}
+}
+
+func prober(listener string, address string) {
+	for {
+		result := probe(address)
+
+		probeResults.Lock()
+		probeResults.listeners[listener] = result
+		probeResults.Unlock()
+
+		time.Sleep(*probeInterval)
+	}
+}
+
+func probeInit() {
+	for listener, address := range probes {
+		go prober(listener, address)
+	}
+}
+
+func probeCollector(e *exposition) {
+	probeResults.Lock()
+	defer probeResults.Unlock()
+
+	listeners := make([]string, 0, len(probeResults.listeners))
+	for listener := range probeResults.listeners {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+
+	bool2float := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	e.header("smtpd_probe_success", "Whether the last probe of the listener succeeded.", "gauge", nil, "listener")
+	for _, listener := range listeners {
+		e.sample("smtpd_probe_success", label("listener", listener), bool2float(probeResults.listeners[listener].success))
+	}
+	e.end()
+
+	e.header("smtpd_probe_tls", "Whether the last probe of the listener negotiated TLS.", "gauge", nil, "listener")
+	for _, listener := range listeners {
+		e.sample("smtpd_probe_tls", label("listener", listener), bool2float(probeResults.listeners[listener].tls))
+	}
+	e.end()
+
+	e.header("smtpd_probe_duration_seconds", "The duration of the last probe of the listener.", "gauge", nil, "listener")
+	for _, listener := range listeners {
+		e.sample("smtpd_probe_duration_seconds", label("listener", listener), probeResults.listeners[listener].duration.Seconds())
+	}
+	e.end()
+}
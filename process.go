@@ -0,0 +1,100 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+var processMetrics *bool
+
+// procStat is the resource usage of a single smtpd process, the name is
+// the process title set by smtpd ("pony express", "lookup", ...).
+type procStat struct {
+	name   string
+	cpu    float64
+	rss    uint64
+	fds    uint64
+	hasFds bool
+}
+
+func processName(title string) string {
+	if strings.HasPrefix(title, "smtpd: ") {
+		return strings.TrimPrefix(title, "smtpd: ")
+	}
+	return "parent"
+}
+
+func processCollector(e *exposition) {
+	if !*processMetrics {
+		return
+	}
+
+	stats, err := readProcesses()
+	if err != nil {
+		log.Printf("process metrics: %v", err)
+		return
+	}
+
+	usage := make(map[string]*procStat)
+	count := make(map[string]uint64)
+	for _, stat := range stats {
+		u, ok := usage[stat.name]
+		if !ok {
+			u = &procStat{name: stat.name, hasFds: stat.hasFds}
+			usage[stat.name] = u
+		}
+		u.cpu += stat.cpu
+		u.rss += stat.rss
+		u.fds += stat.fds
+		count[stat.name]++
+	}
+
+	names := make([]string, 0, len(usage))
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e.header("smtpd_processes", "The number of smtpd processes.", "gauge", nil, "process")
+	for _, name := range names {
+		e.sample("smtpd_processes", label("process", name), float64(count[name]))
+	}
+	e.end()
+
+	e.header("smtpd_process_cpu_seconds_total", "The CPU time consumed by smtpd processes.", "counter", nil, "process")
+	for _, name := range names {
+		e.sample("smtpd_process_cpu_seconds_total", label("process", name), usage[name].cpu)
+	}
+	e.end()
+
+	e.header("smtpd_process_resident_memory_bytes", "The resident memory of smtpd processes.", "gauge", nil, "process")
+	for _, name := range names {
+		e.sample("smtpd_process_resident_memory_bytes", label("process", name), float64(usage[name].rss))
+	}
+	e.end()
+
+	e.header("smtpd_process_open_fds", "The number of file descriptors opened by smtpd processes.", "gauge", nil, "process")
+	for _, name := range names {
+		if usage[name].hasFds {
+			e.sample("smtpd_process_open_fds", label("process", name), float64(usage[name].fds))
+		}
+	}
+	e.end()
+}
@@ -0,0 +1,91 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// USER_HZ, the unit of utime and stime, is 100 on all supported platforms
+const clockTicks = 100
+
+func readProcess(dir string) (procStat, bool) {
+	comm, err := ioutil.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil || strings.TrimSpace(string(comm)) != "smtpd" {
+		return procStat{}, false
+	}
+
+	stat := procStat{}
+	cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return procStat{}, false
+	}
+	if i := bytes.IndexByte(cmdline, 0); i != -1 {
+		cmdline = cmdline[:i]
+	}
+	stat.name = processName(string(cmdline))
+
+	// the command may contain spaces, fields start after its closing paren
+	data, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return procStat{}, false
+	}
+	if i := bytes.LastIndexByte(data, ')'); i != -1 {
+		fields := strings.Fields(string(data[i+1:]))
+		if len(fields) > 12 {
+			utime, _ := strconv.ParseFloat(fields[11], 64)
+			stime, _ := strconv.ParseFloat(fields[12], 64)
+			stat.cpu = (utime + stime) / clockTicks
+		}
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "statm")); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 1 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			stat.rss = pages * uint64(os.Getpagesize())
+		}
+	}
+
+	if fds, err := ioutil.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		stat.fds = uint64(len(fds))
+		stat.hasFds = true
+	}
+	return stat, true
+}
+
+func readProcesses() ([]procStat, error) {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []procStat{}
+	for _, dir := range dirs {
+		if stat, ok := readProcess(dir); ok {
+			stats = append(stats, stat)
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,69 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+//go:build openbsd
+// +build openbsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// parseCPUTime parses the ps cputime format, [[dd-]hh:]mm:ss.cc
+func parseCPUTime(value string) float64 {
+	days := 0.0
+	if i := strings.IndexByte(value, '-'); i != -1 {
+		days, _ = strconv.ParseFloat(value[:i], 64)
+		value = value[i+1:]
+	}
+
+	seconds := 0.0
+	for _, field := range strings.Split(value, ":") {
+		v, _ := strconv.ParseFloat(field, 64)
+		seconds = seconds*60 + v
+	}
+	return days*86400 + seconds
+}
+
+// there is no /proc on OpenBSD, ps(1) reads the same kvm data we'd need
+// without requiring cgo. File descriptors are not available this way.
+func readProcesses() ([]procStat, error) {
+	out, err := exec.Command("ps", "-axww", "-o", "ucomm=,rss=,cputime=,command=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []procStat{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != "smtpd" {
+			continue
+		}
+		rss, _ := strconv.ParseUint(fields[1], 10, 64)
+		stats = append(stats, procStat{
+			name: processName(strings.Join(fields[3:], " ")),
+			cpu:  parseCPUTime(fields[2]),
+			rss:  rss * 1024,
+		})
+	}
+	return stats, nil
+}
@@ -0,0 +1,74 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+var publishNATS *string
+var publishKafka *string
+var publishTopic *string
+var publishEvents *bool
+
+// publisher adapts a message bus to a sink, records are published as JSON
+// keyed by session so that a session's records stay ordered.
+func publisher(send func(key string, payload []byte) error) func(interface{}) error {
+	return func(r interface{}) error {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		key := ""
+		switch r := r.(type) {
+		case *txRecord:
+			key = r.Session
+		case *eventRecord:
+			key = r.Session
+		case *notableRecord:
+			key = r.Kind
+		}
+		return send(key, payload)
+	}
+}
+
+func publishInit() {
+	kinds := []string{"transaction", "notable"}
+	if *publishEvents {
+		kinds = append(kinds, "event")
+	}
+
+	if *publishNATS != "" {
+		conn, err := newNATSConn(*publishNATS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		addSink("nats", kinds, publisher(func(key string, payload []byte) error {
+			return conn.publish(*publishTopic, payload)
+		}))
+	}
+
+	if *publishKafka != "" {
+		send, err := kafkaWriter(strings.Split(*publishKafka, ","), *publishTopic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		addSink("kafka", kinds, publisher(send))
+	}
+}
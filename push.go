@@ -0,0 +1,225 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pushURL *string
+var pushInterval *time.Duration
+var pushCollectors *string
+
+// pushSample is a series in a push, counters and histograms are pushed as
+// the increase since the previous push and gauges as their current value.
+type pushSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Kind   string            `json:"kind"`
+	Value  float64           `json:"value"`
+}
+
+type pushDocument struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Interval  float64      `json:"interval_seconds"`
+	Samples   []pushSample `json:"samples"`
+}
+
+// pushState is the baseline of the deltas, it only moves on once a push
+// was accepted so that a failed push is made up for by the next one.
+var pushState = struct {
+	sync.Mutex
+	previous map[string]float64
+	at       time.Time
+}{previous: make(map[string]float64), at: startTime}
+
+// parseSample splits an exposition line into its name, labels and value.
+func parseSample(line string) (string, map[string]string, float64, error) {
+	labels := make(map[string]string)
+	i := strings.IndexAny(line, "{ ")
+	if i == -1 {
+		return "", nil, 0, fmt.Errorf("invalid sample: %s", line)
+	}
+	name, rest := line[:i], line[i:]
+
+	if rest[0] == '{' {
+		rest = rest[1:]
+		for rest != "" && rest[0] != '}' {
+			j := strings.Index(rest, "=\"")
+			if j == -1 {
+				return "", nil, 0, fmt.Errorf("invalid sample: %s", line)
+			}
+			key := rest[:j]
+			rest = rest[j+2:]
+
+			value := strings.Builder{}
+			for rest != "" && rest[0] != '"' {
+				if rest[0] == '\\' && len(rest) > 1 {
+					rest = rest[1:]
+					if rest[0] == 'n' {
+						value.WriteByte('\n')
+						rest = rest[1:]
+						continue
+					}
+				}
+				value.WriteByte(rest[0])
+				rest = rest[1:]
+			}
+			if rest == "" {
+				return "", nil, 0, fmt.Errorf("invalid sample: %s", line)
+			}
+			labels[key] = value.String()
+			rest = strings.TrimPrefix(rest[1:], ",")
+		}
+		if rest == "" {
+			return "", nil, 0, fmt.Errorf("invalid sample: %s", line)
+		}
+		rest = rest[1:]
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("invalid sample: %s", line)
+	}
+	return name, labels, value, nil
+}
+
+// pushDeltas renders the metrics and turns them into a push document, it
+// goes through the exposition so that pushed and scraped metrics never
+// diverge. It returns the counters to use as the next baseline, it is
+// called with pushState locked.
+func pushDeltas(now time.Time) (*pushDocument, map[string]float64, error) {
+	enabled := make(map[string]bool)
+	if *pushCollectors != "" {
+		for _, name := range strings.Split(*pushCollectors, ",") {
+			enabled[name] = true
+		}
+	}
+	buf := &bytes.Buffer{}
+	render(&exposition{w: buf, sets: metricSets}, enabled)
+	if *metricStyle == "prefix" {
+		buf = prefixStyle(buf, false)
+	}
+
+	doc := &pushDocument{
+		Timestamp: now,
+		Interval:  now.Sub(pushState.at).Seconds(),
+		Samples:   []pushSample{},
+	}
+	current := make(map[string]float64)
+	kind := ""
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			kind = fields[len(fields)-1]
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, labels, value, err := parseSample(line)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if kind == "gauge" || kind == "untyped" {
+			doc.Samples = append(doc.Samples, pushSample{name, labels, "gauge", value})
+			continue
+		}
+		// the series itself is the key, labels are rendered in a stable order
+		i := strings.LastIndexByte(line, ' ')
+		current[line[:i]] = value
+		delta := value - pushState.previous[line[:i]]
+		if delta < 0 {
+			// the counter was reset
+			delta = value
+		}
+		if delta != 0 {
+			doc.Samples = append(doc.Samples, pushSample{name, labels, "delta", delta})
+		}
+	}
+
+	return doc, current, nil
+}
+
+func push() {
+	pushState.Lock()
+	defer pushState.Unlock()
+
+	now := time.Now()
+	doc, current, err := pushDeltas(now)
+	if err != nil {
+		log.Printf("push: %v", err)
+		return
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		log.Printf("push: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(*pushURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("push: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("push: %s: %s", *pushURL, resp.Status)
+		return
+	}
+	pushState.previous = current
+	pushState.at = now
+}
+
+func pushInit() {
+	if *pushURL == "" {
+		return
+	}
+	if *pushCollectors != "" {
+		for _, name := range strings.Split(*pushCollectors, ",") {
+			if getCollector(name) == nil {
+				log.Fatalf("unknown collector: %s", name)
+			}
+		}
+	}
+	go func() {
+		for {
+			time.Sleep(*pushInterval)
+			push()
+		}
+	}()
+}
+
+// pushFlush pushes what happened since the last push before exiting.
+func pushFlush() {
+	if *pushURL != "" {
+		push()
+	}
+}
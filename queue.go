@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var queueSize *int
+var pipeTimeout *time.Duration
+
+// events read from smtpd are processed by a worker so that a slow update
+// never blocks the pipe, when the queue is full they are dropped instead
+// unless they open or close a session or a transaction.
+var queue chan []string
+var queueDone = make(chan struct{})
+var queueDropped uint64
+
+// queueLock orders the readers enqueueing events against the queue being
+// closed on shutdown, after which queueStopped has them drop events.
+var queueLock sync.RWMutex
+var queueStopped bool
+
+// malformed lines are logged and skipped rather than taking the filter,
+// and smtpd with it, down.
+var eventsInvalid uint64
+
+func invalidEvent(err error) {
+	atomic.AddUint64(&eventsInvalid, 1)
+	log.Printf("invalid input: %v", err)
+}
+
+// lastEventAt is the time, in nanoseconds, at which the last line was
+// read from smtpd or a shim, heartbeats included.
+var lastEventAt int64
+
+func eventSeen() {
+	atomic.StoreInt64(&lastEventAt, time.Now().UnixNano())
+}
+
+func queueInit() {
+	if *queueSize < 1 {
+		log.Fatalf("invalid queue size: %d", *queueSize)
+	}
+	queue = make(chan []string, *queueSize)
+
+	go func() {
+		for atoms := range queue {
+			process(atoms)
+		}
+		close(queueDone)
+	}()
+}
+
+func process(atoms []string) {
+	switch atoms[0] {
+	case "report":
+		trigger(reporters, atoms)
+	case "filter":
+		analyzeDataLine(atoms)
+	case "config":
+		resetSessions()
+	case "forget":
+		forgetSessions(atoms[1], atoms[2:])
+	}
+}
+
+func enqueue(atoms []string) {
+	queueLock.RLock()
+	defer queueLock.RUnlock()
+
+	if queueStopped {
+		return
+	}
+	select {
+	case queue <- atoms:
+	default:
+		atomic.AddUint64(&queueDropped, 1)
+	}
+}
+
+// lifecycleEvent tells the events opening and closing sessions and
+// transactions, dropping them would leave sessions behind forever.
+func lifecycleEvent(atoms []string) bool {
+	switch atoms[4] {
+	case "link-connect", "link-disconnect":
+		return true
+	}
+	return strings.HasPrefix(atoms[4], "tx-")
+}
+
+// enqueueWait queues an event that must never be dropped, such as a
+// handshake or sessions to forget, waiting for room in the queue.
+func enqueueWait(atoms []string) {
+	queueLock.RLock()
+	defer queueLock.RUnlock()
+
+	if queueStopped {
+		return
+	}
+	queue <- atoms
+}
+
+// queueDrain stops the readers and processes the pending events before
+// exiting.
+func queueDrain() {
+	queueLock.Lock()
+	queueStopped = true
+	close(queue)
+	queueLock.Unlock()
+
+	<-queueDone
+}
+
+func queueCollector(e *exposition) {
+	e.header("smtpd_filter_queue_depth", "The number of events waiting to be processed.", "gauge", nil)
+	e.sample("smtpd_filter_queue_depth", "", float64(len(queue)))
+	e.end()
+
+	e.header("smtpd_filter_queue_capacity", "The maximum number of events waiting to be processed.", "gauge", nil)
+	e.sample("smtpd_filter_queue_capacity", "", float64(cap(queue)))
+	e.end()
+
+	e.header("smtpd_filter_events_dropped_total", "The number of events dropped because the queue was full.", "counter", nil)
+	e.sample("smtpd_filter_events_dropped_total", "", float64(atomic.LoadUint64(&queueDropped)))
+	e.end()
+
+	e.header("smtpd_filter_events_invalid_total", "The number of malformed events skipped.", "counter", nil)
+	e.sample("smtpd_filter_events_invalid_total", "", float64(atomic.LoadUint64(&eventsInvalid)))
+	e.end()
+
+	// shims send heartbeats to the daemon, and a server that saw no
+	// connection for -pipe-timeout is more likely to have a broken pipe
+	last := startTime
+	e.header("smtpd_filter_events_last_seen_timestamp_seconds", "The last time an event was received.", "gauge", nil)
+	if nsec := atomic.LoadInt64(&lastEventAt); nsec != 0 {
+		last = time.Unix(0, nsec)
+		e.sample("smtpd_filter_events_last_seen_timestamp_seconds", "", float64(last.Unix()))
+	}
+	e.end()
+
+	healthy := 1.0
+	if *pipeTimeout > 0 && time.Since(last) > *pipeTimeout {
+		healthy = 0
+	}
+	e.header("smtpd_filter_pipe_healthy", "Whether an event was received within the pipe timeout.", "gauge", nil)
+	e.sample("smtpd_filter_pipe_healthy", "", healthy)
+	e.end()
+}
@@ -0,0 +1,232 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// txRecord summarizes a transaction once it is committed or rolled back.
+type txRecord struct {
+	Type       string    `json:"type"`
+	Session    string    `json:"session"`
+	Message    string    `json:"msgid"`
+	Direction  string    `json:"direction"`
+	Role       string    `json:"role,omitempty"`
+	Result     string    `json:"result"`
+	BeganAt    time.Time `json:"began_at"`
+	EndedAt    time.Time `json:"ended_at"`
+	Size       uint64    `json:"size"`
+	Sender     string    `json:"sender_domain"`
+	Recipients uint64    `json:"recipients"`
+	Domains    []string  `json:"recipient_domains"`
+}
+
+func newTxRecord(s *session, subsystem string, result string, msgid string, size uint64) *txRecord {
+	r := &txRecord{
+		Type:      "transaction",
+		Session:   s.id,
+		Message:   msgid,
+		Direction: subsystem,
+		Role:      s.role,
+		Result:    result,
+		BeganAt:   s.txBeganAt,
+		EndedAt:   s.timestamp,
+		Size:      size,
+		Sender:    s.mailDomain,
+	}
+	for domain, count := range s.rcptDomains {
+		r.Domains = append(r.Domains, domain)
+		r.Recipients += count
+	}
+	sort.Strings(r.Domains)
+	return r
+}
+
+// eventRecord is a report event as received from smtpd.
+type eventRecord struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Direction string    `json:"direction"`
+	Event     string    `json:"event"`
+	Session   string    `json:"session"`
+	Params    []string  `json:"params"`
+}
+
+// notableRecord is a derived event worth an operator's attention, such as
+// a brute force attack being detected.
+type notableRecord struct {
+	Type      string            `json:"type"`
+	Timestamp time.Time         `json:"timestamp"`
+	Kind      string            `json:"kind"`
+	Fields    map[string]string `json:"fields"`
+}
+
+// sink receives the kinds of records it accepts (transaction, event,
+// notable) on its own goroutine, they are dropped rather than delaying
+// event processing when it falls behind.
+type sink struct {
+	name    string
+	accepts map[string]bool
+	queue   chan interface{}
+	write   func(interface{}) error
+	flush   func() error
+	done    chan struct{}
+	written uint64
+	dropped uint64
+	errors  uint64
+}
+
+var sinks []*sink
+
+// eventSinks is set when a sink wants every report event.
+var eventSinks bool
+
+func addSink(name string, kinds []string, write func(interface{}) error) {
+	addBatchSink(name, kinds, write, nil)
+}
+
+// addBatchSink adds a sink whose writes are buffered, flush is called
+// whenever its queue runs empty: batches grow with the load.
+func addBatchSink(name string, kinds []string, write func(interface{}) error, flush func() error) {
+	s := &sink{name: name, accepts: make(map[string]bool), queue: make(chan interface{}, 1024), write: write, flush: flush, done: make(chan struct{})}
+	for _, kind := range kinds {
+		s.accepts[kind] = true
+	}
+	sinks = append(sinks, s)
+	if s.accepts["event"] {
+		eventSinks = true
+	}
+
+	go func() {
+		for r := range s.queue {
+			if err := s.write(r); err != nil {
+				atomic.AddUint64(&s.errors, 1)
+				log.Printf("%s: %v", s.name, err)
+				continue
+			}
+			atomic.AddUint64(&s.written, 1)
+			if s.flush != nil && len(s.queue) == 0 {
+				if err := s.flush(); err != nil {
+					atomic.AddUint64(&s.errors, 1)
+					log.Printf("%s: %v", s.name, err)
+				}
+			}
+		}
+		close(s.done)
+	}()
+}
+
+// sinksDrain writes the pending records before exiting.
+func sinksDrain() {
+	for _, s := range sinks {
+		close(s.queue)
+		<-s.done
+	}
+}
+
+func emit(r interface{}, kind string) {
+	for _, sk := range sinks {
+		if !sk.accepts[kind] {
+			continue
+		}
+		select {
+		case sk.queue <- r:
+		default:
+			atomic.AddUint64(&sk.dropped, 1)
+		}
+	}
+}
+
+func emitRecord(s *session, subsystem string, result string, msgid string, size uint64) {
+	if len(sinks) == 0 {
+		return
+	}
+	emit(newTxRecord(s, subsystem, result, msgid, size), "transaction")
+}
+
+func emitEvent(s *session, atoms []string, params []string) {
+	if !eventSinks {
+		return
+	}
+	emit(&eventRecord{
+		Type:      "event",
+		Timestamp: s.timestamp,
+		Direction: atoms[3],
+		Event:     atoms[4],
+		Session:   s.id,
+		Params:    privateParams(atoms[4], params),
+	}, "event")
+}
+
+// security emits an event of interest to SIEMs, too frequent to be
+// notable on its own.
+func security(now time.Time, kind string, fields map[string]string) {
+	if len(sinks) == 0 {
+		return
+	}
+	emit(&notableRecord{
+		Type:      "security",
+		Timestamp: now,
+		Kind:      kind,
+		Fields:    privateFields(fields),
+	}, "security")
+}
+
+// notable emits a derived event, fields are sorted by the encoders.
+func notable(now time.Time, kind string, fields map[string]string) {
+	if len(sinks) == 0 {
+		return
+	}
+	emit(&notableRecord{
+		Type:      "notable",
+		Timestamp: now,
+		Kind:      kind,
+		Fields:    privateFields(fields),
+	}, "notable")
+}
+
+func sinksCollector(e *exposition) {
+	if len(sinks) == 0 {
+		return
+	}
+	families := []struct {
+		name  string
+		help  string
+		value func(*sink) *uint64
+	}{
+		{"smtpd_sink_records_total", "The number of records written to a sink.", func(s *sink) *uint64 { return &s.written }},
+		{"smtpd_sink_dropped_total", "The number of records dropped because a sink fell behind.", func(s *sink) *uint64 { return &s.dropped }},
+		{"smtpd_sink_errors_total", "The number of records a sink failed to write.", func(s *sink) *uint64 { return &s.errors }},
+	}
+	for _, family := range families {
+		e.header(family.name, family.help, "counter", nil, "sink")
+		for _, s := range sinks {
+			e.sample(family.name, label("sink", s.name), float64(atomic.LoadUint64(family.value(s))))
+		}
+		e.end()
+	}
+}
+
+// recordDomains is how recipient domains are stored in flat formats.
+func recordDomains(r *txRecord) string {
+	return strings.Join(r.Domains, ",")
+}
@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"strings"
+)
+
+// rejection reasons of smtp-in sessions ended by policy rather than by
+// the client:
+//
+//	filter_disconnect: a filter had smtpd disconnect the session
+//	filter_reject:     a filter rejected the connection
+//	limit:             smtpd disconnected the session for hitting a limit
+//	banner:            smtpd refused the session in place of its banner
+var rejectionReasons = []string{"filter_disconnect", "filter_reject", "limit", "banner"}
+
+// filterResponse accounts for the decisions of the filter chain as smtpd
+// reports them, the first reason a session is rejected for is kept.
+func filterResponse(s *session, subsystem string, params []string) {
+	if subsystem != "smtp-in" {
+		return
+	}
+	phase, response := params[0], params[1]
+	if response == "reject" || response == "disconnect" {
+		s.refused = true
+	}
+	if s.rejected != "" {
+		return
+	}
+	switch {
+	case response == "disconnect":
+		s.rejected = "filter_disconnect"
+	case response == "reject" && phase == "connect":
+		s.rejected = "filter_reject"
+	}
+}
+
+// serverRejection accounts for a server response ending a session, 421
+// being sent right before smtpd closes the connection.
+func serverRejection(s *session, response string) {
+	if s.subsystem != "smtp-in" || s.rejected != "" {
+		return
+	}
+	if classifyLimit(response) != "" && strings.HasPrefix(response, "421") {
+		s.rejected = "limit"
+	} else if !s.greeted && (response[0] == '4' || response[0] == '5') {
+		s.rejected = "banner"
+	}
+}
+
+func accountRejection(m *metrics, s *session) {
+	if s.rejected != "" {
+		m.connectionsRejected[s.rejected]++
+	}
+	m.disconnects[disconnectReason(s)]++
+}
+
+// disconnect reasons of sessions, from the events preceding link-disconnect:
+//
+//	quit:            the client sent QUIT
+//	timeout:         smtpd timed the session out
+//	rejected:        a filter or smtpd ended the session, see rejectionReasons
+//	mid_transaction: the connection dropped during a transaction
+//	dropped:         the connection dropped between transactions
+var disconnectReasons = []string{"quit", "timeout", "rejected", "mid_transaction", "dropped"}
+
+func disconnectReason(s *session) string {
+	switch {
+	case s.rejected != "":
+		return "rejected"
+	case s.timedOut:
+		return "timeout"
+	case s.quit:
+		return "quit"
+	case s.tx:
+		return "mid_transaction"
+	}
+	return "dropped"
+}
+
+func rejectionsCollector(e *exposition) {
+	e.header("smtpd_connections_rejected_total", "The number of smtp-in sessions ended by a filter or smtpd rather than by the client.", "counter", e.inbound(), "reason")
+	for _, m := range e.inbound() {
+		for _, reason := range rejectionReasons {
+			e.sample("smtpd_connections_rejected_total", m.labels()+","+label("reason", reason), float64(m.connectionsRejected[reason]))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_disconnects_total", "The number of sessions ended per disconnect reason.", "counter", e.sets, "reason")
+	for _, m := range e.sets {
+		for _, reason := range disconnectReasons {
+			e.sample("smtpd_disconnects_total", m.labels()+","+label("reason", reason), float64(m.disconnects[reason]))
+		}
+	}
+	e.end()
+}
@@ -0,0 +1,268 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var reportDir *string
+var reportS3 *string
+var reportFormat *string
+var reportInterval *time.Duration
+
+// daily usage per tenant, kept until the day is over and its final
+// report was written.
+type dailyKey struct {
+	day       string
+	direction string
+	role      string
+	tenant    string
+}
+
+var dailyUsage = make(map[dailyKey]*usage)
+
+type usageRecord struct {
+	Day        string `json:"day"`
+	Tenant     string `json:"tenant"`
+	Direction  string `json:"direction"`
+	Role       string `json:"role"`
+	Messages   uint64 `json:"messages"`
+	Recipients uint64 `json:"recipients"`
+	Bytes      uint64 `json:"bytes"`
+}
+
+func reportEnabled() bool {
+	return tenants != nil && (*reportDir != "" || *reportS3 != "")
+}
+
+func accountDaily(m *metrics, day time.Time, role string, tenant string, recipients uint64, bytes uint64) {
+	if !reportEnabled() {
+		return
+	}
+	key := dailyKey{day.UTC().Format("2006-01-02"), m.direction, role, tenant}
+	u, ok := dailyUsage[key]
+	if !ok {
+		u = &usage{}
+		dailyUsage[key] = u
+	}
+	u.messages++
+	u.recipients += recipients
+	u.bytes += bytes
+}
+
+// snapshotUsage returns the records per day, days before today are
+// forgotten as their report is about to be final.
+func snapshotUsage(today string) map[string][]usageRecord {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	days := make(map[string][]usageRecord)
+	for key, u := range dailyUsage {
+		days[key.day] = append(days[key.day], usageRecord{
+			Day:        key.day,
+			Tenant:     key.tenant,
+			Direction:  key.direction,
+			Role:       key.role,
+			Messages:   u.messages,
+			Recipients: u.recipients,
+			Bytes:      u.bytes,
+		})
+		if key.day < today {
+			delete(dailyUsage, key)
+		}
+	}
+	for _, records := range days {
+		sort.Slice(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			if a.Tenant != b.Tenant {
+				return a.Tenant < b.Tenant
+			}
+			if a.Direction != b.Direction {
+				return a.Direction < b.Direction
+			}
+			return a.Role < b.Role
+		})
+	}
+	return days
+}
+
+func encodeUsage(records []usageRecord) ([]byte, error) {
+	if *reportFormat == "json" {
+		return json.MarshalIndent(records, "", "  ")
+	}
+
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write([]string{"day", "tenant", "direction", "role", "messages", "recipients", "bytes"})
+	for _, r := range records {
+		w.Write([]string{r.Day, r.Tenant, r.Direction, r.Role,
+			strconv.FormatUint(r.Messages, 10),
+			strconv.FormatUint(r.Recipients, 10),
+			strconv.FormatUint(r.Bytes, 10)})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func decodeUsage(data []byte) ([]usageRecord, error) {
+	records := []usageRecord{}
+	if *reportFormat == "json" {
+		err := json.Unmarshal(data, &records)
+		return records, err
+	}
+
+	lines, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, fields := range lines {
+		if i == 0 {
+			continue
+		}
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: %d fields", i+1, len(fields))
+		}
+		r := usageRecord{Day: fields[0], Tenant: fields[1], Direction: fields[2], Role: fields[3]}
+		for j, value := range []*uint64{&r.Messages, &r.Recipients, &r.Bytes} {
+			if *value, err = strconv.ParseUint(fields[4+j], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// loadUsage resumes the report of the current day written by a previous
+// process, which would otherwise be replaced with the usage since the
+// restart. The directory is preferred to the bucket when both are set.
+// A report that can't be read is no reason to take smtpd's filter chain
+// down, usage then starts from empty.
+func loadUsage(day string) {
+	name := fmt.Sprintf("usage-%s.%s", day, *reportFormat)
+	var data []byte
+	var err error
+	if *reportDir != "" {
+		name = filepath.Join(*reportDir, name)
+		if data, err = ioutil.ReadFile(name); os.IsNotExist(err) {
+			return
+		}
+	} else {
+		data, err = s3Get(*reportS3, name)
+	}
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return
+	}
+	if data == nil {
+		return
+	}
+	records, err := decodeUsage(data)
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return
+	}
+
+	for _, r := range records {
+		if r.Day != day {
+			continue
+		}
+		key := dailyKey{r.Day, r.Direction, r.Role, r.Tenant}
+		u, ok := dailyUsage[key]
+		if !ok {
+			u = &usage{}
+			dailyUsage[key] = u
+		}
+		u.messages += r.Messages
+		u.recipients += r.Recipients
+		u.bytes += r.Bytes
+	}
+}
+
+func writeUsage(name string, data []byte) error {
+	if *reportDir != "" {
+		// write and rename so readers never see a partial report
+		tmp, err := ioutil.TempFile(*reportDir, ".usage")
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		if err := os.Rename(tmp.Name(), filepath.Join(*reportDir, name)); err != nil {
+			return err
+		}
+	}
+	if *reportS3 != "" {
+		if err := s3Put(*reportS3, name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReports writes one report per day, the report of the current day
+// is rewritten at each interval until it is final.
+func writeReports() {
+	for day, records := range snapshotUsage(time.Now().UTC().Format("2006-01-02")) {
+		data, err := encodeUsage(records)
+		if err != nil {
+			log.Printf("usage report: %v", err)
+			continue
+		}
+		name := fmt.Sprintf("usage-%s.%s", day, *reportFormat)
+		if err := writeUsage(name, data); err != nil {
+			log.Printf("usage report %s: %v", name, err)
+		}
+	}
+}
+
+func reportInit() {
+	if *reportFormat != "csv" && *reportFormat != "json" {
+		log.Fatalf("invalid report format: %s", *reportFormat)
+	}
+	if !reportEnabled() {
+		return
+	}
+	if *reportS3 != "" {
+		s3Init()
+	}
+	loadUsage(time.Now().UTC().Format("2006-01-02"))
+
+	go func() {
+		for range time.Tick(*reportInterval) {
+			writeReports()
+		}
+	}()
+}
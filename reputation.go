@@ -0,0 +1,265 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var reputationFiles = stringValues{}
+var reputationThresholds *string
+var reputationReload *time.Duration
+
+// reputation tiers of smtp-in peers, from the score of the most specific
+// network listing them: below the first threshold is low, below the
+// second medium, and high above, unknown if none does.
+var reputationTiers = []string{"low", "medium", "high", "unknown"}
+var reputationBounds []float64
+
+// reputationTable holds the scores of the listed networks, keyed by
+// network, with the prefix lengths in use from the most specific.
+type reputationTable struct {
+	scores map[string]float64
+	v4     []int
+	v6     []int
+}
+
+var reputation = struct {
+	sync.RWMutex
+	table    *reputationTable
+	modified map[string]time.Time
+	failures uint64
+}{table: &reputationTable{scores: make(map[string]float64)}}
+
+func loadReputationFile(table *reputationTable, path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected a network and a score", path, lineno)
+		}
+		network := fields[0]
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		score, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid score: %s", path, lineno, fields[1])
+		}
+		table.scores[ipnet.String()] = score
+	}
+	return scanner.Err()
+}
+
+// loadReputation reads all the files into a new table, later files
+// overriding the scores of networks listed in earlier ones.
+func loadReputation() (*reputationTable, error) {
+	table := &reputationTable{scores: make(map[string]float64)}
+	for _, path := range reputationFiles {
+		if err := loadReputationFile(table, path); err != nil {
+			return nil, err
+		}
+	}
+
+	v4, v6 := make(map[int]bool), make(map[int]bool)
+	for network := range table.scores {
+		_, ipnet, _ := net.ParseCIDR(network)
+		ones, bits := ipnet.Mask.Size()
+		if bits == 32 {
+			v4[ones] = true
+		} else {
+			v6[ones] = true
+		}
+	}
+	for ones := range v4 {
+		table.v4 = append(table.v4, ones)
+	}
+	for ones := range v6 {
+		table.v6 = append(table.v6, ones)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(table.v4)))
+	sort.Sort(sort.Reverse(sort.IntSlice(table.v6)))
+	return table, nil
+}
+
+func (table *reputationTable) score(ip net.IP) (float64, bool) {
+	lengths, bits := table.v6, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, lengths, bits = ip4, table.v4, 32
+	}
+	for _, ones := range lengths {
+		mask := net.CIDRMask(ones, bits)
+		network := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if score, ok := table.scores[network.String()]; ok {
+			return score, true
+		}
+	}
+	return 0, false
+}
+
+// reputationTier returns the tier of a peer address.
+func reputationTier(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "unknown"
+	}
+	reputation.RLock()
+	score, ok := reputation.table.score(ip)
+	reputation.RUnlock()
+	if !ok {
+		return "unknown"
+	}
+	for i, bound := range reputationBounds {
+		if score < bound {
+			return reputationTiers[i]
+		}
+	}
+	return "high"
+}
+
+// reputationChanged tells whether a file was modified since it was last
+// loaded, recording the modification times.
+func reputationChanged() bool {
+	changed := false
+	for _, path := range reputationFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(reputation.modified[path]) {
+			reputation.modified[path] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// reputationReloader reloads the files when they change, the previous
+// table being kept until they change again if one is invalid.
+func reputationReloader() {
+	for range time.Tick(*reputationReload) {
+		if !reputationChanged() {
+			continue
+		}
+		table, err := loadReputation()
+		reputation.Lock()
+		if err != nil {
+			log.Printf("reputation: %v", err)
+			reputation.failures++
+		} else {
+			reputation.table = table
+		}
+		reputation.Unlock()
+	}
+}
+
+func reputationInit() {
+	if len(reputationFiles) == 0 {
+		return
+	}
+	for _, threshold := range strings.Split(*reputationThresholds, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(threshold), 64)
+		if err != nil {
+			log.Fatalf("invalid reputation threshold: %s", threshold)
+		}
+		reputationBounds = append(reputationBounds, bound)
+	}
+	if len(reputationBounds) != 2 || reputationBounds[0] > reputationBounds[1] {
+		log.Fatalf("invalid reputation thresholds: %s", *reputationThresholds)
+	}
+
+	reputation.modified = make(map[string]time.Time)
+	reputationChanged()
+	table, err := loadReputation()
+	if err != nil {
+		log.Fatal(err)
+	}
+	reputation.table = table
+
+	for _, m := range metricSets {
+		if m.direction != "smtp-in" {
+			continue
+		}
+		m.reputationSessions = newBuckets(reputationTiers)
+		m.reputationCommits = newBuckets(reputationTiers)
+	}
+	if *reputationReload > 0 {
+		go reputationReloader()
+	}
+}
+
+func reputationCollector(e *exposition) {
+	if len(reputationFiles) == 0 {
+		return
+	}
+	e.header("smtpd_sessions_by_reputation_total", "The number of smtp-in sessions per reputation tier of the peer.", "counter", e.inbound(), "tier")
+	for _, m := range e.inbound() {
+		for _, tier := range reputationTiers {
+			e.sample("smtpd_sessions_by_reputation_total", m.labels()+","+label("tier", tier), float64(m.reputationSessions[tier]))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_tx_commit_by_reputation_total", "The number of smtp-in transactions committed per reputation tier of the peer.", "counter", e.inbound(), "tier")
+	for _, m := range e.inbound() {
+		for _, tier := range reputationTiers {
+			e.sample("smtpd_tx_commit_by_reputation_total", m.labels()+","+label("tier", tier), float64(m.reputationCommits[tier]))
+		}
+	}
+	e.end()
+
+	reputation.RLock()
+	defer reputation.RUnlock()
+
+	e.header("smtpd_reputation_networks", "The number of networks listed in the reputation files.", "gauge", nil)
+	e.sample("smtpd_reputation_networks", "", float64(len(reputation.table.scores)))
+	e.end()
+
+	e.header("smtpd_reputation_reload_failures_total", "The number of times the reputation files failed to reload.", "counter", nil)
+	e.sample("smtpd_reputation_reload_failures_total", "", float64(reputation.failures))
+	e.end()
+}
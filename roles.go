@@ -0,0 +1,143 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+var roles = namedValues{}
+
+// roleListener matches the listener address of smtp-in sessions, an empty
+// host or port matches any.
+type roleListener struct {
+	role string
+	unix bool
+	host net.IP
+	port string
+}
+
+var roleListeners []roleListener
+
+// metric sets of the configured roles, smtp-in sessions on other listeners
+// are accounted in smtpIn.
+var roleMetrics = make(map[string]*metrics)
+
+// metricSets are all the metric sets, in exposition order.
+var metricSets = []*metrics{&smtpIn, &smtpOut}
+
+func (m *metrics) setRole(role string) {
+	m.role = role
+	m.labelSet = label("direction", m.direction) + "," + label("session_role", role)
+}
+
+func parseRoleListener(role string, spec string) roleListener {
+	l := roleListener{role: role}
+	if spec == "unix" {
+		l.unix = true
+		return l
+	}
+
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		host = strings.Trim(spec, "[]")
+	}
+	if host != "" && host != "*" {
+		if l.host = net.ParseIP(host); l.host == nil {
+			log.Fatalf("invalid listener for role %s: %s", role, spec)
+		}
+	}
+	l.port = port
+	return l
+}
+
+func rolesInit() {
+	if len(roles) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		if name == "other" || name == "outbound" {
+			log.Fatalf("reserved role name: %s", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, spec := range strings.Split(roles[name], ",") {
+			roleListeners = append(roleListeners, parseRoleListener(name, strings.TrimSpace(spec)))
+		}
+		m := newMetrics("smtp-in")
+		m.setRole(name)
+		roleMetrics[name] = &m
+	}
+
+	// every series carries a role once roles are configured
+	smtpIn.setRole("other")
+	smtpOut.setRole("outbound")
+	metricSets = []*metrics{}
+	for _, name := range names {
+		metricSets = append(metricSets, roleMetrics[name])
+	}
+	metricSets = append(metricSets, &smtpIn, &smtpOut)
+}
+
+// listenerRole returns the role of the most specific listener matching the
+// local address of an smtp-in session, an address being more specific than
+// a port.
+func listenerRole(address string) string {
+	if len(roleListeners) == 0 {
+		return ""
+	}
+
+	unix := strings.HasPrefix(address, "unix:")
+	host, port, _ := net.SplitHostPort(address)
+	ip := net.ParseIP(host)
+	role, best := "other", -1
+	for _, l := range roleListeners {
+		if l.unix != unix {
+			continue
+		}
+		if !unix && (l.host != nil && !l.host.Equal(ip) || l.port != "" && l.port != port) {
+			continue
+		}
+		score := 0
+		if l.host != nil {
+			score += 2
+		}
+		if l.port != "" {
+			score++
+		}
+		if score > best {
+			role, best = l.role, score
+		}
+	}
+	return role
+}
+
+// metrics returns the metric set a session is accounted in.
+func (s *session) metrics() *metrics {
+	if m, ok := roleMetrics[s.role]; ok {
+		return m
+	}
+	return getMetrics(s.subsystem)
+}
@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type schemaMetric struct {
+	Name      string   `json:"name"`
+	Help      string   `json:"help"`
+	Type      string   `json:"type"`
+	Collector string   `json:"collector"`
+	Labels    []string `json:"labels"`
+}
+
+// schema lists the families each enabled collector exposes, along with
+// the label names they declare, whether or not they have samples yet.
+func schema() []*schemaMetric {
+	adminLock.Lock()
+	names := []string{}
+	for _, c := range collectors {
+		if !c.disabled {
+			names = append(names, c.name)
+		}
+	}
+	adminLock.Unlock()
+
+	families := []*schemaMetric{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		collector := name
+		e := &exposition{w: ioutil.Discard, sets: metricSets}
+		e.declare = func(name string, help string, kind string, sets []*metrics, labels []string) {
+			for _, family := range schemaFamilies(name, sets, labels) {
+				if seen[family.Name] {
+					continue
+				}
+				seen[family.Name] = true
+				family.Help, family.Type, family.Collector = help, kind, collector
+				if kind == "histogram" {
+					family.Labels = append(family.Labels, "le")
+				}
+				sort.Strings(family.Labels)
+				families = append(families, family)
+			}
+		}
+		render(e, map[string]bool{name: true})
+	}
+	return families
+}
+
+// schemaFamilies are the families a header declares, one per direction
+// of its metric sets in the prefix style.
+func schemaFamilies(name string, sets []*metrics, labels []string) []*schemaMetric {
+	setLabels := []string{}
+	directions := []string{}
+	for _, m := range sets {
+		for _, label := range m.labelNames() {
+			if !containsString(setLabels, label) {
+				setLabels = append(setLabels, label)
+			}
+		}
+		if !containsString(directions, m.direction) {
+			directions = append(directions, m.direction)
+		}
+	}
+
+	if *metricStyle != "prefix" || len(sets) == 0 || !strings.HasPrefix(name, "smtpd_") {
+		all := append(append([]string{}, setLabels...), labels...)
+		return []*schemaMetric{{Name: name, Labels: all}}
+	}
+	families := []*schemaMetric{}
+	for _, direction := range directions {
+		all := []string{}
+		for _, label := range setLabels {
+			if label != "direction" {
+				all = append(all, label)
+			}
+		}
+		all = append(all, labels...)
+		families = append(families, &schemaMetric{Name: directionPrefixes[direction] + strings.TrimPrefix(name, "smtpd_"), Labels: all})
+	}
+	return families
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schema())
+}
@@ -0,0 +1,74 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var sampleLabel = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="(?:[^"\\]|\\.)*"`)
+
+// TestSchemaLabels checks that the samples of the collectors fed by
+// events only carry label names their family declares.
+func TestSchemaLabels(t *testing.T) {
+	testInit()
+	for _, line := range benchmarkSession {
+		trigger(reporters, splitEvent(line))
+	}
+
+	for _, name := range []string{"queue", "sessions", "tx", "latency", "peers", "messages", "series"} {
+		declared := make(map[string][]string)
+		var buf bytes.Buffer
+		e := &exposition{w: &buf, sets: metricSets}
+		e.declare = func(family string, help string, kind string, sets []*metrics, labels []string) {
+			for _, m := range sets {
+				declared[family] = append(declared[family], m.labelNames()...)
+			}
+			declared[family] = append(declared[family], labels...)
+			if kind == "histogram" {
+				declared[family] = append(declared[family], "le")
+			}
+		}
+		getCollector(name).collect(e)
+
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			sample := line[:strings.IndexAny(line, "{ ")]
+			family := sample
+			for _, suffix := range []string{"_bucket", "_sum", "_count", "_created"} {
+				if _, ok := declared[family]; !ok {
+					family = strings.TrimSuffix(sample, suffix)
+				}
+			}
+			labels, ok := declared[family]
+			if !ok {
+				t.Errorf("%s: sample %s of an undeclared family", name, sample)
+				continue
+			}
+			for _, match := range sampleLabel.FindAllStringSubmatch(line, -1) {
+				if !containsString(labels, match[1]) {
+					t.Errorf("%s: label %s of %s is not declared", name, match[1], sample)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+var scriptFile *string
+
+// script is a collector whose metrics are derived from events by a user
+// script, see script_starlark.go.
+type script struct {
+	*metricStore
+	run    func(*Event) ([]*pluginUpdate, error)
+	errors uint64
+}
+
+// Event runs the script synchronously, scripts are bounded in the number
+// of steps they may execute per event.
+func (s *script) Event(ev *Event) {
+	updates, err := s.run(ev)
+	if err != nil {
+		if atomic.AddUint64(&s.errors, 1) == 1 {
+			log.Printf("script: %v", err)
+		}
+		return
+	}
+	for _, u := range updates {
+		if !s.apply(u) {
+			atomic.AddUint64(&s.errors, 1)
+		}
+	}
+}
+
+func (s *script) Collect(e *exposition) {
+	s.metricStore.Collect(e)
+
+	e.header("smtpd_script_errors_total", "The number of script failures and invalid metric updates.", "counter", nil)
+	e.sample("smtpd_script_errors_total", "", float64(atomic.LoadUint64(&s.errors)))
+	e.end()
+}
+
+func scriptInit() {
+	if *scriptFile == "" {
+		return
+	}
+	run, err := loadScript(*scriptFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	RegisterCollector(&script{metricStore: newMetricStore("script"), run: run})
+}
@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+//go:build starlark
+// +build starlark
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+func init() {
+	registerFeature("starlark")
+}
+
+// patterns compiled by match(), scripts use a handful of them.
+var patterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+func match(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, value string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &pattern, &value); err != nil {
+		return nil, err
+	}
+	patterns.Lock()
+	re, ok := patterns.compiled[pattern]
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			patterns.Unlock()
+			return nil, err
+		}
+		patterns.compiled[pattern] = re
+	}
+	patterns.Unlock()
+	return starlark.Bool(re.MatchString(value)), nil
+}
+
+// toGo converts the values a script returns, so that updates are decoded
+// like those of subprocess plugins.
+func toGo(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int, starlark.Float:
+		f, _ := starlark.AsFloat(v)
+		return f, nil
+	case *starlark.List, starlark.Tuple:
+		values := []interface{}{}
+		iter := starlark.Iterate(v)
+		defer iter.Done()
+		var item starlark.Value
+		for iter.Next(&item) {
+			value, err := toGo(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case *starlark.Dict:
+		values := make(map[string]interface{})
+		for _, item := range v.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("non-string key: %s", item[0])
+			}
+			value, err := toGo(item[1])
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected %s value", v.Type())
+}
+
+func loadScript(path string) (func(*Event) ([]*pluginUpdate, error), error) {
+	predeclared := starlark.StringDict{"match": starlark.NewBuiltin("match", match)}
+	thread := &starlark.Thread{Name: "load"}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, nil, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals["on_event"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s: on_event function not defined", path)
+	}
+
+	return func(ev *Event) ([]*pluginUpdate, error) {
+		params := make([]starlark.Value, len(ev.Params))
+		for i, param := range ev.Params {
+			params[i] = starlark.String(param)
+		}
+		event := starlark.NewDict(6)
+		event.SetKey(starlark.String("timestamp"), starlark.Float(float64(ev.Timestamp.UnixNano())/1e9))
+		event.SetKey(starlark.String("direction"), starlark.String(ev.Direction))
+		event.SetKey(starlark.String("role"), starlark.String(ev.Role))
+		event.SetKey(starlark.String("event"), starlark.String(ev.Name))
+		event.SetKey(starlark.String("session"), starlark.String(ev.Session))
+		event.SetKey(starlark.String("params"), starlark.NewList(params))
+
+		thread := &starlark.Thread{Name: "event"}
+		thread.SetMaxExecutionSteps(100000)
+		result, err := starlark.Call(thread, fn, starlark.Tuple{event}, nil)
+		if err != nil {
+			return nil, err
+		}
+		value, err := toGo(result)
+		if err != nil || value == nil {
+			return nil, err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		updates := []*pluginUpdate{}
+		if err := json.Unmarshal(data, &updates); err != nil {
+			return nil, fmt.Errorf("on_event must return a list of updates: %v", err)
+		}
+		return updates, nil
+	}, nil
+}
@@ -0,0 +1,168 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var selftestInterval *time.Duration
+var selftestDeadline *time.Duration
+var selftestSendmail *string
+var selftestRcpt *string
+
+const selftestPrefix = "filter-prometheus-selftest+"
+
+// selftest tracks the messages injected through sendmail, a test succeeds
+// when its transaction is committed through the filter before the deadline.
+var selftest = struct {
+	sync.Mutex
+	pending  map[string]time.Time
+	ran      bool
+	success  bool
+	lastOK   time.Time
+	duration float64
+	failures uint64
+}{pending: make(map[string]time.Time)}
+
+// selftestToken returns the token of a self-test envelope sender.
+func selftestToken(address string) string {
+	address = strings.Trim(address, "<>")
+	if !strings.HasPrefix(address, selftestPrefix) {
+		return ""
+	}
+	token := strings.TrimPrefix(address, selftestPrefix)
+	if i := strings.IndexByte(token, '@'); i != -1 {
+		token = token[:i]
+	}
+	return token
+}
+
+func selftestCommitted(token string) {
+	if token == "" {
+		return
+	}
+	selftest.Lock()
+	defer selftest.Unlock()
+
+	sent, ok := selftest.pending[token]
+	if !ok {
+		return
+	}
+	delete(selftest.pending, token)
+	selftest.ran = true
+	selftest.success = true
+	selftest.lastOK = time.Now()
+	selftest.duration = selftest.lastOK.Sub(sent).Seconds()
+}
+
+func selftestFailed(token string) {
+	selftest.Lock()
+	defer selftest.Unlock()
+
+	if token != "" {
+		if _, ok := selftest.pending[token]; !ok {
+			return
+		}
+		delete(selftest.pending, token)
+	}
+	selftest.ran = true
+	selftest.success = false
+	selftest.failures++
+}
+
+func selftestSend() {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatal(err)
+	}
+	token := hex.EncodeToString(buf)
+	sender := selftestPrefix + token + "@" + hostname()
+
+	selftest.Lock()
+	selftest.pending[token] = time.Now()
+	selftest.Unlock()
+
+	cmd := exec.Command(*selftestSendmail, "-f", sender, "--", *selftestRcpt)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("From: <%s>\nTo: <%s>\nSubject: filter-prometheus self-test %s\nDate: %s\n\nself-test\n",
+		sender, *selftestRcpt, token, time.Now().Format(time.RFC1123Z)))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("selftest: %s: %v: %s", *selftestSendmail, err, strings.TrimSpace(string(out)))
+		selftestFailed(token)
+		return
+	}
+
+	time.AfterFunc(*selftestDeadline, func() { selftestFailed(token) })
+}
+
+func selftestInit() {
+	if *selftestInterval == 0 {
+		return
+	}
+	if *selftestRcpt == "" {
+		log.Fatal("-selftest-interval requires -selftest-rcpt")
+	}
+	if *selftestDeadline <= 0 || *selftestDeadline > *selftestInterval {
+		log.Fatalf("invalid selftest deadline: %s", *selftestDeadline)
+	}
+	go func() {
+		for range time.Tick(*selftestInterval) {
+			selftestSend()
+		}
+	}()
+}
+
+func selftestCollector(e *exposition) {
+	if *selftestInterval == 0 {
+		return
+	}
+	selftest.Lock()
+	defer selftest.Unlock()
+
+	e.header("smtpd_selftest_success", "Whether the last self-test message went through smtpd and the filter in time.", "gauge", nil)
+	if selftest.ran {
+		success := 0.0
+		if selftest.success {
+			success = 1
+		}
+		e.sample("smtpd_selftest_success", "", success)
+	}
+	e.end()
+
+	e.header("smtpd_selftest_last_success_timestamp_seconds", "The last time a self-test message went through.", "gauge", nil)
+	if !selftest.lastOK.IsZero() {
+		e.sample("smtpd_selftest_last_success_timestamp_seconds", "", float64(selftest.lastOK.Unix()))
+	}
+	e.end()
+
+	e.header("smtpd_selftest_duration_seconds", "The time it took the last successful self-test message to go through.", "gauge", nil)
+	if !selftest.lastOK.IsZero() {
+		e.sample("smtpd_selftest_duration_seconds", "", selftest.duration)
+	}
+	e.end()
+
+	e.header("smtpd_selftest_failures_total", "The number of self-test messages that failed or missed the deadline.", "counter", nil)
+	e.sample("smtpd_selftest_failures_total", "", float64(selftest.failures))
+	e.end()
+}
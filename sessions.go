@@ -0,0 +1,80 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+)
+
+var sessionShards *int
+
+// sessionStore holds the sessions in lock-striped shards keyed by session
+// ID, so that concurrent lookups on busy relays don't contend on a single
+// map.
+type sessionStore struct {
+	shards []sessionShard
+}
+
+type sessionShard struct {
+	sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore(shards int) *sessionStore {
+	store := &sessionStore{shards: make([]sessionShard, shards)}
+	for i := range store.shards {
+		store.shards[i].sessions = make(map[string]*session)
+	}
+	return store
+}
+
+func (store *sessionStore) shard(id string) *sessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &store.shards[h.Sum32()%uint32(len(store.shards))]
+}
+
+func (store *sessionStore) get(id string) (*session, bool) {
+	shard := store.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	s, ok := shard.sessions[id]
+	return s, ok
+}
+
+func (store *sessionStore) set(s *session) {
+	shard := store.shard(s.id)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.sessions[s.id] = s
+}
+
+func (store *sessionStore) delete(id string) {
+	shard := store.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.sessions, id)
+}
+
+func sessionsInit() {
+	if *sessionShards < 1 {
+		log.Fatalf("invalid session shards: %d", *sessionShards)
+	}
+	sessions = newSessionStore(*sessionShards)
+}
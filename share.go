@@ -0,0 +1,102 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+var shareSocket *string
+
+// exporterListen binds the exporter address, it returns nil when binding
+// is to be retried by exporterServe. With -share, the filter binding it
+// also returns the socket its siblings forward to, and a filter finding
+// it taken by another instance of the filter, attached under a different
+// name in smtpd.conf, becomes a shim forwarding its events to that instance.
+func exporterListen() (net.Listener, net.Listener) {
+	listener, err := net.Listen("tcp", *exporter)
+	if err == nil {
+		if *shareSocket != "" {
+			return listener, daemonListen(*shareSocket)
+		}
+		return listener, nil
+	}
+	if !addressInUse(err) {
+		log.Fatal(err)
+	}
+	// an instance sharing the exporter is no previous process
+	if *handoffFile != "" && *shareSocket == "" {
+		if listener := handoffAcquire(); listener != nil {
+			return listener, nil
+		}
+	}
+	if *shareSocket == "" {
+		if exporterDeferred() {
+			return nil, nil
+		}
+		log.Fatal(err)
+	}
+
+	// the instance owning the port may still be setting up its socket
+	for i := 0; i < 10; i++ {
+		if conn, derr := net.DialTimeout("unix", *shareSocket, time.Second); derr == nil {
+			conn.Close()
+			sharedInstanceName()
+			forward(*shareSocket)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if exporterDeferred() {
+		return nil, nil
+	}
+	log.Fatalf("%v, and no filter is listening on %s", err, *shareSocket)
+	return nil, nil
+}
+
+func addressInUse(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.EADDRINUSE
+		}
+	}
+	return false
+}
+
+// sharedInstanceName tells apart the filters of a same smtpd forwarding to
+// the instance owning the exporter, unless named with -instance.
+func sharedInstanceName() {
+	named := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "instance" {
+			named = true
+		}
+	})
+	if !named {
+		*instanceName = fmt.Sprintf("%s/%d", hostname(), os.Getpid())
+	}
+}
+
+// daemonMode is true when events may be forwarded by shims.
+func daemonMode() bool {
+	return *daemonSocket != "" || *shareSocket != ""
+}
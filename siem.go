@@ -0,0 +1,157 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var siemTarget *string
+var siemFormat *string
+
+// protocol versions considered a downgrade when negotiated.
+var legacyTLS = map[string]bool{
+	"SSLv3":   true,
+	"TLSv1":   true,
+	"TLSv1.0": true,
+	"TLSv1.1": true,
+}
+
+// tlsParam extracts a field from link-tls parameters, such as
+// "version=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256".
+func tlsParam(params string, key string) string {
+	for _, field := range strings.Split(params, ",") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, key+"=") {
+			return strings.TrimPrefix(field, key+"=")
+		}
+	}
+	return ""
+}
+
+func tlsVersion(params string) string {
+	return tlsParam(params, "version")
+}
+
+type siemEvent struct {
+	name     string
+	severity int
+}
+
+var siemEvents = map[string]siemEvent{
+	"auth_failure":           {"Authentication failure", 3},
+	"auth_brute_force":       {"Authentication brute force", 7},
+	"early_talker":           {"Client talked before the banner", 5},
+	"tls_downgrade":          {"Legacy TLS version negotiated", 5},
+	"delivery_failure_spike": {"Delivery failure spike", 5},
+}
+
+// field names in each format, fields without one are sent as custom
+// strings in CEF and as is in LEEF.
+var cefKeys = map[string]string{"ip": "src", "user": "suser", "reason": "reason"}
+var leefKeys = map[string]string{"ip": "src", "user": "usrName", "reason": "reason"}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+var leefValueEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+func sortedFields(fields map[string]string) []string {
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatCEF(r *notableRecord) string {
+	event := siemEvents[r.Kind]
+	extension := []string{"rt=" + strconv.FormatInt(r.Timestamp.UnixNano()/1e6, 10)}
+	custom := 0
+	for _, key := range sortedFields(r.Fields) {
+		value := cefValueEscaper.Replace(r.Fields[key])
+		if name, ok := cefKeys[key]; ok {
+			extension = append(extension, name+"="+value)
+			continue
+		}
+		if custom == 6 {
+			continue
+		}
+		custom++
+		extension = append(extension, fmt.Sprintf("cs%d=%s cs%dLabel=%s", custom, value, custom, key))
+	}
+	return fmt.Sprintf("CEF:0|OpenSMTPD|filter-prometheus|1.0|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(r.Kind), cefHeaderEscaper.Replace(event.name),
+		event.severity, strings.Join(extension, " "))
+}
+
+func formatLEEF(r *notableRecord) string {
+	event := siemEvents[r.Kind]
+	// without devTimeFormat, devTime is in milliseconds since the epoch
+	attributes := []string{
+		"devTime=" + strconv.FormatInt(r.Timestamp.UnixNano()/1e6, 10),
+		"sev=" + strconv.Itoa(event.severity),
+	}
+	for _, key := range sortedFields(r.Fields) {
+		name, ok := leefKeys[key]
+		if !ok {
+			name = key
+		}
+		attributes = append(attributes, name+"="+leefValueEscaper.Replace(r.Fields[key]))
+	}
+	return fmt.Sprintf("LEEF:1.0|OpenSMTPD|filter-prometheus|1.0|%s|%s",
+		r.Kind, strings.Join(attributes, "\t"))
+}
+
+func siemInit() {
+	if *siemTarget == "" {
+		return
+	}
+	format := formatCEF
+	switch *siemFormat {
+	case "cef":
+	case "leef":
+		format = formatLEEF
+	default:
+		log.Fatalf("invalid siem format: %s", *siemFormat)
+	}
+	w, err := newSyslogWriter(*siemTarget)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.newline = true
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+
+	// collectors expect records wrapped in an RFC 3164 syslog header, they
+	// are sent with the auth facility
+	addSink("siem", []string{"notable", "security"}, func(r interface{}) error {
+		if r, ok := r.(*notableRecord); ok {
+			return w.write(fmt.Sprintf("<%d>%s %s %s", 4*8+syslogWarning,
+				r.Timestamp.Format(time.Stamp), hostname, format(r)))
+		}
+		return nil
+	})
+}
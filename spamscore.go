@@ -0,0 +1,127 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var spamScoreHeaders *string
+
+// spamHeaders are the headers, lowercased, in which a scanner earlier in
+// the filter chain reports its score.
+var spamHeaders = make(map[string]bool)
+
+var spamScoreBuckets = []float64{0, 1, 2, 3, 5, 7.5, 10, 15, 20, 30}
+
+// scoreHeader records the score of the first of the configured headers:
+// scanners prepend theirs, a copy forged by the sender comes after it.
+func (msg *message) scoreHeader(name string, value string) {
+	if len(spamHeaders) == 0 || msg.inBody || msg.scored || !spamHeaders[strings.ToLower(name)] {
+		return
+	}
+	if score, ok := spamScore(value); ok {
+		msg.score = score
+		msg.scored = true
+	}
+}
+
+// spamScore parses the score out of the header formats of rspamd and
+// SpamAssassin:
+//
+//	X-Rspamd-Score: 3.20
+//	X-Spamd-Result: default: False [3.20 / 15.00]; ...
+//	X-Spam-Status: No, score=3.2 required=5.0 tests=...
+//	X-Spam-Score: 3.2
+func spamScore(value string) (float64, bool) {
+	if i := strings.Index(value, "score="); i != -1 {
+		value = value[i+len("score="):]
+	} else if i := strings.IndexByte(value, '['); i != -1 {
+		value = value[i+1:]
+	}
+	value = strings.TrimSpace(value)
+	end := 0
+	for end < len(value) && strings.IndexByte("+-.0123456789", value[end]) != -1 {
+		end++
+	}
+	score, err := strconv.ParseFloat(value[:end], 64)
+	return score, err == nil
+}
+
+// accountSpamScore is called at the end of a message, the score goes to
+// the tenant of the sender domain so that a customer whose traffic turns
+// spammy stands out before the shared addresses get listed.
+func accountSpamScore(m *metrics, s *session) {
+	if !s.msg.scored || m.spamScores == nil {
+		return
+	}
+	tenant, ok := tenantOf(s.mailDomain)
+	if !ok {
+		tenant = "other"
+	}
+	h, ok := m.spamScores[tenant]
+	if !ok {
+		h = newHistogram(spamScoreBuckets...)
+		m.spamScores[tenant] = h
+	}
+	h.observe(s.msg.score)
+}
+
+func spamScoresInit() {
+	for _, header := range strings.Split(*spamScoreHeaders, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			spamHeaders[strings.ToLower(header)] = true
+		}
+	}
+	if len(spamHeaders) == 0 {
+		return
+	}
+	if !*passthrough {
+		log.Fatal("-spam-score-headers requires -passthrough")
+	}
+
+	for _, m := range metricSets {
+		if m.direction != "smtp-in" {
+			continue
+		}
+		m.spamScores = map[string]*histogram{"other": newHistogram(spamScoreBuckets...)}
+		for _, tenant := range tenants {
+			m.spamScores[tenant] = newHistogram(spamScoreBuckets...)
+		}
+	}
+}
+
+func spamCollector(e *exposition) {
+	if len(spamHeaders) == 0 {
+		return
+	}
+	e.header("smtpd_message_spam_score", "The spam score of messages per sender tenant, as reported by a scanner earlier in the filter chain.", "histogram", e.inbound(), "tenant")
+	for _, m := range e.inbound() {
+		names := make([]string, 0, len(m.spamScores))
+		for tenant := range m.spamScores {
+			names = append(names, tenant)
+		}
+		sort.Strings(names)
+		for _, tenant := range names {
+			e.histogram("smtpd_message_spam_score", m.labels()+","+label("tenant", tenant), m.spamScores[tenant])
+		}
+	}
+	e.end()
+}
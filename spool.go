@@ -0,0 +1,149 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var spoolPath *string
+var spoolInterval *time.Duration
+
+type spoolUsage struct {
+	bytes uint64
+	files uint64
+}
+
+var spool = struct {
+	sync.Mutex
+	success bool
+	dirs    map[string]spoolUsage
+
+	// free space and inodes of the partition, when they could be read
+	free       bool
+	bytesFree  uint64
+	inodesFree uint64
+}{dirs: make(map[string]spoolUsage)}
+
+// scanSpool accounts for usage per top-level directory of the spool
+// (queue, incoming, corrupt, ...), every entry consumes an inode.
+func scanSpool() {
+	dirs := make(map[string]spoolUsage)
+	err := filepath.Walk(*spoolPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files come and go while smtpd runs
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(*spoolPath, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		dir := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+
+		usage := dirs[dir]
+		usage.files++
+		if info.Mode().IsRegular() {
+			usage.bytes += uint64(info.Size())
+		}
+		dirs[dir] = usage
+		return nil
+	})
+	if err != nil {
+		log.Printf("spool: %v", err)
+	}
+
+	// full partitions and inode exhaustion stop smtpd alike
+	bytesFree, inodesFree, ferr := spoolFree(*spoolPath)
+	if ferr != nil {
+		log.Printf("spool: %v", ferr)
+	}
+
+	spool.Lock()
+	defer spool.Unlock()
+	spool.success = err == nil
+	if err == nil {
+		spool.dirs = dirs
+	}
+	spool.free = ferr == nil
+	spool.bytesFree, spool.inodesFree = bytesFree, inodesFree
+}
+
+func spoolInit() {
+	if *spoolPath == "" {
+		return
+	}
+	go func() {
+		for {
+			scanSpool()
+			time.Sleep(*spoolInterval)
+		}
+	}()
+}
+
+func spoolCollector(e *exposition) {
+	if *spoolPath == "" {
+		return
+	}
+
+	spool.Lock()
+	defer spool.Unlock()
+
+	dirs := make([]string, 0, len(spool.dirs))
+	for dir := range spool.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	e.header("smtpd_spool_bytes", "The size of the files in the spool.", "gauge", nil, "dir")
+	for _, dir := range dirs {
+		e.sample("smtpd_spool_bytes", label("dir", dir), float64(spool.dirs[dir].bytes))
+	}
+	e.end()
+
+	e.header("smtpd_spool_files", "The number of files and directories in the spool.", "gauge", nil, "dir")
+	for _, dir := range dirs {
+		e.sample("smtpd_spool_files", label("dir", dir), float64(spool.dirs[dir].files))
+	}
+	e.end()
+
+	if spool.free {
+		e.header("smtpd_spool_bytes_free", "The space available to smtpd on the spool partition.", "gauge", nil)
+		e.sample("smtpd_spool_bytes_free", "", float64(spool.bytesFree))
+		e.end()
+
+		e.header("smtpd_spool_inodes_free", "The number of free inodes on the spool partition.", "gauge", nil)
+		e.sample("smtpd_spool_inodes_free", "", float64(spool.inodesFree))
+		e.end()
+	}
+
+	success := 0
+	if spool.success {
+		success = 1
+	}
+	e.header("smtpd_spool_scan_success", "Whether the last scan of the spool succeeded.", "gauge", nil)
+	e.sample("smtpd_spool_scan_success", "", float64(success))
+	e.end()
+}
@@ -0,0 +1,101 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var stateFile *string
+
+var startTime = time.Now()
+
+// state is what survives a restart of the filter.
+type state struct {
+	Restarts uint64 `json:"restarts"`
+}
+
+var persisted state
+
+func loadState() {
+	data, err := ioutil.ReadFile(*stateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		log.Fatalf("%s: %v", *stateFile, err)
+	}
+	persisted.Restarts++
+}
+
+func saveState() error {
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	// write and rename so a crash never leaves a truncated state file
+	tmp, err := ioutil.TempFile(filepath.Dir(*stateFile), ".filter-prometheus")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), *stateFile)
+}
+
+func stateInit() {
+	if *stateFile == "" {
+		return
+	}
+	loadState()
+	if err := saveState(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func filterCollector(e *exposition) {
+	e.header("smtpd_filter_start_time_seconds", "The time at which the filter started.", "gauge", nil)
+	e.sample("smtpd_filter_start_time_seconds", "", float64(startTime.Unix()))
+	e.end()
+
+	e.header("smtpd_filter_restarts_total", "The number of times the filter was restarted.", "counter", nil)
+	e.sample("smtpd_filter_restarts_total", "", float64(persisted.Restarts))
+	e.end()
+
+	buildInfoCollector(e)
+	registrationCollector(e)
+	handshakeCollector(e)
+	exporterCollector(e)
+	warmStartCollector(e)
+	reconnectsCollector(e)
+}
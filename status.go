@@ -0,0 +1,82 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// highest detail of each subject of enhanced status codes, as registered
+// by RFC 3463 and its updates, codes beyond are exposed as other so that
+// a remote server can't create series at will.
+var enhancedDetails = []int{0, 10, 4, 6, 7, 6, 10, 27}
+
+// enhancedStatus returns the class, subject and detail of the enhanced
+// status code of a response, multi-line responses being accounted for
+// on their last line.
+func enhancedStatus(response string) (string, string, string, bool) {
+	if len(response) < 4 || response[3] != ' ' {
+		return "", "", "", false
+	}
+	if response[0] != '2' && response[0] != '4' && response[0] != '5' {
+		return "", "", "", false
+	}
+	code := response[4:]
+	if i := strings.IndexByte(code, ' '); i != -1 {
+		code = code[:i]
+	}
+	fields := strings.Split(code, ".")
+	if len(fields) != 3 || fields[0] != response[:1] {
+		return "", "", "", false
+	}
+	subject, err := strconv.Atoi(fields[1])
+	if err != nil || len(fields[1]) > 3 {
+		return "", "", "", false
+	}
+	detail, err := strconv.Atoi(fields[2])
+	if err != nil || len(fields[2]) > 3 {
+		return "", "", "", false
+	}
+	if subject < 0 || subject >= len(enhancedDetails) || detail < 0 || detail > enhancedDetails[subject] {
+		return fields[0], "other", "other", true
+	}
+	return fields[0], strconv.Itoa(subject), strconv.Itoa(detail), true
+}
+
+func accountEnhancedStatus(m *metrics, response string) {
+	if class, subject, detail, ok := enhancedStatus(response); ok {
+		m.responsesEnhanced[class+"."+subject+"."+detail]++
+	}
+}
+
+func responsesCollector(e *exposition) {
+	e.header("smtpd_responses_enhanced_total", "The number of responses per enhanced status code.", "counter", e.sets, "class", "subject", "detail")
+	for _, m := range e.sets {
+		codes := make([]string, 0, len(m.responsesEnhanced))
+		for code := range m.responsesEnhanced {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fields := strings.SplitN(code, ".", 3)
+			e.sample("smtpd_responses_enhanced_total", m.labels()+","+label("class", fields[0])+","+label("subject", fields[1])+","+label("detail", fields[2]), float64(m.responsesEnhanced[code]))
+		}
+	}
+	e.end()
+}
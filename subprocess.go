@@ -0,0 +1,288 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var plugins = namedValues{}
+
+var subprocesses []*subprocess
+
+// owners of the plugin metric families, two plugins can't share one.
+var pluginFamilies = struct {
+	sync.Mutex
+	owners map[string]string
+}{owners: make(map[string]string)}
+
+var metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// pluginUpdate is a metric update written by a plugin, one per line.
+type pluginUpdate struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Help   string            `json:"help"`
+	Labels map[string]string `json:"labels"`
+	Op     string            `json:"op"`
+	Value  float64           `json:"value"`
+}
+
+type pluginFamily struct {
+	kind   string
+	help   string
+	labels []string
+	series map[string]float64
+}
+
+// metricStore holds the metrics updated by a plugin or a script.
+type metricStore struct {
+	name string
+
+	sync.Mutex
+	families map[string]*pluginFamily
+	series   int
+}
+
+func newMetricStore(name string) *metricStore {
+	return &metricStore{name: name, families: make(map[string]*pluginFamily)}
+}
+
+// subprocess is a collector implemented by an external program: events
+// are written to its stdin as JSON lines, it answers with metric updates
+// on its stdout whenever it sees fit.
+type subprocess struct {
+	*metricStore
+	command string
+	events  chan *Event
+
+	dropped  uint64
+	invalid  uint64
+	restarts uint64
+}
+
+func (p *metricStore) Name() string {
+	return p.name
+}
+
+// Event never blocks, events are dropped while the plugin falls behind.
+func (p *subprocess) Event(ev *Event) {
+	select {
+	case p.events <- ev:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+func (p *metricStore) apply(u *pluginUpdate) bool {
+	if !metricName.MatchString(u.Name) || strings.HasPrefix(u.Name, "smtpd_") {
+		return false
+	}
+	if u.Type != "counter" && u.Type != "gauge" {
+		return false
+	}
+	names := make([]string, 0, len(u.Labels))
+	for name := range u.Labels {
+		if !labelName.MatchString(name) {
+			return false
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labels := []string{}
+	for _, name := range names {
+		value, ok := sanitizeLabel(u.Labels[name])
+		if !ok {
+			return false
+		}
+		labels = append(labels, label(name, value))
+	}
+	key := strings.Join(labels, ",")
+
+	p.Lock()
+	defer p.Unlock()
+	family, ok := p.families[u.Name]
+	if !ok {
+		pluginFamilies.Lock()
+		owner, owned := pluginFamilies.owners[u.Name]
+		if !owned {
+			pluginFamilies.owners[u.Name] = p.name
+		}
+		pluginFamilies.Unlock()
+		if owned && owner != p.name {
+			return false
+		}
+		family = &pluginFamily{kind: u.Type, help: u.Help, series: make(map[string]float64)}
+		p.families[u.Name] = family
+	}
+	if family.kind != u.Type {
+		return false
+	}
+	if _, ok := family.series[key]; !ok {
+		if p.series >= *maxSeries {
+			return false
+		}
+		p.series++
+		for _, name := range names {
+			if !containsString(family.labels, name) {
+				family.labels = append(family.labels, name)
+			}
+		}
+	}
+
+	switch {
+	case u.Op == "set" && u.Type == "gauge":
+		family.series[key] = u.Value
+	case u.Op == "add" || u.Op == "inc":
+		if u.Op == "inc" {
+			u.Value = 1
+		}
+		if u.Type == "counter" && u.Value < 0 {
+			return false
+		}
+		family.series[key] += u.Value
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *subprocess) run() error {
+	cmd := exec.Command("/bin/sh", "-c", p.command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		enc := json.NewEncoder(stdin)
+		for {
+			select {
+			case ev := <-p.events:
+				if enc.Encode(ev) != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		u := &pluginUpdate{}
+		if json.Unmarshal(scanner.Bytes(), u) != nil || !p.apply(u) {
+			atomic.AddUint64(&p.invalid, 1)
+		}
+	}
+	close(done)
+	stdin.Close()
+	return cmd.Wait()
+}
+
+func (p *metricStore) Collect(e *exposition) {
+	p.Lock()
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := p.families[name]
+		e.header(name, family.help, family.kind, nil, family.labels...)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			e.sample(name, key, family.series[key])
+		}
+		e.end()
+	}
+	p.Unlock()
+}
+
+func pluginsCollector(e *exposition) {
+	families := []struct {
+		name  string
+		help  string
+		value func(*subprocess) *uint64
+	}{
+		{"smtpd_plugin_events_dropped_total", "The number of events dropped because a plugin fell behind.", func(p *subprocess) *uint64 { return &p.dropped }},
+		{"smtpd_plugin_updates_invalid_total", "The number of invalid metric updates written by a plugin.", func(p *subprocess) *uint64 { return &p.invalid }},
+		{"smtpd_plugin_restarts_total", "The number of times a plugin was restarted.", func(p *subprocess) *uint64 { return &p.restarts }},
+	}
+	for _, family := range families {
+		e.header(family.name, family.help, "counter", nil, "plugin")
+		for _, p := range subprocesses {
+			e.sample(family.name, label("plugin", p.name), float64(atomic.LoadUint64(family.value(p))))
+		}
+		e.end()
+	}
+}
+
+func pluginsInit() {
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := &subprocess{
+			metricStore: newMetricStore(name),
+			command:     plugins[name],
+			events:      make(chan *Event, 4096),
+		}
+		RegisterCollector(p)
+		subprocesses = append(subprocesses, p)
+		go func() {
+			for {
+				if err := p.run(); err != nil {
+					log.Printf("plugin %s: %v", p.name, err)
+				}
+				// a crashing plugin is restarted, after a pause
+				time.Sleep(5 * time.Second)
+				atomic.AddUint64(&p.restarts, 1)
+			}
+		}()
+	}
+	if len(subprocesses) != 0 {
+		registerCollector("plugins", pluginsCollector)
+	}
+}
@@ -0,0 +1,144 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var syslogTarget *string
+var syslogFacility *string
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+const syslogWarning = 4
+
+// the structured data ID uses the enterprise number reserved for examples
+// in RFC 5424, there's no registered one for the filter.
+const syslogSDID = "filter-prometheus@32473"
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// formatSyslog formats a notable event as an RFC 5424 message.
+func formatSyslog(facility int, hostname string, r *notableRecord) string {
+	keys := []string{}
+	for key := range r.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sd := "[" + syslogSDID + " kind=\"" + sdEscaper.Replace(r.Kind) + "\""
+	message := r.Kind
+	for _, key := range keys {
+		sd += " " + key + "=\"" + sdEscaper.Replace(r.Fields[key]) + "\""
+		message += " " + key + "=" + r.Fields[key]
+	}
+	sd += "]"
+
+	return fmt.Sprintf("<%d>1 %s %s filter-prometheus %d %s %s %s",
+		facility*8+syslogWarning, r.Timestamp.UTC().Format(time.RFC3339Nano),
+		hostname, os.Getpid(), r.Kind, sd, message)
+}
+
+// syslogWriter sends messages to udp://, tcp:// or unix:// targets, TCP
+// uses octet counting framing (RFC 6587) unless newline framing is asked.
+type syslogWriter struct {
+	network string
+	address string
+	newline bool
+	conn    net.Conn
+}
+
+func (w *syslogWriter) write(message string) error {
+	if w.conn == nil {
+		conn, err := net.DialTimeout(w.network, w.address, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+
+	if w.network == "tcp" {
+		if w.newline {
+			message += "\n"
+		} else {
+			message = fmt.Sprintf("%d %s", len(message), message)
+		}
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := w.conn.Write([]byte(message)); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+func newSyslogWriter(target string) (*syslogWriter, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "514")
+		}
+		return &syslogWriter{network: u.Scheme, address: address}, nil
+	case "unix":
+		return &syslogWriter{network: "unixgram", address: u.Path}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported syslog target", target)
+}
+
+func syslogInit() {
+	if *syslogTarget == "" {
+		return
+	}
+	facility, ok := syslogFacilities[*syslogFacility]
+	if !ok {
+		log.Fatalf("invalid syslog facility: %s", *syslogFacility)
+	}
+	w, err := newSyslogWriter(*syslogTarget)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	addSink("syslog", []string{"notable"}, func(r interface{}) error {
+		if r, ok := r.(*notableRecord); ok {
+			return w.write(formatSyslog(facility, hostname, r))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,173 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var quantileWindowWidth *time.Duration
+
+// quantiles exposed as gauges, for tools that can't histogram_quantile().
+var quantiles = []float64{0.5, 0.95, 0.99}
+
+const tdigestCompression = 100
+
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+// tdigest is a merging t-digest: observations are buffered and merged into
+// centroids that are smaller near the tails, where accuracy matters most.
+type tdigest struct {
+	centroids []centroid
+	buffer    []centroid
+	total     float64
+}
+
+func (t *tdigest) add(value float64, count float64) {
+	t.buffer = append(t.buffer, centroid{value, count})
+	t.total += count
+	if len(t.buffer) >= 5*tdigestCompression {
+		t.compress()
+	}
+}
+
+func (t *tdigest) merge(o *tdigest) {
+	for _, c := range o.centroids {
+		t.add(c.mean, c.count)
+	}
+	for _, c := range o.buffer {
+		t.add(c.mean, c.count)
+	}
+}
+
+func (t *tdigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := []centroid{all[0]}
+	seen := 0.0
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		q := (seen + last.count/2) / t.total
+		if last.count+c.count <= 4*t.total*q*(1-q)/tdigestCompression {
+			last.mean += (c.mean - last.mean) * c.count / (last.count + c.count)
+			last.count += c.count
+			continue
+		}
+		seen += last.count
+		merged = append(merged, c)
+	}
+	t.centroids = merged
+	t.buffer = nil
+}
+
+// quantile interpolates between the centroids surrounding the rank of q.
+func (t *tdigest) quantile(q float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 {
+		return math.NaN()
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].mean
+	}
+
+	rank := q * t.total
+	seen := 0.0
+	for i, c := range t.centroids {
+		if rank < seen+c.count/2 {
+			if i == 0 {
+				return c.mean
+			}
+			previous := t.centroids[i-1]
+			start := seen - previous.count/2
+			return previous.mean + (c.mean-previous.mean)*(rank-start)/(seen+c.count/2-start)
+		}
+		seen += c.count
+	}
+	return t.centroids[len(t.centroids)-1].mean
+}
+
+const quantileSlots = 5
+
+// quantileWindow keeps the observations of the last -quantile-window in
+// slots that are dropped as time goes by.
+type quantileWindow struct {
+	digests [quantileSlots]*tdigest
+	starts  [quantileSlots]time.Time
+}
+
+// quantileWindowInit checks that the window is wide enough to be split in
+// slots, slot would divide by zero otherwise.
+func quantileWindowInit() {
+	if *quantileWindowWidth != 0 && *quantileWindowWidth < quantileSlots {
+		log.Fatalf("invalid quantile window: %v", *quantileWindowWidth)
+	}
+}
+
+func (w *quantileWindow) slot(now time.Time) int {
+	width := *quantileWindowWidth / quantileSlots
+	start := now.Truncate(width)
+	i := int(start.UnixNano()/int64(width)) % quantileSlots
+	if !w.starts[i].Equal(start) {
+		w.digests[i] = &tdigest{}
+		w.starts[i] = start
+	}
+	return i
+}
+
+func (w *quantileWindow) observe(now time.Time, value float64) {
+	if *quantileWindowWidth == 0 {
+		return
+	}
+	w.digests[w.slot(now)].add(value, 1)
+}
+
+func (w *quantileWindow) digest(now time.Time) *tdigest {
+	merged := &tdigest{}
+	for i, d := range w.digests {
+		if d != nil && now.Sub(w.starts[i]) < *quantileWindowWidth {
+			merged.merge(d)
+		}
+	}
+	return merged
+}
+
+func newQuantileWindows(names []string) map[string]*quantileWindow {
+	windows := make(map[string]*quantileWindow)
+	for _, name := range names {
+		windows[name] = &quantileWindow{}
+	}
+	return windows
+}
+
+// quantileGauges exposes the quantiles of a window, NaN when it is empty.
+func (e *exposition) quantileGauges(name string, labels string, w *quantileWindow) {
+	d := w.digest(time.Now())
+	for _, q := range quantiles {
+		e.sample(name, labels+","+label("quantile", strconv.FormatFloat(q, 'f', -1, 64)), d.quantile(q))
+	}
+}
@@ -0,0 +1,230 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var domainMetrics *bool
+var tenantsFile *string
+
+// tenants maps sender and recipient domains to the customers they belong
+// to, subdomains belong to the tenant of their parent domain.
+var tenants map[string]string
+
+// usage is what a domain or tenant sent or received, the sender role
+// accounts for messages sent from it, the recipient role for messages
+// sent to it.
+type usage struct {
+	messages   uint64
+	recipients uint64
+	bytes      uint64
+	created    time.Time
+}
+
+type usageKey struct {
+	role string
+	name string
+}
+
+func loadTenants(path string) (map[string]string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	mapping := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			log.Fatalf("%s:%d: expected a domain and a tenant", path, lineno)
+		}
+		mapping[normalizeDomain(fields[0])] = fields[1]
+	}
+	return mapping, scanner.Err()
+}
+
+func tenantOf(domain string) (string, bool) {
+	for domain != "" {
+		if tenant, ok := tenants[domain]; ok {
+			return tenant, true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i == -1 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return "", false
+}
+
+// domainLabel is the label value of a domain, or of its bucket in the
+// domains bucket map.
+func domainLabel(domain string) (string, bool) {
+	if bucket, ok := bucketOf("domains", domain); ok {
+		return bucket, true
+	}
+	return dynamicLabel("smtpd_domain", domain)
+}
+
+type usageTable map[usageKey]*usage
+
+func (t usageTable) register(key usageKey) *usage {
+	u, ok := t[key]
+	if !ok {
+		u = &usage{created: time.Now()}
+		t[key] = u
+	}
+	return u
+}
+
+func (t usageTable) add(key usageKey, recipients uint64, bytes uint64) {
+	u := t.register(key)
+	u.messages++
+	u.recipients += recipients
+	u.bytes += bytes
+}
+
+func (t usageTable) keys() []usageKey {
+	keys := []usageKey{}
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].role != keys[j].role {
+			return keys[i].role < keys[j].role
+		}
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
+
+// accountTransaction is called on commit with the domains gathered along
+// the transaction, a message to several domains of a tenant is accounted
+// once for that tenant.
+func accountTransaction(m *metrics, s *session, bytes uint64) {
+	if !*domainMetrics && tenants == nil {
+		return
+	}
+
+	recipients := uint64(0)
+	perTenant := make(map[string]uint64)
+	for domain, count := range s.rcptDomains {
+		recipients += count
+		if *domainMetrics {
+			if name, ok := domainLabel(domain); ok {
+				m.domainUsage.add(usageKey{"recipient", name}, count, bytes)
+			}
+		}
+		if tenant, ok := tenantOf(domain); ok {
+			perTenant[tenant] += count
+		}
+	}
+	for tenant, count := range perTenant {
+		m.tenantUsage.add(usageKey{"recipient", tenant}, count, bytes)
+		accountDaily(m, s.timestamp, "recipient", tenant, count, bytes)
+	}
+
+	if s.mailDomain == "" {
+		return
+	}
+	if *domainMetrics {
+		if name, ok := domainLabel(s.mailDomain); ok {
+			m.domainUsage.add(usageKey{"sender", name}, recipients, bytes)
+		}
+	}
+	if tenant, ok := tenantOf(s.mailDomain); ok {
+		m.tenantUsage.add(usageKey{"sender", tenant}, recipients, bytes)
+		accountDaily(m, s.timestamp, "sender", tenant, recipients, bytes)
+	}
+}
+
+func tenantsInit() {
+	if *tenantsFile == "" {
+		return
+	}
+	mapping, err := loadTenants(*tenantsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tenants = mapping
+
+	// configured domains and tenants are exposed before their first
+	// message so that increase() sees it
+	for _, m := range metricSets {
+		for domain, tenant := range tenants {
+			for _, role := range []string{"sender", "recipient"} {
+				m.tenantUsage.register(usageKey{role, tenant})
+				if !*domainMetrics {
+					continue
+				}
+				if name, ok := domainLabel(domain); ok {
+					m.domainUsage.register(usageKey{role, name})
+				}
+			}
+		}
+	}
+}
+
+func (e *exposition) usage(prefix string, labelName string, table func(*metrics) usageTable) {
+	families := []struct {
+		suffix string
+		help   string
+		value  func(*usage) uint64
+	}{
+		{"messages_total", "The number of messages committed.", func(u *usage) uint64 { return u.messages }},
+		{"recipients_total", "The number of recipients of committed messages.", func(u *usage) uint64 { return u.recipients }},
+		{"bytes_total", "The size of committed messages.", func(u *usage) uint64 { return u.bytes }},
+	}
+	for _, family := range families {
+		name := prefix + family.suffix
+		e.header(name, family.help, "counter", e.sets, labelName, "role")
+		for _, m := range e.sets {
+			t := table(m)
+			for _, key := range t.keys() {
+				labels := m.labels() + "," + label(labelName, key.name) + "," + label("role", key.role)
+				e.sample(name, labels, float64(family.value(t[key])))
+				e.created(name, labels, t[key].created)
+			}
+		}
+		e.end()
+	}
+}
+
+func domainsCollector(e *exposition) {
+	if *domainMetrics {
+		e.usage("smtpd_domain_", "domain", func(m *metrics) usageTable { return m.domainUsage })
+	}
+	if tenants != nil {
+		e.usage("smtpd_tenant_", "tenant", func(m *metrics) usageTable { return m.tenantUsage })
+	}
+}
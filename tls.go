@@ -0,0 +1,252 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsCerts = namedValues{}
+var tlsProbes = namedValues{}
+var tlsCertInterval *time.Duration
+var tlsHostnames = stringValues{}
+
+// SNI of smtp-in TLS sessions, guarded by metricsLock.
+var tlsSNI = make(map[string]uint64)
+
+type certStatus struct {
+	expiry time.Time
+	err    error
+}
+
+var certs = struct {
+	sync.Mutex
+	listeners map[string]certStatus
+}{listeners: make(map[string]certStatus)}
+
+func readCertExpiry(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// the first certificate of a chain is the leaf
+	var block *pem.Block
+	for {
+		block, data = pem.Decode(data)
+		if block == nil || block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+	if block == nil {
+		return time.Time{}, fmt.Errorf("%s: no certificate found", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// dialSMTP connects to an SMTP listener and returns the TLS state once
+// the connection is secured, either right away for smtps listeners
+// (port 465) or after STARTTLS.
+func dialSMTP(address string, timeout time.Duration) (*smtp.Client, *tls.ConnectionState, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: true}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if port == "465" {
+		conn = tls.Client(conn, config)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	if err := client.Hello(hostname); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+
+	if state, ok := client.TLSConnectionState(); ok {
+		return client, &state, nil
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		return client, nil, nil
+	}
+	if err := client.StartTLS(config); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	state, _ := client.TLSConnectionState()
+	return client, &state, nil
+}
+
+func probeCertExpiry(address string) (time.Time, error) {
+	client, state, err := dialSMTP(address, 30*time.Second)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer client.Quit()
+
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return time.Time{}, fmt.Errorf("%s: no certificate presented", address)
+	}
+	return state.PeerCertificates[0].NotAfter, nil
+}
+
+func refreshCerts() {
+	update := func(listener string, expiry time.Time, err error) {
+		if err != nil {
+			log.Printf("tls certificate for %s: %v", listener, err)
+		}
+		certs.Lock()
+		certs.listeners[listener] = certStatus{expiry, err}
+		certs.Unlock()
+	}
+
+	for listener, path := range tlsCerts {
+		expiry, err := readCertExpiry(path)
+		update(listener, expiry, err)
+	}
+	for listener, address := range tlsProbes {
+		expiry, err := probeCertExpiry(address)
+		update(listener, expiry, err)
+	}
+}
+
+func tlsInit() {
+	if len(tlsCerts) == 0 && len(tlsProbes) == 0 {
+		return
+	}
+	go func() {
+		for {
+			refreshCerts()
+			time.Sleep(*tlsCertInterval)
+		}
+	}()
+}
+
+// tlsServerName classifies the SNI reported in smtp-in link-tls parameters
+// as a local hostname, "other" or "none", smtpd versions not reporting it
+// aren't accounted at all.
+func tlsServerName(params string) (string, bool) {
+	for _, field := range strings.Split(params, ",") {
+		field = strings.TrimSpace(field)
+		if !strings.HasPrefix(field, "sni=") && !strings.HasPrefix(field, "servername=") {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(field[strings.Index(field, "=")+1:], "."))
+		if name == "" {
+			return "none", true
+		}
+		for _, hostname := range tlsHostnames {
+			if name == strings.ToLower(hostname) {
+				return hostname, true
+			}
+		}
+		return "other", true
+	}
+	return "", false
+}
+
+// starttlsCommand notes that a STARTTLS command was sent, smtpd doesn't
+// report failed handshakes: a session accepting STARTTLS that ends without
+// link-tls is counted as one.
+func starttlsCommand(s *session, line string) {
+	if strings.EqualFold(strings.TrimSpace(line), "STARTTLS") {
+		s.starttls = true
+	}
+}
+
+// starttlsResponse forgets STARTTLS commands the server refused.
+func starttlsResponse(s *session, response string) {
+	if s.starttls && !s.tls && !strings.HasPrefix(response, "220") {
+		s.starttls = false
+	}
+}
+
+func tlsHandshakeFailure(m *metrics, s *session) {
+	if s.starttls && !s.tls {
+		m.tlsHandshakeFailures++
+	}
+}
+
+func tlsCollector(e *exposition) {
+	certs.Lock()
+	defer certs.Unlock()
+
+	listeners := make([]string, 0, len(certs.listeners))
+	for listener := range certs.listeners {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+
+	e.header("smtpd_tls_cert_expiry_timestamp_seconds", "The expiry date of the listener certificate.", "gauge", nil, "listener")
+	for _, listener := range listeners {
+		if status := certs.listeners[listener]; status.err == nil {
+			e.sample("smtpd_tls_cert_expiry_timestamp_seconds", label("listener", listener), float64(status.expiry.Unix()))
+		}
+	}
+	e.end()
+
+	e.header("smtpd_tls_cert_check_success", "Whether the last check of the listener certificate succeeded.", "gauge", nil, "listener")
+	for _, listener := range listeners {
+		success := 0
+		if certs.listeners[listener].err == nil {
+			success = 1
+		}
+		e.sample("smtpd_tls_cert_check_success", label("listener", listener), float64(success))
+	}
+	e.end()
+
+	if len(tlsHostnames) == 0 {
+		return
+	}
+	e.header("smtpd_tls_sni_total", "The number of smtp-in TLS sessions per server name requested by the client.", "counter", []*metrics{&smtpIn}, "sni")
+	for _, name := range append(append([]string{}, tlsHostnames...), "other", "none") {
+		e.sample("smtpd_tls_sni_total", label("direction", "smtp-in")+","+label("sni", name), float64(tlsSNI[name]))
+	}
+	e.end()
+}
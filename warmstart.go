@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var warmStart *time.Duration
+var warmStartStats *bool
+
+// sessions that existed before the filter started are unknown to it, the
+// active gauges are unreliable until they are gone.
+func warmStarting() bool {
+	return time.Since(startTime) < *warmStart
+}
+
+// seedSessions reads smtpd's own count of active sessions so that the
+// active gauges account for sessions opened before the filter started.
+func seedSessions() {
+	out, err := exec.Command(*smtpctl, "show", "stats").Output()
+	if err != nil {
+		log.Printf("%s show stats: %v", *smtpctl, err)
+		return
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		var m *metrics
+		switch fields[0] {
+		case "smtp.session":
+			m = &smtpIn
+		case "mta.session":
+			m = &smtpOut
+		default:
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		m.sessionsActive += n
+		m.sessionsSeeded += n
+	}
+}
+
+// seededDisconnect accounts for the disconnection of a session opened
+// before the filter started, if any are left.
+func seededDisconnect(m *metrics) bool {
+	if m.sessionsSeeded == 0 {
+		return false
+	}
+	m.sessionsSeeded--
+	m.decrement(&m.sessionsActive, "smtpd_sessions_active")
+	return true
+}
+
+func warmStartInit() {
+	if *warmStartStats {
+		metricsLock.Lock()
+		seedSessions()
+		metricsLock.Unlock()
+	}
+}
+
+func warmStartCollector(e *exposition) {
+	value := 0.0
+	if warmStarting() {
+		value = 1
+	}
+	e.header("smtpd_filter_warm_start", "Whether the filter started recently enough that active gauges may miss older sessions.", "gauge", nil)
+	e.sample("smtpd_filter_warm_start", "", value)
+	e.end()
+
+	e.header("smtpd_sessions_seeded", "The number of sessions opened before the filter started and still active.", "gauge", e.sets)
+	for _, m := range e.sets {
+		e.sample("smtpd_sessions_seeded", m.labels(), float64(m.sessionsSeeded))
+	}
+	e.end()
+}
@@ -0,0 +1,57 @@
+//
+// Copyright (c) 2020 Gilles Chehade <gilles@poolp.org>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+//
+
+package main
+
+import (
+	"time"
+)
+
+const windowBuckets = 30
+
+// window counts events over a sliding period using a ring buffer of
+// buckets, a bucket is recycled as soon as it falls out of the period.
+type window struct {
+	width  int64
+	slots  [windowBuckets]int64
+	counts [windowBuckets]uint64
+}
+
+func newWindow(period time.Duration) window {
+	return window{width: int64(period) / windowBuckets}
+}
+
+func (w *window) add(now time.Time, n uint64) {
+	slot := now.UnixNano() / w.width
+	i := slot % windowBuckets
+	if w.slots[i] != slot {
+		w.slots[i] = slot
+		w.counts[i] = 0
+	}
+	w.counts[i] += n
+}
+
+func (w *window) sum(now time.Time) uint64 {
+	slot := now.UnixNano() / w.width
+
+	total := uint64(0)
+	for i := 0; i < windowBuckets; i++ {
+		if slot-w.slots[i] < windowBuckets {
+			total += w.counts[i]
+		}
+	}
+	return total
+}